@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/audit"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/spf13/viper"
+)
+
+const testAdminToken = "secret"
+
+// useAdminToken configures the admin token for the test
+func useAdminToken(t *testing.T) {
+	previous := viper.GetString("admin-token")
+	viper.Set("admin-token", testAdminToken)
+	t.Cleanup(func() { viper.Set("admin-token", previous) })
+}
+
+// adminRequest makes a request carrying token, if it isn't empty
+func adminRequest(method string, target string, token string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// auditTrail reads the actions recorded in the audit trail
+func auditTrail(t *testing.T) []audit.Entry {
+	t.Helper()
+	f, err := os.Open(audit.Path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := []audit.Entry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := audit.Entry{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAdminActions(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	useAdminToken(t)
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	for _, token := range []string{"", "wrong"} {
+		for _, handler := range []http.HandlerFunc{ArchiveInstanceHandler(false), ArchiveInstanceHandler(true), DeleteInstanceHandler} {
+			if w := serve(handler, adminRequest(http.MethodPost, "/", token), vars); w.Code != http.StatusForbidden {
+				t.Errorf("token %q: responded %d, want %d", token, w.Code, http.StatusForbidden)
+			}
+		}
+	}
+	if entries := auditTrail(t); len(entries) != 0 {
+		t.Fatalf("refused actions were recorded: %v", entries)
+	}
+
+	w := serve(ArchiveInstanceHandler(false), adminRequest(http.MethodPost, "/", testAdminToken), vars)
+	if w.Code != http.StatusOK {
+		t.Fatalf("archive responded %d %s", w.Code, w.Body)
+	}
+	archived, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archived.State != instance.StateArchived || archived.Archived.IsZero() {
+		t.Errorf("archived instance is %s, archived at %v", archived.State, archived.Archived)
+	}
+	if page, err := instance.Find(instance.Query{}); err != nil || len(page.Instances) != 0 {
+		t.Errorf("archived instance is listed: %v %v", page, err)
+	}
+	if page, err := instance.Find(instance.Query{State: instance.StateArchived}); err != nil || len(page.Instances) != 1 {
+		t.Errorf("archived instance isn't listed when asked for: %v %v", page, err)
+	}
+
+	// nothing can be drawn on an archived instance
+	w = serve(NewSessionHandler, httptest.NewRequest(http.MethodPost, "/", nil), map[string]string{"instanceID": inst.ID.String(), "x": "1", "y": "1"})
+	if w.Code != http.StatusConflict {
+		t.Errorf("new session on an archived instance responded %d", w.Code)
+	}
+
+	w = serve(ArchiveInstanceHandler(true), adminRequest(http.MethodPost, "/", testAdminToken), vars)
+	if w.Code != http.StatusOK {
+		t.Fatalf("restore responded %d %s", w.Code, w.Body)
+	}
+	if _, err := session.NewSession(inst, 1, 1, nil); err != nil {
+		t.Errorf("new session on a restored instance: %v", err)
+	}
+
+	w = serve(DeleteInstanceHandler, adminRequest(http.MethodDelete, "/", testAdminToken), vars)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete responded %d %s", w.Code, w.Body)
+	}
+	if _, err := instance.Open(inst.ID.String()); err == nil {
+		t.Error("deleted instance can still be opened")
+	}
+
+	entries := auditTrail(t)
+	want := []string{"archive", "restore", "delete"}
+	if len(entries) != len(want) {
+		t.Fatalf("recorded %v, want %v", entries, want)
+	}
+	for n, entry := range entries {
+		if entry.Action != want[n] || entry.Instance != inst.ID || !strings.HasPrefix(entry.Actor, "admin@") || entry.Time.IsZero() {
+			t.Errorf("entry %d is %+v, want %s", n, entry, want[n])
+		}
+	}
+}
+
+func TestExportSessions(t *testing.T) {
+	inst := newTestInstance(t)
+	useAdminToken(t)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := session.NewSession(inst, 1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	w := serve(ExportHandler, adminRequest(http.MethodGet, "/?sessions=true", ""), vars)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("exporting sessions without the token responded %d", w.Code)
+	}
+
+	w = serve(ExportHandler, adminRequest(http.MethodGet, "/?sessions=true", testAdminToken), vars)
+	if w.Code != http.StatusOK {
+		t.Fatalf("responded %d", w.Code)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range archive.File {
+		found = found || f.Name == "sessions/"+s.ID.String()+"/session"
+	}
+	if !found {
+		t.Error("admin export left out the session")
+	}
+}
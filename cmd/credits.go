@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// CreditsHandler lists the contributors credited with each tile of an
+// instance
+func CreditsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	credits, err := inst.Credits()
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to list credits"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(credits)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall credits"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
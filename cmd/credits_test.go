@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+)
+
+func TestCredits(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	drawing := encodePNG(t, 10, 10, color.Black)
+
+	newSession := func(query string) (*session.Session, int) {
+		t.Helper()
+		w := serve(NewSessionHandler, httptest.NewRequest(http.MethodPost, "/?"+query, nil), map[string]string{"instanceID": inst.ID.String(), "x": "1", "y": "0"})
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		s := &session.Session{}
+		err := json.Unmarshal(w.Body.Bytes(), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, w.Code
+	}
+	save := func(s *session.Session, target string, contentType string, body []byte) int {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		return serve(SessionSaveImageHandler, r, map[string]string{"instanceID": inst.ID.String(), "sessionID": s.ID.String()}).Code
+	}
+
+	if _, status := newSession("handle=@ada"); status != http.StatusBadRequest {
+		t.Errorf("session crediting a handle without a name responded %d", status)
+	}
+	ada, status := newSession("name=Ada&handle=@ada")
+	if status != http.StatusOK {
+		t.Fatalf("new session responded %d", status)
+	}
+	anonymous, _ := newSession("")
+
+	// the session's contributor, then someone named by the save instead
+	if status := save(ada, "/", "image/png", drawing); status != http.StatusOK {
+		t.Fatalf("save responded %d", status)
+	}
+	form, body := multipartBody(t, drawing, map[string]string{"name": "Grace", "link": "https://example.com/grace", "title": "night"})
+	if status := save(ada, "/", form, body); status != http.StatusOK {
+		t.Fatalf("save responded %d", status)
+	}
+	if status := save(anonymous, "/?name=Alan", "image/png", drawing); status != http.StatusOK {
+		t.Fatalf("save responded %d", status)
+	}
+	if status := save(anonymous, "/", "image/png", drawing); status != http.StatusOK {
+		t.Fatalf("save responded %d", status)
+	}
+	if status := save(anonymous, "/?name=Alan&link=ftp://example.com", "image/png", drawing); status != http.StatusBadRequest {
+		t.Errorf("save with an invalid link responded %d", status)
+	}
+
+	latest, err := inst.Tile(ada.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title := latest.Versions[1].Metadata["title"]; title != "night" || len(latest.Versions[1].Metadata) != 1 {
+		t.Errorf("credit fields were kept as metadata: %v", latest.Versions[1].Metadata)
+	}
+
+	w := serve(CreditsHandler, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"instanceID": inst.ID.String()})
+	if w.Code != http.StatusOK {
+		t.Fatalf("credits responded %d", w.Code)
+	}
+	credits := []instance.TileCredit{}
+	err = json.Unmarshal(w.Body.Bytes(), &credits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credits) != 1 || credits[0].Location != ada.Location {
+		t.Fatalf("credited %v", credits)
+	}
+	want := []struct {
+		name     string
+		handle   string
+		versions []int
+	}{
+		{"Ada", "@ada", []int{1}},
+		{"Grace", "", []int{2}},
+		{"Alan", "", []int{3}},
+	}
+	contributors := credits[0].Contributors
+	if len(contributors) != len(want) {
+		t.Fatalf("credited %v", contributors)
+	}
+	for n, c := range contributors {
+		if c.Name != want[n].name || c.Handle != want[n].handle || len(c.Versions) != 1 || c.Versions[0] != want[n].versions[0] {
+			t.Errorf("contributor %d is %+v, want %+v", n, c, want[n])
+		}
+	}
+}
+
+func TestCompositeCredits(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	for mode, status := range map[string]int{"overlay": http.StatusOK, "legend": http.StatusOK, "banner": http.StatusBadRequest} {
+		w := serve(CompositeHandler, httptest.NewRequest(http.MethodGet, "/?credits="+mode, nil), vars)
+		if w.Code != status {
+			t.Errorf("%s credits responded %d, want %d", mode, w.Code, status)
+		}
+	}
+}
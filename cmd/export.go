@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export <instance>",
+	Short: "Export an instance to an archive",
+	Long: `Writes a self-contained archive of an instance, holding its source image,
+tiles, sessions and composite, which can be restored with the import command.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		output, _ := cmd.Flags().GetString("output")
+
+		inst, err := instance.Open(args[0])
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Failed to open instance"))
+		}
+		if output == "" {
+			output = fmt.Sprintf("%v.%s", inst.ID, format)
+		}
+
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Failed to create archive"))
+		}
+
+		err = inst.Export(f, instance.ExportOptions{Format: format, Sessions: true})
+		f.Close()
+		if err != nil {
+			os.Remove(output)
+			log.Fatal(err)
+		}
+		fmt.Printf("Exported instance %v to %s\n", inst.ID, output)
+	},
+}
+
+// ExportHandler serves an archive of an instance for download. Session
+// records are left out unless an admin asks for them with sessions=true,
+// anyone holding a session ID can save to its tile.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := instance.Open(vars["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	contentType := map[string]string{
+		"zip": "application/zip",
+		"tar": "application/x-tar",
+	}[format]
+	if contentType == "" {
+		http.Error(w, fmt.Sprintf("format must be one of %v", instance.ArchiveFormats), http.StatusBadRequest)
+		return
+	}
+
+	sessions := r.URL.Query().Get("sessions") == "true"
+	if sessions && !isAdmin(r) {
+		http.Error(w, "exporting sessions needs the admin token", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.%s"`, inst.ID, format))
+	err = inst.Export(w, instance.ExportOptions{Format: format, Sessions: sessions})
+	if err != nil {
+		// headers have gone, all that can be done is cut the archive short
+		log.Error(errors.Wrap(err, "Failed to export instance"))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().StringP("output", "o", "", "File to write the archive to (default is <instance>.<format>)")
+	exportCmd.Flags().String("format", "zip", "Archive format, zip or tar")
+}
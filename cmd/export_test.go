@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/session"
+)
+
+func TestExportHandler(t *testing.T) {
+	inst := newTestInstance(t)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.NewSession(inst, 1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	w := serve(ExportHandler, httptest.NewRequest(http.MethodGet, "/?format=rar", nil), vars)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format responded %d", w.Code)
+	}
+
+	w = serve(ExportHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("responded %d with %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range archive.File {
+		if strings.HasPrefix(f.Name, "sessions/") {
+			t.Errorf("exported %s, session IDs must not be given out", f.Name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/audit"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var instanceForkCmd = &cobra.Command{
+	Use:   "fork <instance>",
+	Short: "Create an instance from the current source, layout and tiles of another",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		tiles, _ := cmd.Flags().GetStringSlice("tile")
+		options := instance.ForkOptions{}
+		options.Title, _ = cmd.Flags().GetString("title")
+		options.Creator, _ = cmd.Flags().GetString("creator")
+		options.Share, _ = cmd.Flags().GetBool("share")
+
+		parent := openInstance(args[0])
+		for _, t := range tiles {
+			location, found := parent.FindTile(t)
+			if !found {
+				log.Fatalf("Instance %v has no tile called %s", parent.ID, t)
+			}
+			options.Tiles = append(options.Tiles, location)
+		}
+		fork, err := parent.Fork(options)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Failed to fork instance"))
+		}
+		err = audit.Record(audit.Entry{
+			Action:   "fork",
+			Instance: fork.ID,
+			Actor:    "cli:" + os.Getenv("USER"),
+			Detail:   fmt.Sprintf("from %v", parent.ID),
+		})
+		if err != nil {
+			log.Error(err)
+		}
+		writeInstance(cmd, fork)
+	},
+}
+
+// ForkInstanceHandler creates an instance from the current source, layout
+// and tiles of another, which is left as it is. Only some tiles are carried
+// over if tile parameters, each naming a tile, are given. Image files are
+// shared with the parent unless share=false. Only admins can fork instances.
+func ForkInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "this needs the admin token", http.StatusForbidden)
+		return
+	}
+
+	parent, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	options := instance.ForkOptions{
+		Title:   query.Get("title"),
+		Creator: query.Get("creator"),
+		Share:   true,
+	}
+	if share := query.Get("share"); share != "" {
+		options.Share, err = strconv.ParseBool(share)
+		if err != nil {
+			http.Error(w, "share must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, t := range query["tile"] {
+		location, found := parent.FindTile(t)
+		if !found {
+			http.Error(w, fmt.Sprintf("there is no tile called %s", t), http.StatusBadRequest)
+			return
+		}
+		options.Tiles = append(options.Tiles, location)
+	}
+
+	fork, err := parent.Fork(options)
+	if gerr, ok := err.(*instance.GridError); ok {
+		http.Error(w, gerr.Reason, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to fork instance %v", parent.ID))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = audit.Record(audit.Entry{
+		Action:   "fork",
+		Instance: fork.ID,
+		Actor:    "admin@" + r.RemoteAddr,
+		Detail:   fmt.Sprintf("from %v", parent.ID),
+	})
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to record fork of instance %v", parent.ID))
+	}
+
+	json, err := json.Marshal(fork)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall instance data"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+func init() {
+	instanceCmd.AddCommand(instanceForkCmd)
+
+	instanceForkCmd.Flags().StringSlice("tile", nil, "Tiles to carry over by name, x,y in a grid, every tile is if none are given")
+	instanceForkCmd.Flags().String("title", "", "Title of the fork, the parent's title if it isn't given")
+	instanceForkCmd.Flags().String("creator", "", "Who the fork was created by")
+	instanceForkCmd.Flags().Bool("share", true, "Hard link image files rather than copying them")
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+)
+
+func TestForkInstanceHandler(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	useAdminToken(t)
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	if w := serve(ForkInstanceHandler, adminRequest(http.MethodPost, "/", ""), vars); w.Code != http.StatusForbidden {
+		t.Fatalf("forking without the token responded %d", w.Code)
+	}
+	for _, query := range []string{"share=maybe", "tile=one", "tile=6,0"} {
+		if w := serve(ForkInstanceHandler, adminRequest(http.MethodPost, "/?"+query, testAdminToken), vars); w.Code != http.StatusBadRequest {
+			t.Errorf("forking with %s responded %d", query, w.Code)
+		}
+	}
+	if len(auditTrail(t)) != 0 {
+		t.Error("recorded forks which weren't made")
+	}
+
+	w := serve(ForkInstanceHandler, adminRequest(http.MethodPost, "/?title=copy&tile=1,1", testAdminToken), vars)
+	if w.Code != http.StatusOK {
+		t.Fatalf("forking responded %d %s", w.Code, w.Body)
+	}
+	fork := &instance.Instance{}
+	err := json.Unmarshal(w.Body.Bytes(), fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fork.Title != "copy" || fork.ForkedFrom == nil || fork.ForkedFrom.Parent != inst.ID {
+		t.Errorf("forked %+v", fork)
+	}
+	entries := auditTrail(t)
+	if len(entries) != 1 || entries[0].Action != "fork" || entries[0].Instance != fork.ID || entries[0].Detail != "from "+inst.ID.String() {
+		t.Errorf("recorded %v", entries)
+	}
+}
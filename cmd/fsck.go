@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// fsckCmd represents the fsck command
+var fsckCmd = &cobra.Command{
+	Use:   "fsck [instance...]",
+	Short: "Verify and repair the data folder",
+	Long: `Scans instances for unreadable records, missing source images, tiles with the
+wrong dimensions or outside the layout, orphaned sessions and stale composites.
+
+With --repair bad files are moved to the quarantine folder in the data folder,
+records with trailing data are rewritten and composites are regenerated.
+Exits with status 1 if any problem is left unrepaired.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		repair, _ := cmd.Flags().GetBool("repair")
+
+		options := instance.CheckOptions{Repair: repair}
+		for _, id := range args {
+			parsed, err := uuid.Parse(id)
+			if err != nil {
+				log.Fatal(errors.Wrap(err, id+" is not a valid instance ID"))
+			}
+			options.Instances = append(options.Instances, parsed)
+		}
+
+		problems, err := instance.Check(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if outputJSON(cmd) {
+			writeJSON(problems)
+		} else {
+			for _, p := range problems {
+				fmt.Printf("%s: %s\n", p.Path, p.Reason)
+				if p.Repair != "" {
+					fmt.Printf("  repaired: %s\n", p.Repair)
+				}
+			}
+		}
+
+		unrepaired := 0
+		for _, p := range problems {
+			if p.Repair == "" {
+				unrepaired++
+			}
+		}
+		if !outputJSON(cmd) {
+			fmt.Printf("%d problems found, %d repaired\n", len(problems), len(problems)-unrepaired)
+		}
+		if unrepaired > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+
+	fsckCmd.Flags().Bool("repair", false, "Quarantine bad files and regenerate composites")
+	fsckCmd.Flags().StringP("output", "o", "table", "Output format, table or json")
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import <archive>",
+	Short: "Import an instance from an archive",
+	Long: `Restores an instance from an archive written by the export command. Every
+file is checked against the archive's manifest before anything is saved.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, _ := cmd.Flags().GetString("id")
+		newID, _ := cmd.Flags().GetBool("new-id")
+
+		options := instance.ImportOptions{}
+		if id != "" {
+			parsed, err := uuid.Parse(id)
+			if err != nil {
+				log.Fatal(errors.Wrap(err, id+" is not a valid instance ID"))
+			}
+			options.ID = parsed
+		} else if newID {
+			options.ID = uuid.New()
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Failed to open archive"))
+		}
+		defer f.Close()
+
+		inst, err := instance.Import(f, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Imported instance %v\n", inst.ID)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().String("id", "", "Import the instance with this ID instead of the one in the archive")
+	importCmd.Flags().Bool("new-id", false, "Import the instance with a newly generated ID")
+}
@@ -0,0 +1,367 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/audit"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// instanceCmd represents the instance command
+var instanceCmd = &cobra.Command{
+	Use:   "instance",
+	Short: "Manage instances",
+	Long: `Creates, inspects and removes instances directly in the data folder, without
+going through a running server.`,
+}
+
+var instanceCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an instance",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		source, _ := cmd.Flags().GetString("source")
+		cols, _ := cmd.Flags().GetInt("cols")
+		rows, _ := cmd.Flags().GetInt("rows")
+		title, _ := cmd.Flags().GetString("title")
+		creator, _ := cmd.Flags().GetString("creator")
+		keep, _ := cmd.Flags().GetInt("keep-tile-versions")
+		mode, _ := cmd.Flags().GetString("mode")
+		votingPeriod, _ := cmd.Flags().GetDuration("voting-period")
+		pattern, _ := cmd.Flags().GetString("pattern")
+		layoutPath, _ := cmd.Flags().GetString("layout")
+		seam, err := seamFlags(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		inst, err := instance.NewWithOptions(instance.Options{
+			SourceImagePath:  source,
+			Cols:             cols,
+			Rows:             rows,
+			Pattern:          pattern,
+			Layout:           readLayoutFile(layoutPath),
+			Title:            title,
+			Creator:          creator,
+			KeepTileVersions: keep,
+			Mode:             mode,
+			VotingPeriod:     votingPeriod,
+			Seam:             seam,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = inst.StitchSessionImage()
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeInstance(cmd, inst)
+	},
+}
+
+var instanceListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List instances",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		instances, err := instance.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		summaries := make([]instanceDetail, len(instances))
+		for n, inst := range instances {
+			summaries[n] = newInstanceDetail(inst)
+		}
+
+		if outputJSON(cmd) {
+			writeJSON(summaries)
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTITLE\tSTATE\tGRID\tFILLED\tVERSION\tSOURCE")
+		for _, s := range summaries {
+			grid := fmt.Sprintf("%dx%d", s.StepCountX, s.StepCountY)
+			if s.Layout != nil {
+				grid = "layout"
+			}
+			fmt.Fprintf(w, "%v\t%s\t%s\t%s\t%d/%d\t%d\t%s\n", s.ID, s.Title, s.State, grid,
+				s.TilesFilled, s.TileCount(), s.CompositeVersion, s.SourceImagePath)
+		}
+		w.Flush()
+	},
+}
+
+var instanceShowCmd = &cobra.Command{
+	Use:   "show <instance>",
+	Short: "Show an instance and which of its tiles have been drawn",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		writeInstance(cmd, openInstance(args[0]))
+	},
+}
+
+var instanceDeleteCmd = &cobra.Command{
+	Use:   "delete <instance>...",
+	Short: "Delete instances and everything saved for them",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, id := range args {
+			inst := openInstance(id)
+			err := inst.Delete()
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = audit.Record(audit.Entry{
+				Action:   "delete",
+				Instance: inst.ID,
+				Actor:    "cli:" + os.Getenv("USER"),
+				Detail:   inst.Title,
+			})
+			if err != nil {
+				log.Error(err)
+			}
+			fmt.Printf("Deleted instance %v\n", inst.ID)
+		}
+	},
+}
+
+var instanceBallotsCmd = &cobra.Command{
+	Use:   "ballots <instance>",
+	Short: "Issue ballots for voting on a competitive instance",
+	Long: `Issues ballots for voting on the candidates of a competitive instance and
+prints them, one per line. Each ballot holds one vote for each tile in every
+round. Only a hash of each ballot is kept, so they can't be printed again.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		count, _ := cmd.Flags().GetInt("count")
+		inst := openInstance(args[0])
+		ballots, err := inst.IssueBallots(count)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = audit.Record(audit.Entry{
+			Action:   "issue-ballots",
+			Instance: inst.ID,
+			Actor:    "cli:" + os.Getenv("USER"),
+			Detail:   inst.Title,
+		})
+		if err != nil {
+			log.Error(err)
+		}
+		for _, ballot := range ballots {
+			fmt.Println(ballot)
+		}
+	},
+}
+
+var instanceRestitchCmd = &cobra.Command{
+	Use:   "restitch <instance>...",
+	Short: "Render the composite of instances again from their tiles",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, id := range args {
+			inst := openInstance(id)
+			err := inst.StitchSessionImage()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("Restitched instance %v, composite version %d\n", inst.ID, inst.CompositeVersion)
+		}
+	},
+}
+
+var instanceRoundCmd = &cobra.Command{
+	Use:   "round <instance>",
+	Short: "Start the next round of a complete instance over its composite",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		options := instance.RoundOptions{}
+		options.Cols, _ = cmd.Flags().GetInt("cols")
+		options.Rows, _ = cmd.Flags().GetInt("rows")
+		options.OffsetX, _ = cmd.Flags().GetInt("offset-x")
+		options.OffsetY, _ = cmd.Flags().GetInt("offset-y")
+		layoutPath, _ := cmd.Flags().GetString("layout")
+		options.Layout = readLayoutFile(layoutPath)
+
+		inst := openInstance(args[0])
+		err := inst.StartRound(options)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Failed to start round"))
+		}
+		err = audit.Record(audit.Entry{
+			Action:   "new-round",
+			Instance: inst.ID,
+			Actor:    "cli:" + os.Getenv("USER"),
+			Detail:   inst.Title,
+		})
+		if err != nil {
+			log.Error(err)
+		}
+		writeInstance(cmd, inst)
+	},
+}
+
+// instanceDetail is an instance along with the state of its tiles
+type instanceDetail struct {
+	*instance.Instance
+	// TilesFilled is counted from the tiles rather than taken from the
+	// instance record, so it is right even if the record isn't
+	TilesFilled int `json:"tilesFilled"`
+	// Tiles holds the number of versions saved for each tile, by the row and
+	// column of its location. Places in a layout with no tile hold -1.
+	Tiles [][]int `json:"tiles"`
+}
+
+func newInstanceDetail(inst *instance.Instance) instanceDetail {
+	detail := instanceDetail{
+		Instance: inst,
+		Tiles:    [][]int{},
+	}
+	for _, region := range inst.Regions() {
+		for len(detail.Tiles) <= region.Location.Y {
+			detail.Tiles = append(detail.Tiles, []int{})
+		}
+		row := detail.Tiles[region.Location.Y]
+		for len(row) <= region.Location.X {
+			row = append(row, -1)
+		}
+		detail.Tiles[region.Location.Y] = row
+
+		t, err := inst.Tile(region.Location)
+		if err != nil {
+			log.Warn(errors.Wrap(err, "failed to load contribution"))
+			continue
+		}
+		row[region.Location.X] = len(t.Versions)
+		if len(t.Versions) > 0 {
+			detail.TilesFilled++
+		}
+	}
+	return detail
+}
+
+func openInstance(id string) *instance.Instance {
+	inst, err := instance.Open(id)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Failed to open instance"))
+	}
+	return inst
+}
+
+func writeInstance(cmd *cobra.Command, inst *instance.Instance) {
+	detail := newInstanceDetail(inst)
+	if outputJSON(cmd) {
+		writeJSON(detail)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%v\n", inst.ID)
+	fmt.Fprintf(w, "Title:\t%s\n", inst.Title)
+	fmt.Fprintf(w, "Creator:\t%s\n", inst.Creator)
+	fmt.Fprintf(w, "State:\t%s\n", inst.State)
+	fmt.Fprintf(w, "Mode:\t%s\n", inst.Mode)
+	fmt.Fprintf(w, "Round:\t%d\n", inst.Round)
+	if inst.Mode == instance.ModeCompetitive {
+		fmt.Fprintf(w, "Voting round:\t%d (closes %s)\n", inst.VotingRound, formatTime(inst.VotingCloses))
+	}
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(inst.Created))
+	fmt.Fprintf(w, "Updated:\t%s\n", formatTime(inst.Updated))
+	fmt.Fprintf(w, "Source:\t%s (%dx%d)\n", inst.SourceImagePath, inst.SourceImageWidth, inst.SourceImageHeight)
+	if inst.Layout != nil {
+		fmt.Fprintf(w, "Layout:\t%d tiles\n", len(inst.Layout))
+	} else {
+		fmt.Fprintf(w, "Grid:\t%dx%d tiles of %dx%d, offset by %d,%d\n", inst.StepCountX, inst.StepCountY, inst.StepSizeX, inst.StepSizeY, inst.OffsetX, inst.OffsetY)
+	}
+	if inst.Seam != nil {
+		fmt.Fprintf(w, "Seam:\t%s\n", strings.TrimSpace(fmt.Sprintf("%s, %d pixels %s", inst.Seam.Style, inst.Seam.Width, inst.Seam.Colour)))
+	}
+	fmt.Fprintf(w, "Composite:\t%s (version %d)\n", inst.CompositeImageUrl, inst.CompositeVersion)
+	fmt.Fprintf(w, "Filled:\t%d/%d\n", detail.TilesFilled, inst.TileCount())
+	w.Flush()
+
+	fmt.Println()
+	writeFillMap(os.Stdout, detail.Tiles)
+}
+
+// writeFillMap draws the tiles by location, with # for those which have
+// been drawn and . for those which haven't
+func writeFillMap(w io.Writer, tiles [][]int) {
+	for _, row := range tiles {
+		cells := make([]string, len(row))
+		for x, versions := range row {
+			switch {
+			case versions < 0:
+				cells[x] = " "
+			case versions > 0:
+				cells[x] = "#"
+			default:
+				cells[x] = "."
+			}
+		}
+		fmt.Fprintln(w, strings.Join(cells, " "))
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func outputJSON(cmd *cobra.Command) bool {
+	output, _ := cmd.Flags().GetString("output")
+	switch output {
+	case "json":
+		return true
+	case "table":
+		return false
+	default:
+		log.Fatalf("Unknown output format %s, must be table or json", output)
+		return false
+	}
+}
+
+func writeJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Failed to marshall output"))
+	}
+	fmt.Println(string(data))
+}
+
+func init() {
+	rootCmd.AddCommand(instanceCmd)
+	instanceCmd.AddCommand(instanceCreateCmd, instanceListCmd, instanceShowCmd, instanceDeleteCmd, instanceBallotsCmd, instanceRestitchCmd, instanceRoundCmd)
+
+	instanceCmd.PersistentFlags().StringP("output", "o", "table", "Output format, table or json")
+
+	instanceCreateCmd.Flags().String("source", "assets/paper4.jpg", "Source image to divide into tiles")
+	instanceCreateCmd.Flags().Int("cols", instance.DefaultStepCount, "Number of columns of tiles")
+	instanceCreateCmd.Flags().Int("rows", instance.DefaultStepCount, "Number of rows of tiles")
+	instanceCreateCmd.Flags().String("pattern", instance.PatternGrid, "Pattern the columns and rows of tiles are laid out in, grid or brick")
+	instanceCreateCmd.Flags().String("layout", "", "JSON file listing the name, location and bounds of each tile, instead of columns and rows")
+	instanceCreateCmd.Flags().String("title", "", "Title of the instance")
+	instanceCreateCmd.Flags().String("creator", "", "Who the instance was created by")
+	instanceCreateCmd.Flags().Int("keep-tile-versions", 0, "Versions of each tile kept when the janitor prunes old ones, 0 keeps them all")
+	instanceCreateCmd.Flags().String("mode", instance.ModeLatest, "How saved tiles are taken up, latest or competitive")
+	instanceCreateCmd.Flags().Duration("voting-period", 0, "How long each voting round of a competitive instance lasts, 0 leaves closing them to an admin")
+	instanceBallotsCmd.Flags().Int("count", 1, "Number of ballots to issue")
+
+	instanceRoundCmd.Flags().Int("cols", 0, "Number of columns of tiles, 0 keeps the current number")
+	instanceRoundCmd.Flags().Int("rows", 0, "Number of rows of tiles, 0 keeps the current number")
+	instanceRoundCmd.Flags().Int("offset-x", 0, "Pixels the grid is moved right from the left edge of the composite")
+	instanceRoundCmd.Flags().Int("offset-y", 0, "Pixels the grid is moved down from the top edge of the composite")
+	instanceRoundCmd.Flags().String("layout", "", "JSON file listing the name, location and bounds of each tile, instead of a grid")
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bytes"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+)
+
+func TestInstanceDetail(t *testing.T) {
+	inst := newTestInstance(t)
+	for _, location := range []tile.Location{{X: 0, Y: 0}, {X: 5, Y: 2}, {X: 0, Y: 0}} {
+		submission, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = inst.UpdateTile(location, submission)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	detail := newInstanceDetail(inst)
+	if detail.TilesFilled != 2 {
+		t.Errorf("%d tiles filled, want 2", detail.TilesFilled)
+	}
+	if len(detail.Tiles) != 6 || detail.Tiles[0][0] != 2 || detail.Tiles[2][5] != 1 || detail.Tiles[2][4] != 0 {
+		t.Errorf("tile versions are %v", detail.Tiles)
+	}
+
+	var fillMap bytes.Buffer
+	writeFillMap(&fillMap, [][]int{{2, 0, 0}, {0, 0, 1}})
+	if got, want := fillMap.String(), "# . .\n. . #\n"; got != want {
+		t.Errorf("fill map is\n%swant\n%s", got, want)
+	}
+}
+
+func TestInstanceNotFound(t *testing.T) {
+	useTempData(t)
+	for _, id := range []string{uuid.New().String(), "not-an-id"} {
+		w := serve(InstanceInfoHandler, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"instanceID": id})
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: responded %d, want %d", id, w.Code, http.StatusNotFound)
+		}
+	}
+	w := serve(CompositeHandler, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"instanceID": uuid.New().String()})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("composite of an unknown instance responded %d", w.Code)
+	}
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/audit"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+)
+
+// InstancesHandler lists summaries of instances a page at a time. They can
+// be filtered by state and creator, and sorted by creation time, recent
+// activity or completion.
+func InstancesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	params := r.URL.Query()
+	q := instance.Query{
+		State:   params.Get("state"),
+		Creator: params.Get("creator"),
+		Sort:    params.Get("sort"),
+		Cursor:  params.Get("cursor"),
+		Limit:   defaultListLimit,
+	}
+	switch params.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be a number from 1 to %d", maxListLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	page, err := instance.Find(q)
+	if err != nil {
+		if qerr, ok := err.(*instance.QueryError); ok {
+			http.Error(w, qerr.Reason, http.StatusBadRequest)
+			return
+		}
+		log.Error(errors.Wrap(err, "Failed to list instances"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(page)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall instance list"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// isAdmin reports whether a request carries the admin token. Nobody is an
+// admin if the token isn't configured.
+func isAdmin(r *http.Request) bool {
+	token := viper.GetString("admin-token")
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// openAdminInstance opens the instance an admin request is for, responding
+// with an error and returning nil if it can't be or the request isn't from
+// an admin
+func openAdminInstance(w http.ResponseWriter, r *http.Request) *instance.Instance {
+	if !isAdmin(r) {
+		http.Error(w, "this needs the admin token", http.StatusForbidden)
+		return nil
+	}
+
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return nil
+	}
+	if inst.ID == defaultInstance.ID {
+		http.Error(w, "the default instance can't be changed", http.StatusConflict)
+		return nil
+	}
+	return inst
+}
+
+func recordAdminAction(r *http.Request, action string, inst *instance.Instance) {
+	err := audit.Record(audit.Entry{
+		Action:   action,
+		Instance: inst.ID,
+		Actor:    "admin@" + r.RemoteAddr,
+		Detail:   inst.Title,
+	})
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to record %s of instance %v", action, inst.ID))
+	}
+}
+
+// DeleteInstanceHandler permanently removes an instance along with its tiles,
+// sessions, composites and any renditions of them. Only admins can delete
+// instances.
+func DeleteInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	inst := openAdminInstance(w, r)
+	if inst == nil {
+		return
+	}
+
+	sessions, err := session.List(inst)
+	if err != nil {
+		log.Warn(err)
+	}
+	err = inst.Delete()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(r, "delete", inst)
+
+	renditions.Invalidate(fmt.Sprintf("composite/%v/", inst.ID))
+	renditions.Invalidate(fmt.Sprintf("tile/%v/", inst.ID))
+	for _, s := range sessions {
+		renditions.Invalidate(fmt.Sprintf("background/%v/", s.ID))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ArchiveInstanceHandler makes an instance read-only and hides it from
+// listings, or with restore undoes that. Only admins can archive instances.
+func ArchiveInstanceHandler(restore bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			return
+		}
+
+		inst := openAdminInstance(w, r)
+		if inst == nil {
+			return
+		}
+
+		var err error
+		action := "archive"
+		if restore {
+			action = "restore"
+			err = inst.Restore()
+		} else {
+			err = inst.Archive()
+		}
+		if err != nil {
+			log.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		recordAdminAction(r, action, inst)
+
+		json, err := json.Marshal(inst)
+		if err != nil {
+			log.Error(errors.Wrap(err, "Failed to marshall instance data"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(json)
+	}
+}
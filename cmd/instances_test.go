@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+)
+
+func TestInstancesHandler(t *testing.T) {
+	inst := newTestInstance(t)
+
+	tests := []struct {
+		query  string
+		status int
+		listed int
+	}{
+		{"", http.StatusOK, 1},
+		{"?state=open&sort=completion&order=asc&limit=5", http.StatusOK, 1},
+		{"?state=complete", http.StatusOK, 0},
+		{"?state=finished", http.StatusBadRequest, 0},
+		{"?sort=title", http.StatusBadRequest, 0},
+		{"?order=up", http.StatusBadRequest, 0},
+		{"?limit=0", http.StatusBadRequest, 0},
+		{"?limit=101", http.StatusBadRequest, 0},
+		{"?cursor=!!", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		w := serve(InstancesHandler, httptest.NewRequest(http.MethodGet, "/"+test.query, nil), nil)
+		if w.Code != test.status {
+			t.Errorf("%s: responded %d %s, want %d", test.query, w.Code, w.Body, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		page := &instance.Page{}
+		err := json.Unmarshal(w.Body.Bytes(), page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Instances) != test.listed || (test.listed > 0 && page.Instances[0].ID != inst.ID) {
+			t.Errorf("%s: listed %+v", test.query, page.Instances)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"github.com/andrewmyhre/donk-server/pkg/janitor"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/spf13/viper"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// janitorCmd represents the janitor command
+var janitorCmd = &cobra.Command{
+	Use:   "janitor",
+	Short: "Remove data which is no longer needed",
+	Long: `Makes a single pass over every instance, removing the backgrounds of sessions
+which have expired or been abandoned, archived instances kept for longer than
+the archive retention and tile versions beyond each instance's retention
+policy. The server does the same periodically while it runs.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		session.IdleTimeout = viper.GetDuration("session-idle-timeout")
+		report := janitor.Run(janitorPolicy())
+		writeJSON(report)
+	},
+}
+
+func janitorPolicy() janitor.Policy {
+	return janitor.Policy{
+		ArchiveRetention: viper.GetDuration("archive-retention"),
+		DryRun:           viper.GetBool("janitor-dry-run"),
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(janitorCmd)
+
+	// shared with serve, which runs the janitor in the background
+	rootCmd.PersistentFlags().Duration("session-idle-timeout", session.IdleTimeout, "How long a session can go without saving before it expires")
+	viper.BindPFlag("session-idle-timeout", rootCmd.PersistentFlags().Lookup("session-idle-timeout"))
+	rootCmd.PersistentFlags().Duration("archive-retention", 30*24*time.Hour, "How long archived instances are kept before the janitor deletes them, forever if 0")
+	viper.BindPFlag("archive-retention", rootCmd.PersistentFlags().Lookup("archive-retention"))
+	rootCmd.PersistentFlags().Bool("janitor-dry-run", false, "Report what the janitor would remove without removing anything")
+	viper.BindPFlag("janitor-dry-run", rootCmd.PersistentFlags().Lookup("janitor-dry-run"))
+}
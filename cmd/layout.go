@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// maxLayoutBytes is the largest layout accepted in a request body
+const maxLayoutBytes = 1 << 20
+
+// readLayout decodes a layout written as a JSON list of tiles, each with a
+// name, location and bounds
+func readLayout(r io.Reader) (tile.Layout, error) {
+	layout := tile.Layout{}
+	err := json.NewDecoder(r).Decode(&layout)
+	if err != nil {
+		return nil, errors.Wrap(err, "Layout must be a JSON list of tiles")
+	}
+	return layout, nil
+}
+
+// readLayoutFile reads a layout from a file for the CLI, it returns nil if
+// no file is given
+func readLayoutFile(layoutPath string) tile.Layout {
+	if layoutPath == "" {
+		return nil
+	}
+	f, err := os.Open(layoutPath)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "Failed to open layout"))
+	}
+	defer f.Close()
+	layout, err := readLayout(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return layout
+}
+
+// layoutBody reads a layout sent as the JSON body of a request. It returns
+// nil if the body isn't JSON.
+func layoutBody(r *http.Request) (tile.Layout, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil, nil
+	}
+	return readLayout(io.LimitReader(r.Body, maxLayoutBytes))
+}
+
+// tileLocation finds the tile of inst a request is for, named by the tile
+// variable or given by x and y. If the instance doesn't have it it responds
+// with 404 and returns false.
+func tileLocation(w http.ResponseWriter, inst *instance.Instance, vars map[string]string) (tile.Location, bool) {
+	return layoutLocation(w, inst.Regions(), vars)
+}
+
+// layoutLocation finds the tile of layout a request is for, as tileLocation
+// does
+func layoutLocation(w http.ResponseWriter, layout tile.Layout, vars map[string]string) (tile.Location, bool) {
+	if name, provided := vars["tile"]; provided {
+		region := layout.Named(name)
+		if region == nil {
+			http.Error(w, fmt.Sprintf("there is no tile called %s", name), http.StatusNotFound)
+			return tile.Location{}, false
+		}
+		return region.Location, true
+	}
+
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	location := tile.Location{X: x, Y: y}
+	if layout.Find(location) == nil {
+		http.Error(w, fmt.Sprintf("tile %v is outside the instance layout", location), http.StatusNotFound)
+		return location, false
+	}
+	return location, true
+}
+
+// LayoutHandler lists the tiles of an instance's current round with the
+// name they're addressed by and the part of the composite they cover
+func LayoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(inst.Regions())
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall layout"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+func TestNamedTiles(t *testing.T) {
+	newTestInstance(t)
+	useRenditions(t)
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath: filepath.Join(instance.DataPath, "source.png"),
+		Layout: tile.Layout{
+			{Name: "sky", Bounds: image.Rect(0, 0, 60, 30)},
+			{Name: "sea", Bounds: image.Rect(0, 30, 60, 60)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(LayoutHandler, httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"instanceID": inst.ID.String()})
+	if w.Code != http.StatusOK {
+		t.Fatalf("layout responded %d", w.Code)
+	}
+	layout := tile.Layout{}
+	err = json.Unmarshal(w.Body.Bytes(), &layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout) != 2 || layout[1].Name != "sea" || layout[1].Location != (tile.Location{X: 1}) {
+		t.Errorf("listed layout %+v", layout)
+	}
+
+	tests := []struct {
+		vars   map[string]string
+		status int
+		want   tile.Location
+	}{
+		{map[string]string{"tile": "sea"}, http.StatusOK, tile.Location{X: 1}},
+		{map[string]string{"x": "0", "y": "0"}, http.StatusOK, tile.Location{}},
+		{map[string]string{"tile": "moon"}, http.StatusNotFound, tile.Location{}},
+		// the grid the layout replaced has no tile 0,1
+		{map[string]string{"x": "0", "y": "1"}, http.StatusNotFound, tile.Location{}},
+	}
+	for _, test := range tests {
+		test.vars["instanceID"] = inst.ID.String()
+		w := serve(NewSessionHandler, httptest.NewRequest(http.MethodPost, "/", nil), test.vars)
+		if w.Code != test.status {
+			t.Errorf("new session for %v responded %d, want %d", test.vars, w.Code, test.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		s := &session.Session{}
+		err := json.Unmarshal(w.Body.Bytes(), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Location != test.want {
+			t.Errorf("new session for %v is at %v, want %v", test.vars, s.Location, test.want)
+		}
+	}
+}
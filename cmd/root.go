@@ -19,6 +19,7 @@ import (
   "fmt"
   "os"
   "github.com/spf13/cobra"
+  "github.com/andrewmyhre/donk-server/pkg/instance"
 
   homedir "github.com/mitchellh/go-homedir"
   "github.com/spf13/viper"
@@ -56,6 +57,8 @@ func init() {
   // will be global for your application.
 
   rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.donk-server.yaml)")
+  rootCmd.PersistentFlags().String("data-dir", instance.DataPath, "folder instances are stored in")
+  viper.BindPFlag("data-dir", rootCmd.PersistentFlags().Lookup("data-dir"))
 
 
   // Cobra also supports local flags, which will only run
@@ -86,7 +89,9 @@ func initConfig() {
 
   // If a config file is found, read it in.
   if err := viper.ReadInConfig(); err == nil {
-    fmt.Println("Using config file:", viper.ConfigFileUsed())
+    fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
   }
+
+  instance.DataPath = viper.GetString("data-dir")
 }
 
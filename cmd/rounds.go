@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// roundSummary describes a round of an instance as it is listed
+type roundSummary struct {
+	instance.Round
+	Current           bool   `json:"current"`
+	CompositeImageUrl string `json:"compositeImageUrl"`
+}
+
+// roundSummaries lists every round of an instance, the current one last
+func roundSummaries(inst *instance.Instance) []roundSummary {
+	rounds := make([]roundSummary, 0, len(inst.Rounds)+1)
+	for _, round := range inst.Rounds {
+		rounds = append(rounds, roundSummary{
+			Round:             round,
+			CompositeImageUrl: fmt.Sprintf("/v1/instance/%v/round/%d/composite", inst.ID, round.Number),
+		})
+	}
+	started := inst.RoundStarted
+	if started.IsZero() {
+		started = inst.Created
+	}
+	rounds = append(rounds, roundSummary{
+		Round: instance.Round{
+			Number:           inst.Round,
+			SourceImagePath:  inst.SourceImagePath,
+			Cols:             inst.StepCountX,
+			Rows:             inst.StepCountY,
+			OffsetX:          inst.OffsetX,
+			OffsetY:          inst.OffsetY,
+			Layout:           inst.Layout,
+			TilesFilled:      inst.TilesFilled,
+			CompositeVersion: inst.CompositeVersion,
+			Started:          started,
+		},
+		Current:           true,
+		CompositeImageUrl: inst.CompositeImageUrl,
+	})
+	return rounds
+}
+
+// RoundsHandler lists the rounds of an instance, with where to fetch the
+// composite each of them ended with
+func RoundsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	json, err := json.Marshal(roundSummaries(inst))
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall rounds"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// RoundCompositeHandler serves the composite an earlier round of an instance
+// ended with
+func RoundCompositeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := instance.Open(vars["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	number, _ := strconv.Atoi(vars["round"])
+	round := inst.FindRound(number)
+	if round == nil {
+		http.Error(w, fmt.Sprintf("instance has no finished round %d", number), http.StatusNotFound)
+		return
+	}
+
+	compositePath := inst.RoundCompositePath(round.Number)
+	modified := time.Time{}
+	if info, err := os.Stat(compositePath); err == nil {
+		modified = info.ModTime()
+	}
+	// the composites of finished rounds never change
+	writeImage(w, r, storedImage{
+		key:      fmt.Sprintf("round/%v/%d/%d", inst.ID, round.Number, round.CompositeVersion),
+		format:   "jpeg",
+		modified: modified,
+		read: func() ([]byte, error) {
+			data, err := ioutil.ReadFile(compositePath)
+			if err != nil {
+				return nil, errors.Wrap(err, "Couldn't provide round composite image")
+			}
+			return data, nil
+		},
+	})
+}
+
+// NewRoundHandler finishes the current round of a complete instance and
+// starts the next one over its composite. The grid can be changed with the
+// cols, rows, offsetX and offsetY parameters so that the seams between tiles
+// move, or replaced by a layout sent as the JSON body. Only admins can start
+// rounds.
+func NewRoundHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	inst := openAdminInstance(w, r)
+	if inst == nil {
+		return
+	}
+
+	options := instance.RoundOptions{}
+	params := r.URL.Query()
+	for name, value := range map[string]*int{
+		"cols":    &options.Cols,
+		"rows":    &options.Rows,
+		"offsetX": &options.OffsetX,
+		"offsetY": &options.OffsetY,
+	} {
+		if param := params.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 {
+				http.Error(w, name+" must be a positive number", http.StatusBadRequest)
+				return
+			}
+			*value = n
+		}
+	}
+	var err error
+	options.Layout, err = layoutBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = inst.StartRound(options)
+	if cause := errors.Cause(err); cause == instance.ErrIncomplete || cause == instance.ErrArchived {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if gerr, ok := err.(*instance.GridError); ok {
+		http.Error(w, gerr.Reason, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(r, "new-round", inst)
+
+	json, err := json.Marshal(inst)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall instance data"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
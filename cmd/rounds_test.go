@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// complete draws every tile of the test instance
+func complete(t *testing.T, inst *instance.Instance) {
+	t.Helper()
+	for y := 0; y < inst.StepCountY; y++ {
+		for x := 0; x < inst.StepCountX; x++ {
+			location := tile.Location{X: x, Y: y}
+			submission, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = inst.UpdateTile(location, submission)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestNewRoundHandler(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	useAdminToken(t)
+	vars := map[string]string{"instanceID": inst.ID.String()}
+	newRound := func(query string, token string) int {
+		return serve(NewRoundHandler, adminRequest(http.MethodPost, "/?"+query, token), vars).Code
+	}
+
+	if status := newRound("", testAdminToken); status != http.StatusConflict {
+		t.Errorf("new round of an open instance responded %d", status)
+	}
+	complete(t, inst)
+	if status := newRound("", ""); status != http.StatusForbidden {
+		t.Errorf("new round without the token responded %d", status)
+	}
+	for _, query := range []string{"cols=many", "rows=-1", "cols=61"} {
+		if status := newRound(query, testAdminToken); status != http.StatusBadRequest {
+			t.Errorf("new round with %s responded %d", query, status)
+		}
+	}
+	if status := newRound("cols=3&rows=2&offsetX=5", testAdminToken); status != http.StatusOK {
+		t.Fatalf("new round responded %d", status)
+	}
+	entries := auditTrail(t)
+	if len(entries) != 1 || entries[0].Action != "new-round" {
+		t.Errorf("recorded %v", entries)
+	}
+
+	w := serve(RoundsHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars)
+	if w.Code != http.StatusOK {
+		t.Fatalf("rounds responded %d", w.Code)
+	}
+	rounds := []roundSummary{}
+	err := json.Unmarshal(w.Body.Bytes(), &rounds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rounds) != 2 || rounds[0].Current || rounds[0].Cols != 6 || !rounds[1].Current || rounds[1].Cols != 3 || rounds[1].OffsetX != 5 {
+		t.Errorf("listed rounds %+v", rounds)
+	}
+
+	for round, status := range map[string]int{"1": http.StatusOK, "2": http.StatusNotFound, "0": http.StatusNotFound} {
+		vars := map[string]string{"instanceID": inst.ID.String(), "round": round}
+		if w := serve(RoundCompositeHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars); w.Code != status {
+			t.Errorf("composite of round %s responded %d, want %d", round, w.Code, status)
+		}
+	}
+}
+
+func TestEarlierRoundCandidates(t *testing.T) {
+	inst := newCompetitiveInstance(t)
+	useRenditions(t)
+	ballots, err := inst.IssueBallots(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete(t, inst)
+	for y := 0; y < inst.StepCountY; y++ {
+		for x := 0; x < inst.StepCountX; x++ {
+			err := inst.Vote(tile.Location{X: x, Y: y}, 1, ballots[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := inst.CloseVotingRound(); err != nil {
+		t.Fatal(err)
+	}
+	err = inst.StartRound(instance.RoundOptions{Cols: 2, Rows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		x, y   string
+		round  string
+		status int
+	}{
+		// voting rounds 1 and 2 were on the first round's 6x6 grid
+		{"5", "5", "1", http.StatusOK},
+		{"5", "5", "2", http.StatusOK},
+		{"5", "5", "3", http.StatusNotFound},
+		{"1", "1", "3", http.StatusOK},
+		{"1", "1", "4", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		vars := map[string]string{"instanceID": inst.ID.String(), "x": test.x, "y": test.y, "round": test.round}
+		w := serve(CandidatesHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars)
+		if w.Code != test.status {
+			t.Errorf("candidates for %s,%s in round %s responded %d, want %d", test.x, test.y, test.round, w.Code, test.status)
+		}
+	}
+
+	vars := map[string]string{"instanceID": inst.ID.String(), "x": "5", "y": "5", "round": "1", "candidate": "1"}
+	if w := serve(CandidateImageHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars); w.Code != http.StatusOK {
+		t.Errorf("candidate of the first round responded %d", w.Code)
+	}
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/andrewmyhre/donk-server/pkg/audit"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var instanceSeamCmd = &cobra.Command{
+	Use:   "seam <instance>",
+	Short: "Change how the edges where tiles meet are treated in the composite",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		seam, err := seamFlags(cmd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		inst := openInstance(args[0])
+		err = inst.SetSeam(seam)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "Failed to change seam"))
+		}
+		err = audit.Record(audit.Entry{
+			Action:   "seam",
+			Instance: inst.ID,
+			Actor:    "cli:" + os.Getenv("USER"),
+			Detail:   inst.Title,
+		})
+		if err != nil {
+			log.Error(err)
+		}
+		writeInstance(cmd, inst)
+	},
+}
+
+// seamFlags reads the seam treatment given by the seam flags of a command
+func seamFlags(cmd *cobra.Command) (*instance.Seam, error) {
+	style, _ := cmd.Flags().GetString("seam")
+	width, _ := cmd.Flags().GetInt("seam-width")
+	colour, _ := cmd.Flags().GetString("seam-colour")
+	return instance.NewSeam(style, width, colour)
+}
+
+// seamParams reads the seam treatment given by the seam, seamWidth and
+// seamColour parameters of a request
+func seamParams(params url.Values) (*instance.Seam, error) {
+	width := 0
+	if param := params.Get("seamWidth"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil {
+			return nil, &instance.SeamError{Reason: "seamWidth must be a number of pixels"}
+		}
+		width = n
+	}
+	return instance.NewSeam(params.Get("seam"), width, params.Get("seamColour"))
+}
+
+// SeamHandler changes how the edges where the tiles of an instance meet are
+// treated in its composite, with the seam, seamWidth and seamColour
+// parameters. Only admins can change it.
+func SeamHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	inst := openAdminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	seam, err := seamParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = inst.SetSeam(seam)
+	if errors.Cause(err) == instance.ErrArchived {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(r, "seam", inst)
+
+	json, err := json.Marshal(inst)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall instance data"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+func init() {
+	instanceCmd.AddCommand(instanceSeamCmd)
+
+	for _, c := range []*cobra.Command{instanceCreateCmd, instanceSeamCmd} {
+		c.Flags().String("seam", instance.SeamNone, "How the edges where tiles meet are treated in the composite, none, feather or grout")
+		c.Flags().Int("seam-width", 0, "Pixels blended across by feathered seams or covered by grout, 0 for the default")
+		c.Flags().String("seam-colour", "", "Colour of grout as #rrggbb, white if it isn't given")
+	}
+}
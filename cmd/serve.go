@@ -16,22 +16,37 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/janitor"
+	"github.com/andrewmyhre/donk-server/pkg/rendition"
 	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"image"
 	_ "image/jpeg"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
+// renditions caches images encoded for clients, see writeImage
+var renditions *rendition.Cache
+
 var defaultInstance = &instance.Instance {
 	ID: uuid.Nil,
 	SourceImagePath: "assets/paper4.jpg",
@@ -41,6 +56,20 @@ var defaultInstance = &instance.Instance {
 	StepCountY: 6,
 	StepSizeX: 924,
 	StepSizeY: 624,
+	CompositeImageUrl: "/v1/composite",
+	State: instance.StateOpen,
+	Round: 1,
+}
+
+// openDefaultInstance loads the default instance as it was last saved. Its
+// composite is restitched in the background so defaultInstance falls behind.
+func openDefaultInstance() *instance.Instance {
+	saved, err := instance.Open(defaultInstance.ID.String())
+	if err != nil {
+		log.Warn(errors.Wrap(err, "Failed to load default instance"))
+		return defaultInstance
+	}
+	return saved
 }
 
 // serveCmd represents the serve command
@@ -49,29 +78,97 @@ var serveCmd = &cobra.Command{
 	Short: "Start serving API requests",
 	Long: `Runs the web service which serves API requests for Donk`,
 	Run: func(cmd *cobra.Command, args []string) {
+		tile.DefaultLimits.MaxBytes = viper.GetInt64("max-upload-bytes")
+		tile.DefaultLimits.MaxPixels = viper.GetInt("max-upload-pixels")
+		renditions = rendition.NewCache(viper.GetInt64("rendition-cache-bytes"))
+		rendition.Sizes = viper.GetIntSlice("rendition-sizes")
+		instance.TimelapseVariants = viper.GetInt("timelapse-variants")
+		session.IdleTimeout = viper.GetDuration("session-idle-timeout")
+		// composite renditions are dropped once the version after them has
+		// been written, rather than when the tiles in it are saved
+		instance.Stitched = func(id uuid.UUID) {
+			renditions.Invalidate(fmt.Sprintf("composite/%v/", id))
+		}
+		instance.StitchDelay = viper.GetDuration("stitch-delay")
+		instance.SourceCacheBytes = viper.GetInt64("source-cache-bytes")
+
 		err := defaultInstance.EnsurePath()
 		if err != nil {
 			log.Fatal(err)
 		}
+		// carry on from the last composite version so that ETags from a
+		// previous run aren't reused for different images
+		if saved, err := instance.Open(defaultInstance.ID.String()); err == nil {
+			defaultInstance.CompositeVersion = saved.CompositeVersion
+			defaultInstance.State = saved.State
+			defaultInstance.TilesFilled = saved.TilesFilled
+			defaultInstance.Created = saved.Created
+			defaultInstance.Updated = saved.Updated
+		} else {
+			defaultInstance.Created = time.Now().UTC()
+		}
 		err = defaultInstance.StitchSessionImage()
 		if err != nil {
 			log.Fatal(err)
 		}
+		err = instance.ResumeStitches()
+		if err != nil {
+			log.Warn(errors.Wrap(err, "Failed to resume pending stitches"))
+		}
+
+		if interval := viper.GetDuration("janitor-interval"); interval > 0 {
+			janitor.Start(interval, janitorPolicy(), nil)
+		}
 
 		r := mux.NewRouter()
 		r.HandleFunc("/", HomeHandler)
+		r.Handle("/debug/vars", expvar.Handler())
 		r.HandleFunc("/v1/composite", CompositeHandler)
+		r.HandleFunc("/v1/instances", InstancesHandler).Methods(http.MethodGet,http.MethodOptions)
 		r.HandleFunc("/v1/instance/new", NewInstanceHandler).Queries("sourceImage", "{sourceImage}").Methods(http.MethodPost,http.MethodOptions)
 		r.HandleFunc("/v1/instance/new", NewInstanceHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/composite/status", CompositeStatusHandler).Methods(http.MethodGet,http.MethodOptions)
 		r.HandleFunc("/v1/instance/{instanceID}/composite", CompositeHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/composite/status", CompositeStatusHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/timelapse.gif", TimelapseHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/export", ExportHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/credits", CreditsHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/layout", LayoutHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/seam", SeamHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/fork", ForkInstanceHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/rounds", RoundsHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/rounds/new", NewRoundHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/round/{round:[0-9]+}/composite", RoundCompositeHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/archive", ArchiveInstanceHandler(false)).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/restore", ArchiveInstanceHandler(true)).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}", DeleteInstanceHandler).Methods(http.MethodDelete)
 		r.HandleFunc("/v1/instance/{instanceID}", InstanceInfoHandler)
+		r.HandleFunc("/v1/tile/{x:[0-9]+}/{y:[0-9]+}", TileHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{x:[0-9]+}/{y:[0-9]+}", TileHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{x:[0-9]+}/{y:[0-9]+}/candidates", CandidatesHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{x:[0-9]+}/{y:[0-9]+}/candidates/{candidate:[0-9]+}/vote", VoteHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{x:[0-9]+}/{y:[0-9]+}/round/{round:[0-9]+}/candidates", CandidatesHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{x:[0-9]+}/{y:[0-9]+}/round/{round:[0-9]+}/candidates/{candidate:[0-9]+}", CandidateImageHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{tile}", TileHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{tile}/candidates", CandidatesHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{tile}/candidates/{candidate:[0-9]+}/vote", VoteHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{tile}/round/{round:[0-9]+}/candidates", CandidatesHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/tile/{tile}/round/{round:[0-9]+}/candidates/{candidate:[0-9]+}", CandidateImageHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/voting/close", CloseVotingHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/ballots", IssueBallotsHandler).Methods(http.MethodPost,http.MethodOptions)
 		r.HandleFunc("/v1/session/new/{x:[0-9]+}/{y:[0-9]+}", NewSessionHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/session/{sessionID}", AbandonSessionHandler).Methods(http.MethodDelete)
 		r.HandleFunc("/v1/session/{sessionID}", SessionInfoHandler)
 		r.HandleFunc("/v1/session/{sessionID}/background", SessionBackgroundImageHandler)
+		r.HandleFunc("/v1/session/{sessionID}/start", StartSessionHandler).Methods(http.MethodPost,http.MethodOptions)
 		r.HandleFunc("/v1/session/{sessionID}/save", SessionSaveImageHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/sessions", SessionsHandler).Methods(http.MethodGet,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/session/{sessionID}", AbandonSessionHandler).Methods(http.MethodDelete)
 		r.HandleFunc("/v1/instance/{instanceID}/session/{sessionID}", SessionInfoHandler)
 		r.HandleFunc("/v1/instance/{instanceID}/session/new/{x:[0-9]+}/{y:[0-9]+}", NewSessionHandler).Methods(http.MethodPost,http.MethodOptions)
+		r.HandleFunc("/v1/instance/{instanceID}/session/new/{tile}", NewSessionHandler).Methods(http.MethodPost,http.MethodOptions)
 		r.HandleFunc("/v1/instance/{instanceID}/session/{sessionID}/background", SessionBackgroundImageHandler)
+		r.HandleFunc("/v1/instance/{instanceID}/session/{sessionID}/start", StartSessionHandler).Methods(http.MethodPost,http.MethodOptions)
 		r.HandleFunc("/v1/instance/{instanceID}/session/{sessionID}/save", SessionSaveImageHandler).Methods(http.MethodPost,http.MethodOptions)
 		http.Handle("/v1", r)
 
@@ -103,7 +200,72 @@ func NewInstanceHandler(w http.ResponseWriter, r *http.Request) {
 		sourceImagePath=sourceImage
 	} 
 
-	inst, err := instance.New(sourceImagePath)
+	keepTileVersions := 0
+	if keep := r.URL.Query().Get("keepTileVersions"); keep != "" {
+		n, err := strconv.Atoi(keep)
+		if err != nil || n < 0 {
+			http.Error(w, "keepTileVersions must be a number, 0 keeps every version", http.StatusBadRequest)
+			return
+		}
+		keepTileVersions = n
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != instance.ModeLatest && mode != instance.ModeCompetitive {
+		http.Error(w, fmt.Sprintf("mode must be one of %v", instance.Modes), http.StatusBadRequest)
+		return
+	}
+	var votingPeriod time.Duration
+	if period := r.URL.Query().Get("votingPeriod"); period != "" {
+		d, err := time.ParseDuration(period)
+		if err != nil || d < 0 {
+			http.Error(w, "votingPeriod must be a duration, such as 24h", http.StatusBadRequest)
+			return
+		}
+		votingPeriod = d
+	}
+
+	// tiles are laid out in a pattern of cols by rows, or by a layout sent as
+	// the JSON body
+	cols, rows := instance.DefaultStepCount, instance.DefaultStepCount
+	for name, value := range map[string]*int{"cols": &cols, "rows": &rows} {
+		if param := r.URL.Query().Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 1 {
+				http.Error(w, name+" must be a number of at least 1", http.StatusBadRequest)
+				return
+			}
+			*value = n
+		}
+	}
+	layout, err := layoutBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seam, err := seamParams(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath:  sourceImagePath,
+		Cols:             cols,
+		Rows:             rows,
+		Pattern:          r.URL.Query().Get("pattern"),
+		Layout:           layout,
+		Title:            r.URL.Query().Get("title"),
+		Creator:          r.URL.Query().Get("creator"),
+		KeepTileVersions: keepTileVersions,
+		Mode:             mode,
+		VotingPeriod:     votingPeriod,
+		Seam:             seam,
+	})
+	if gerr, ok := err.(*instance.GridError); ok {
+		http.Error(w, gerr.Reason, http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Error(err)
@@ -142,7 +304,8 @@ func InstanceInfoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	i, err := instance.Open(vars["instanceID"])
 	if err != nil {
-		log.Error(errors.Wrap(err, "Failed to open instance"))
+		writeOpenError(w, err)
+		return
 	}
 
 	json, err := json.Marshal(i)
@@ -163,21 +326,9 @@ func SessionInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	vars := mux.Vars(r)
 
-	// var err error
-	// var inst *instance.Instance
-	// if instanceID, provided := vars["instanceID"]; provided {
-	// 	inst, err = instance.Open(instanceID)
-	// 	if err != nil {
-	// 		w.WriteHeader(http.StatusInternalServerError)
-	// 		return
-	// 	}
-	// } else {
-	// 	inst = defaultInstance
-	// }
-
-	session, err := session.Find(vars["sessionID"])
+	session, err := openSession(w, vars)
 	if err != nil {
-		log.Error(errors.Wrap(err, "Failed to find session"))
+		return
 	}
 
 	json, err := json.Marshal(session)
@@ -203,22 +354,201 @@ func CompositeHandler(w http.ResponseWriter, r *http.Request) {
 	if instanceID, provided := vars["instanceID"]; provided {
 		inst, err = instance.Open(instanceID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeOpenError(w, err)
 			return
 		}
 	} else {
-		inst = defaultInstance
+		inst = openDefaultInstance()
+	}
+
+	// the credits parameter renders contributors into the composite
+	if mode := r.URL.Query().Get("credits"); mode != "" {
+		valid := false
+		for _, name := range instance.CreditModes {
+			valid = valid || name == mode
+		}
+		if !valid {
+			http.Error(w, fmt.Sprintf("credits must be one of %v", instance.CreditModes), http.StatusBadRequest)
+			return
+		}
+		writeImage(w, r, storedImage{
+			key:      fmt.Sprintf("composite/%v/%d/credits-%s", inst.ID, inst.CompositeVersion, mode),
+			modified: inst.CompositeModified(),
+			render: func() (image.Image, error) {
+				return inst.RenderCredits(mode)
+			},
+		})
+		return
 	}
 
-	image, err := inst.GetStitchedImage()
+	writeImage(w, r, storedImage{
+		key:      fmt.Sprintf("composite/%v/%d", inst.ID, inst.CompositeVersion),
+		format:   "jpeg",
+		modified: inst.CompositeModified(),
+		read: func() ([]byte, error) {
+			image, err := inst.GetStitchedImage()
+			if err != nil {
+				return nil, errors.Wrap(err, "Couldn't provide instance composite image")
+			}
+			return image, nil
+		},
+	})
+}
+
+// writeOpenError responds to a failure to open the instance a request is for
+func writeOpenError(w http.ResponseWriter, err error) {
+	if errors.Cause(err) == instance.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	log.Error(errors.Wrap(err, "Failed to open instance"))
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// storedImage is an image which can be served to clients. It is either kept
+// on disk, encoded in format, and provided by read, or it is made by render.
+type storedImage struct {
+	// key identifies the version of the image, it is used to cache renditions
+	// and make ETags so it must change whenever the image does
+	key      string
+	format   string
+	modified time.Time
+	read     func() ([]byte, error)
+	render   func() (image.Image, error)
+}
+
+func (s storedImage) image() (image.Image, error) {
+	if s.render != nil {
+		return s.render()
+	}
+
+	data, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode stored image")
+	}
+	return img, nil
+}
+
+// writeImage responds with an image encoded and resized as the client asked.
+// A stored image is sent unchanged if the client asks for its format without
+// a quality or size. Conditional and range requests are answered by
+// http.ServeContent.
+func writeImage(w http.ResponseWriter, r *http.Request, stored storedImage) {
+	options, err := rendition.FromRequest(r)
+	if rerr, ok := errors.Cause(err).(*rendition.RequestError); ok {
+		http.Error(w, rerr.Reason, rerr.Status)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Error(errors.Wrap(err, "Couldn't provide instance composite image"))
+		log.Error(err)
 		return
 	}
+	if r.URL.Query().Get("format") == "" {
+		w.Header().Add("Vary", "Accept")
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(image)
+	key := stored.key + "/" + options.String()
+	etag := strconv.Quote(key)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", viper.GetString("image-cache-control"))
+	if !stored.modified.IsZero() {
+		w.Header().Set("Last-Modified", stored.modified.UTC().Format(http.TimeFormat))
+	}
+
+	// answer revalidation without rendering anything
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	data, err := renditions.Get(key, func() ([]byte, error) {
+		if stored.read != nil && options.Format == stored.format && options.Quality == 0 && !options.Resized() {
+			return stored.read()
+		}
+
+		img, err := stored.image()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		err = rendition.Encode(&buf, rendition.Resize(img, options), options)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to encode image as %s", options.Format)
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Last-Modified")
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", options.MediaType())
+	http.ServeContent(w, r, "", stored.modified, bytes.NewReader(data))
+}
+
+// etagMatches reports whether an If-None-Match header matches etag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// TileHandler serves the current image of a tile, as it appears in the
+// composite
+func TileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	var err error
+	var inst *instance.Instance
+	vars := mux.Vars(r)
+	if instanceID, provided := vars["instanceID"]; provided {
+		inst, err = instance.Open(instanceID)
+		if err != nil {
+			writeOpenError(w, err)
+			return
+		}
+	} else {
+		inst = openDefaultInstance()
+	}
+
+	location, found := tileLocation(w, inst, vars)
+	if !found {
+		return
+	}
+
+	t, err := inst.Tile(location)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(errors.Wrap(err, "Failed to load tile"))
+		return
+	}
+
+	stored := storedImage{
+		key: fmt.Sprintf("tile/%v/%d/%v/0", inst.ID, inst.Round, location),
+		render: func() (image.Image, error) {
+			return inst.RenderTile(t)
+		},
+	}
+	if latest := t.Latest(); latest != nil {
+		stored.key = fmt.Sprintf("tile/%v/%d/%v/%d", inst.ID, inst.Round, location, latest.Number)
+		stored.modified = latest.Created
+	}
+	writeImage(w, r, stored)
 }
 
 func NewSessionHandler(w http.ResponseWriter, r *http.Request) {
@@ -233,22 +563,27 @@ func NewSessionHandler(w http.ResponseWriter, r *http.Request) {
 	if instanceID, provided := vars["instanceID"]; provided {
 		inst, err = instance.Open(instanceID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeOpenError(w, err)
 			return
 		}
 	} else {
-		inst = defaultInstance
+		inst = openDefaultInstance()
 	}
 	
-	x,err := strconv.Atoi(vars["x"])
-	if err != nil {
-		w.Write([]byte("X argument must be a number"))
+	location, found := tileLocation(w, inst, vars)
+	if !found {
+		return
 	}
-	y,err := strconv.Atoi(vars["y"])
+	contributor, err := contributorFrom(r.URL.Query())
 	if err != nil {
-		w.Write([]byte("Y argument must be a number"))
+		writeSaveError(w, err)
+		return
+	}
+	session, err := session.NewSession(inst, location.X, location.Y, contributor)
+	if errors.Cause(err) == instance.ErrArchived {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
-	session, err := session.NewSession(inst, x,y)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Error(err)
@@ -279,28 +614,30 @@ func SessionBackgroundImageHandler(w http.ResponseWriter, r *http.Request) {
 	if instanceID, provided := vars["instanceID"]; provided {
 		inst, err = instance.Open(instanceID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeOpenError(w, err)
 			return
 		}
 	} else {
-		inst = defaultInstance
+		inst = openDefaultInstance()
 	}
 
 	session, err := session.Open(inst, vars["sessionID"])
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		log.Error(err)
+		return
 	}
-	imageData, err := session.ReadBackgroundImage()
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Error(err)
-	}
-	_, err = w.Write(imageData)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Error(err)
+	if session.Closed() && session.BackgroundModified().IsZero() {
+		http.Error(w, "session is "+session.Status, http.StatusGone)
+		return
 	}
+
+	writeImage(w, r, storedImage{
+		key:      fmt.Sprintf("background/%v/%d", session.ID, session.TileVersion),
+		format:   "jpeg",
+		modified: session.BackgroundModified(),
+		read:     session.ReadBackgroundImage,
+	})
 }
 
 func SessionSaveImageHandler(w http.ResponseWriter, r *http.Request) {
@@ -316,11 +653,11 @@ func SessionSaveImageHandler(w http.ResponseWriter, r *http.Request) {
 	if instanceID, provided := vars["instanceID"]; provided {
 		inst, err = instance.Open(instanceID)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			writeOpenError(w, err)
 			return
 		}
 	} else {
-		inst = defaultInstance
+		inst = openDefaultInstance()
 	}
 
 	session, err := session.Open(inst, vars["sessionID"])
@@ -329,28 +666,269 @@ func SessionSaveImageHandler(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 		return
 	}
+	if session.Closed() {
+		http.Error(w, "session is "+session.Status, http.StatusConflict)
+		return
+	}
 
 	defer r.Body.Close()
-	bodyData, err := ioutil.ReadAll(r.Body)
+	r.Body = &limitedBody{
+		ReadCloser: r.Body,
+		remaining:  maxBodyBytes(),
+	}
+
+	submission, err := readSubmission(r, session)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Error(err)
+		writeSaveError(w, err)
 		return
 	}
 
-	err = session.UpdateBackgroundImage(bodyData)
+	err = session.UpdateBackgroundImage(submission)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Error(err)
+		writeSaveError(w, err)
 		return
 	}
 
+	// the tile's renditions are keyed by version so they'd never be served
+	// again, the composite's are dropped once it has been stitched
+	renditions.Invalidate(fmt.Sprintf("tile/%v/%d/%v/", inst.ID, inst.Round, session.Location))
+
+	// the composite is restitched in the background, the session's
+	// compositeVersion says which version will show the tile
+	json, err := json.Marshal(session)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall session data"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// maxBodyBytes is the largest request body accepted when saving a tile. Data
+// URLs are base64 encoded so there is room for the encoding overhead, plus
+// some more for multipart headers and metadata fields.
+func maxBodyBytes() int64 {
+	return tile.DefaultLimits.MaxBytes/3*4 + maxMetadataFields*maxMetadataBytes + 4096
+}
+
+const (
+	maxMetadataFields = 16
+	maxMetadataBytes  = 1024
+)
+
+// unsupportedMediaTypeError is returned for a submission whose Content-Type
+// can't be read as an image
+type unsupportedMediaTypeError string
+
+func (e unsupportedMediaTypeError) Error() string {
+	return "media type " + string(e) + " is not accepted"
+}
+
+// readSubmission reads a tile image from the request body according to its
+// Content-Type:
+//
+//	image/jpeg, image/png: the encoded image
+//	multipart/form-data: an "image" part holding an image or a data URL,
+//	  name, handle and link fields crediting the contributor, other fields
+//	  are kept as metadata for the tile version
+//	text/plain, form encoded or none: a base64 data URL of any accepted
+//	  image type, sent as the whole body
+//
+// The contributor can also be given by name, handle and link query
+// parameters.
+func readSubmission(r *http.Request, s *session.Session) (*tile.Submission, error) {
+	submission, err := readSubmissionBody(r, s)
+	if err != nil {
+		return nil, err
+	}
+
+	credit := r.URL.Query()
+	for _, field := range contributorFields {
+		if value, provided := submission.Metadata[field]; provided {
+			credit.Set(field, value)
+			delete(submission.Metadata, field)
+		}
+	}
+	if len(submission.Metadata) == 0 {
+		submission.Metadata = nil
+	}
+	submission.Contributor, err = contributorFrom(credit)
+	if err != nil {
+		return nil, err
+	}
+	return submission, nil
+}
+
+// contributorFields are the query parameters and multipart fields which
+// credit a contributor
+var contributorFields = []string{"name", "handle", "link"}
+
+// contributorFrom reads the contributor credited by a request, it returns nil
+// if none is
+func contributorFrom(values url.Values) (*tile.Contributor, error) {
+	return tile.NewContributor(values.Get("name"), values.Get("handle"), values.Get("link"))
+}
+
+func readSubmissionBody(r *http.Request, s *session.Session) (*tile.Submission, error) {
+	mediaType := ""
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, unsupportedMediaTypeError(contentType)
+		}
+	}
+
+	if mediaType != "multipart/form-data" {
+		body, err := imageReader(mediaType, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return s.ReadImage(body)
+	}
+
+	parts, err := r.MultipartReader()
+	if err != nil {
+		return nil, &tile.ValidationError{Reason: "malformed multipart body: " + err.Error()}
+	}
+
+	var submission *tile.Submission
+	metadata := make(map[string]string)
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read multipart body")
+		}
+
+		if part.FormName() == "image" {
+			if submission != nil {
+				return nil, &tile.ValidationError{Reason: "multipart body has more than one image part"}
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			body, err := imageReader(partType, part)
+			if err != nil {
+				return nil, err
+			}
+			submission, err = s.ReadImage(body)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if len(metadata) == maxMetadataFields {
+			return nil, &tile.ValidationError{Reason: fmt.Sprintf("multipart body has more than %d fields", maxMetadataFields)}
+		}
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxMetadataBytes+1))
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read multipart field")
+		}
+		if len(value) > maxMetadataBytes {
+			return nil, &tile.ValidationError{Reason: fmt.Sprintf("field %s is longer than %d bytes", part.FormName(), maxMetadataBytes)}
+		}
+		metadata[part.FormName()] = string(value)
+	}
+
+	if submission == nil {
+		return nil, &tile.ValidationError{Reason: "multipart body has no image part"}
+	}
+	if len(metadata) > 0 {
+		submission.Metadata = metadata
+	}
+	return submission, nil
+}
+
+// imageReader returns a reader of the encoded image in a body of mediaType
+func imageReader(mediaType string, body io.Reader) (io.Reader, error) {
+	switch {
+	case mediaType == "" || mediaType == "text/plain" || mediaType == "application/x-www-form-urlencoded":
+		return tile.DefaultLimits.DataURLReader(body)
+	case tile.DefaultLimits.Allows(tile.FormatOf(mediaType)):
+		return body, nil
+	default:
+		return nil, unsupportedMediaTypeError(mediaType)
+	}
+}
+
+// limitedBody fails with a *tile.ValidationError once the request body goes
+// over its size limit
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		var extra [1]byte
+		n, err := l.ReadCloser.Read(extra[:])
+		if n > 0 {
+			return 0, &tile.ValidationError{
+				Reason:   fmt.Sprintf("request body is larger than %d bytes", maxBodyBytes()),
+				TooLarge: true,
+			}
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// writeSaveError responds to a failed tile submission, explaining why the
+// image was rejected when it failed validation
+func writeSaveError(w http.ResponseWriter, err error) {
+	if cause := errors.Cause(err); cause == instance.ErrArchived || cause == session.ErrClosed {
+		http.Error(w, cause.Error(), http.StatusConflict)
+		return
+	}
+	if mediaType, ok := errors.Cause(err).(unsupportedMediaTypeError); ok {
+		log.Warn(err)
+		http.Error(w, mediaType.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if verr, ok := errors.Cause(err).(*tile.ValidationError); ok {
+		log.Warn(err)
+		status := http.StatusBadRequest
+		if verr.TooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, verr.Reason, status)
+		return
+	}
+
+	log.Error(err)
+	w.WriteHeader(http.StatusInternalServerError)
 }
 
 func init() {
 	rootCmd.AddCommand(serveCmd)
 
+	serveCmd.Flags().Int64("max-upload-bytes", tile.DefaultLimits.MaxBytes, "Largest tile image accepted, in bytes")
+	serveCmd.Flags().Int("max-upload-pixels", tile.DefaultLimits.MaxPixels, "Largest tile image accepted, in pixels")
+	viper.BindPFlag("max-upload-bytes", serveCmd.Flags().Lookup("max-upload-bytes"))
+	viper.BindPFlag("max-upload-pixels", serveCmd.Flags().Lookup("max-upload-pixels"))
+
+	serveCmd.Flags().Int64("rendition-cache-bytes", 256<<20, "Memory used to cache images encoded for clients, in bytes")
+	viper.BindPFlag("rendition-cache-bytes", serveCmd.Flags().Lookup("rendition-cache-bytes"))
+	serveCmd.Flags().Int64("source-cache-bytes", instance.SourceCacheBytes, "Memory used to keep decoded source images and the tiles cut from them, in bytes")
+	viper.BindPFlag("source-cache-bytes", serveCmd.Flags().Lookup("source-cache-bytes"))
+	serveCmd.Flags().IntSlice("rendition-sizes", rendition.Sizes, "Widths and heights images may be resized to")
+	viper.BindPFlag("rendition-sizes", serveCmd.Flags().Lookup("rendition-sizes"))
+	serveCmd.Flags().String("image-cache-control", "public, no-cache", "Cache-Control header sent with composite and background images")
+	viper.BindPFlag("image-cache-control", serveCmd.Flags().Lookup("image-cache-control"))
+	serveCmd.Flags().Duration("janitor-interval", time.Hour, "How often the janitor runs in the background, it doesn't if 0")
+	viper.BindPFlag("janitor-interval", serveCmd.Flags().Lookup("janitor-interval"))
+	serveCmd.Flags().String("admin-token", "", "Bearer token which allows instances to be archived and deleted, they can't be if it is empty")
+	viper.BindPFlag("admin-token", serveCmd.Flags().Lookup("admin-token"))
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
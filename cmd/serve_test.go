@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/rendition"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/gorilla/mux"
+)
+
+// useTempData points instance.DataPath at a fresh folder for the test
+func useTempData(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "donk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// composites are only restitched when a test asks, see stitch
+	previous, previousDelay := instance.DataPath, instance.StitchDelay
+	instance.DataPath, instance.StitchDelay = dir, time.Hour
+	t.Cleanup(func() {
+		instance.DataPath, instance.StitchDelay = previous, previousDelay
+		os.RemoveAll(dir)
+	})
+}
+
+// stitch restitches the composite of inst as the background worker would
+func stitch(t *testing.T, inst *instance.Instance) {
+	t.Helper()
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encodePNG encodes a width by height image filled with c
+func encodePNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestInstance creates an instance over a plain 60x60 source, so that
+// its tiles are 10x10
+func newTestInstance(t *testing.T) *instance.Instance {
+	t.Helper()
+	useTempData(t)
+	source := filepath.Join(instance.DataPath, "source.png")
+	err := ioutil.WriteFile(source, encodePNG(t, 60, 60, color.Gray{200}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := instance.New(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// useLimits applies limits to tile submissions for the test
+func useLimits(t *testing.T, limits tile.Limits) tile.Limits {
+	previous := tile.DefaultLimits
+	tile.DefaultLimits = limits
+	t.Cleanup(func() { tile.DefaultLimits = previous })
+	return limits
+}
+
+// serve makes a request to a handler with the route variables it would be
+// given by the router
+func serve(handler http.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, mux.SetURLVars(r, vars))
+	return w
+}
+
+// multipartBody encodes an image part and metadata fields as a form
+func multipartBody(t *testing.T, drawing []byte, fields map[string]string) (string, []byte) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range fields {
+		w.WriteField(name, value)
+	}
+	if drawing != nil {
+		part, err := w.CreatePart(map[string][]string{
+			"Content-Disposition": {`form-data; name="image"; filename="tile.png"`},
+			"Content-Type":        {"image/png"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(drawing)
+	}
+	w.Close()
+	return w.FormDataContentType(), body.Bytes()
+}
+
+func TestSessionSave(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	tileLimits := useLimits(t, tile.Limits{MaxBytes: 4096, Formats: []string{"jpeg", "png"}})
+	drawing := encodePNG(t, 10, 10, color.Black)
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(drawing)
+	form, formBody := multipartBody(t, drawing, map[string]string{"title": "night"})
+	noImage, noImageBody := multipartBody(t, nil, map[string]string{"title": "night"})
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		status      int
+		metadata    map[string]string
+	}{
+		{"raw png", "image/png", drawing, http.StatusOK, nil},
+		{"data URL", "text/plain", []byte(dataURL), http.StatusOK, nil},
+		{"data URL without content type", "", []byte(dataURL), http.StatusOK, nil},
+		{"plain base64", "text/plain", []byte(base64.StdEncoding.EncodeToString(drawing)), http.StatusOK, nil},
+		{"multipart", form, formBody, http.StatusOK, map[string]string{"title": "night"}},
+		{"multipart without an image", noImage, noImageBody, http.StatusBadRequest, nil},
+		{"unsupported media type", "image/gif", drawing, http.StatusUnsupportedMediaType, nil},
+		{"malformed content type", "image/", drawing, http.StatusUnsupportedMediaType, nil},
+		{"wrong size", "image/png", encodePNG(t, 12, 10, color.Black), http.StatusBadRequest, nil},
+		{"not an image", "image/png", []byte("hello"), http.StatusBadRequest, nil},
+		// data after the end of the image still counts towards the limit
+		{"too large", "image/png", append(append([]byte{}, drawing...), make([]byte, tileLimits.MaxBytes)...), http.StatusRequestEntityTooLarge, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := session.NewSession(inst, 2, 3, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := inst.Tile(s.Location)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			w := serve(SessionSaveImageHandler, r, map[string]string{"instanceID": inst.ID.String(), "sessionID": s.ID.String()})
+			if w.Code != test.status {
+				t.Fatalf("responded %d %s, want %d", w.Code, w.Body, test.status)
+			}
+
+			after, err := inst.Tile(s.Location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved := len(after.Versions) - len(before.Versions)
+			if test.status != http.StatusOK {
+				if saved != 0 {
+					t.Errorf("a rejected save added %d versions", saved)
+				}
+				return
+			}
+			if saved != 1 {
+				t.Fatalf("save added %d versions", saved)
+			}
+			latest := after.Latest()
+			if latest.Format != "png" {
+				t.Errorf("saved as %s", latest.Format)
+			}
+			if len(latest.Metadata) != len(test.metadata) || latest.Metadata["title"] != test.metadata["title"] {
+				t.Errorf("saved with metadata %v, want %v", latest.Metadata, test.metadata)
+			}
+		})
+	}
+}
+
+// useRenditions gives the test an empty rendition cache
+func useRenditions(t *testing.T) {
+	previous := renditions
+	renditions = rendition.NewCache(1 << 20)
+	t.Cleanup(func() { renditions = previous })
+}
+
+func TestCompositeFormats(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query  string
+		accept string
+		status int
+		format string
+	}{
+		{"", "", http.StatusOK, "jpeg"},
+		{"", "image/png", http.StatusOK, "png"},
+		{"", "image/jpeg;q=0, */*", http.StatusOK, "png"},
+		{"?format=gif", "image/png", http.StatusOK, "gif"},
+		{"?quality=20", "image/jpeg", http.StatusOK, "jpeg"},
+		{"", "image/webp", http.StatusNotAcceptable, ""},
+		{"?format=webp", "", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+test.query, nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := serve(CompositeHandler, r, map[string]string{"instanceID": inst.ID.String()})
+		if w.Code != test.status {
+			t.Errorf("%s %s: responded %d %s, want %d", test.query, test.accept, w.Code, w.Body, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != "image/"+test.format {
+			t.Errorf("%s %s: served as %s", test.query, test.accept, got)
+		}
+		_, format, err := image.Decode(w.Body)
+		if err != nil || format != test.format {
+			t.Errorf("%s %s: body is %s, %v", test.query, test.accept, format, err)
+		}
+	}
+}
+
+func TestCompositeConditional(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	w := serve(CompositeHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars)
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || modified == "" {
+		t.Fatalf("responded %d with ETag %q and Last-Modified %q", w.Code, etag, modified)
+	}
+	full := w.Body.Bytes()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(CompositeHandler, r, vars); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidating the ETag responded %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-Modified-Since", modified)
+	if w := serve(CompositeHandler, r, vars); w.Code != http.StatusNotModified {
+		t.Errorf("revalidating the modified time responded %d", w.Code)
+	}
+
+	// another format is another representation
+	r = httptest.NewRequest(http.MethodGet, "/?format=png", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(CompositeHandler, r, vars); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("a png with the jpeg ETag responded %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-9")
+	w = serve(CompositeHandler, r, vars)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), full[:10]) {
+		t.Errorf("range responded %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	// a new version of the composite has a new ETag
+	submission, err := inst.ReadTileImage(tile.Location{X: 0, Y: 0}, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.UpdateTile(tile.Location{X: 0, Y: 0}, submission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(CompositeHandler, r, vars); w.Code != http.StatusNotModified {
+		t.Errorf("before the composite was restitched the old ETag responded %d", w.Code)
+	}
+	stitch(t, inst)
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	if w := serve(CompositeHandler, r, vars); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after a save the old ETag responded %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestTileSizes(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+
+	tests := []struct {
+		x, y   string
+		query  string
+		status int
+		size   image.Point
+	}{
+		{"1", "1", "?format=png", http.StatusOK, image.Pt(10, 10)},
+		{"1", "1", "?format=png&width=64", http.StatusOK, image.Pt(64, 64)},
+		{"1", "1", "?format=png&width=64&height=128&fit=fill", http.StatusOK, image.Pt(64, 128)},
+		{"1", "1", "?width=65", http.StatusBadRequest, image.Point{}},
+		{"6", "1", "", http.StatusNotFound, image.Point{}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+test.query, nil)
+		w := serve(TileHandler, r, map[string]string{"instanceID": inst.ID.String(), "x": test.x, "y": test.y})
+		if w.Code != test.status {
+			t.Errorf("%s,%s%s: responded %d %s, want %d", test.x, test.y, test.query, w.Code, w.Body, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		img, _, err := image.Decode(w.Body)
+		if err != nil {
+			t.Errorf("%s,%s%s: %v", test.x, test.y, test.query, err)
+			continue
+		}
+		if size := img.Bounds().Size(); size != test.size {
+			t.Errorf("%s,%s%s: served at %v, want %v", test.x, test.y, test.query, size, test.size)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// openSession opens the session a request is for, through its instance if
+// the request names one. If it can't be opened the error has already been
+// responded to.
+func openSession(w http.ResponseWriter, vars map[string]string) (*session.Session, error) {
+	var s *session.Session
+	var err error
+	if instanceID, provided := vars["instanceID"]; provided {
+		var inst *instance.Instance
+		inst, err = instance.Open(instanceID)
+		if err != nil {
+			writeOpenError(w, err)
+			return nil, err
+		}
+		s, err = session.Open(inst, vars["sessionID"])
+	} else {
+		s, err = session.Find(vars["sessionID"])
+	}
+
+	if errors.Cause(err) == session.ErrNotFound {
+		http.Error(w, session.ErrNotFound.Error(), http.StatusNotFound)
+		return nil, err
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to find session"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return s, nil
+}
+
+// StartSessionHandler marks a session as drawing, clients tell the server
+// when they start so that fetching the background doesn't change anything.
+// Sessions which have already started or submitted are left as they are.
+func StartSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	s, err := openSession(w, mux.Vars(r))
+	if err != nil {
+		return
+	}
+	err = s.StartDrawing()
+	if errors.Cause(err) == session.ErrClosed {
+		http.Error(w, "session is "+s.Status, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(s)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall session data"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// AbandonSessionHandler closes a session so that it can't be saved to. The
+// session's ID is all that's needed, so a client can give up its own
+// session.
+func AbandonSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	s, err := openSession(w, mux.Vars(r))
+	if err != nil {
+		return
+	}
+	err = s.Abandon()
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionsHandler lists the sessions of an instance, oldest first. They can
+// be filtered by tile, status and age. Only admins can list sessions, since
+// anyone with a session's ID can save to it.
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if !isAdmin(r) {
+		http.Error(w, "this needs the admin token", http.StatusForbidden)
+		return
+	}
+
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	filter, err := sessionFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := session.List(inst)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	summaries := make([]session.Summary, 0, len(sessions))
+	for _, s := range sessions {
+		if filter.Matches(s) {
+			summaries = append(summaries, s.Summary())
+		}
+	}
+	sort.Slice(summaries, func(a, b int) bool {
+		return summaries[a].Created.Before(summaries[b].Created)
+	})
+
+	json, err := json.Marshal(map[string]interface{}{"sessions": summaries})
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall session list"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// sessionFilter reads the tile ("x,y"), status, minAge and maxAge query
+// parameters of a session listing
+func sessionFilter(r *http.Request) (session.Filter, error) {
+	query := r.URL.Query()
+	filter := session.Filter{}
+
+	if t := query.Get("tile"); t != "" {
+		location, err := tile.ParseLocation(t)
+		if err != nil {
+			return filter, fmt.Errorf("tile must be given as x,y")
+		}
+		filter.Location = &location
+	}
+	if status := query.Get("status"); status != "" {
+		found := false
+		for _, s := range session.Statuses {
+			found = found || s == status
+		}
+		if !found {
+			return filter, fmt.Errorf("status must be one of %s", strings.Join(session.Statuses, ", "))
+		}
+		filter.Status = status
+	}
+
+	for name, age := range map[string]*time.Duration{"minAge": &filter.MinAge, "maxAge": &filter.MaxAge} {
+		if value := query.Get(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return filter, fmt.Errorf("%s must be a duration such as 90m or 24h", name)
+			}
+			*age = d
+		}
+	}
+	return filter, nil
+}
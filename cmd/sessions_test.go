@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/session"
+)
+
+// sessionStatus reads the status a session has been saved with
+func sessionStatus(t *testing.T, s *session.Session) string {
+	t.Helper()
+	saved, err := session.Open(s.Instance, s.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saved.Status
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	s, err := session.NewSession(inst, 1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String(), "sessionID": s.ID.String()}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := serve(SessionBackgroundImageHandler, httptest.NewRequest(method, "/", nil), vars)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s background responded %d", method, w.Code)
+		}
+	}
+	if status := sessionStatus(t, s); status != session.StatusCreated {
+		t.Fatalf("fetching the background made the session %s", status)
+	}
+
+	for i := 0; i < 2; i++ {
+		w := serve(StartSessionHandler, httptest.NewRequest(http.MethodPost, "/", nil), vars)
+		if w.Code != http.StatusOK {
+			t.Fatalf("start responded %d %s", w.Code, w.Body)
+		}
+		started := session.Summary{}
+		err = json.Unmarshal(w.Body.Bytes(), &started)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if started.Status != session.StatusDrawing {
+			t.Errorf("start responded with a %s session", started.Status)
+		}
+	}
+	if status := sessionStatus(t, s); status != session.StatusDrawing {
+		t.Fatalf("started session is %s", status)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	r.Header.Set("Content-Type", "image/png")
+	if w := serve(SessionSaveImageHandler, r, vars); w.Code != http.StatusOK {
+		t.Fatalf("save responded %d %s", w.Code, w.Body)
+	}
+	if status := sessionStatus(t, s); status != session.StatusSubmitted {
+		t.Fatalf("saved session is %s", status)
+	}
+	// starting again doesn't take a submitted session back to drawing
+	if w := serve(StartSessionHandler, httptest.NewRequest(http.MethodPost, "/", nil), vars); w.Code != http.StatusOK {
+		t.Fatalf("start responded %d %s", w.Code, w.Body)
+	}
+	if status := sessionStatus(t, s); status != session.StatusSubmitted {
+		t.Fatalf("restarted session is %s", status)
+	}
+}
+
+func TestAbandonSession(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	s, err := session.NewSession(inst, 1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// abandoning only needs the session's ID
+	if w := serve(AbandonSessionHandler, httptest.NewRequest(http.MethodDelete, "/", nil), map[string]string{"sessionID": s.ID.String()}); w.Code != http.StatusNoContent {
+		t.Fatalf("abandon responded %d %s", w.Code, w.Body)
+	}
+	if status := sessionStatus(t, s); status != session.StatusAbandoned {
+		t.Fatalf("abandoned session is %s", status)
+	}
+
+	vars := map[string]string{"instanceID": inst.ID.String(), "sessionID": s.ID.String()}
+	if w := serve(StartSessionHandler, httptest.NewRequest(http.MethodPost, "/", nil), vars); w.Code != http.StatusConflict {
+		t.Errorf("starting an abandoned session responded %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	r.Header.Set("Content-Type", "image/png")
+	if w := serve(SessionSaveImageHandler, r, vars); w.Code != http.StatusConflict {
+		t.Errorf("saving an abandoned session responded %d", w.Code)
+	}
+	tile, err := inst.Tile(s.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tile.Versions) != 0 {
+		t.Errorf("abandoned session saved %d versions", len(tile.Versions))
+	}
+}
+
+func TestSessionsHandler(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	useAdminToken(t)
+	created := []*session.Session{}
+	for _, x := range []int{0, 1, 1} {
+		s, err := session.NewSession(inst, x, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, s)
+	}
+	err := created[2].StartDrawing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	if w := serve(SessionsHandler, adminRequest(http.MethodGet, "/", ""), vars); w.Code != http.StatusForbidden {
+		t.Fatalf("listing without the token responded %d", w.Code)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   []*session.Session
+	}{
+		{"", http.StatusOK, created},
+		{"tile=1,2", http.StatusOK, created[1:]},
+		{"status=drawing", http.StatusOK, created[2:]},
+		{"tile=1,2&status=created", http.StatusOK, created[1:2]},
+		{"minAge=1h", http.StatusOK, nil},
+		{"maxAge=1h", http.StatusOK, created},
+		{"tile=one", http.StatusBadRequest, nil},
+		{"status=sleeping", http.StatusBadRequest, nil},
+		{"maxAge=-1h", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			w := serve(SessionsHandler, adminRequest(http.MethodGet, "/?"+test.query, testAdminToken), vars)
+			if w.Code != test.status {
+				t.Fatalf("responded %d %s, want %d", w.Code, w.Body, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			listing := struct {
+				Sessions []session.Summary `json:"sessions"`
+			}{}
+			err := json.Unmarshal(w.Body.Bytes(), &listing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listing.Sessions) != len(test.want) {
+				t.Fatalf("listed %d sessions, want %d", len(listing.Sessions), len(test.want))
+			}
+			for i, s := range test.want {
+				if listing.Sessions[i].ID != s.ID {
+					t.Errorf("session %d is %v, want %v", i, listing.Sessions[i].ID, s.ID)
+				}
+			}
+		})
+	}
+}
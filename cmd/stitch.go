@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// compositeWait is the longest CompositeStatusHandler waits for a composite
+// version, it has to answer within the server's WriteTimeout
+const compositeWait = 10 * time.Second
+
+// CompositeStatusHandler reports the version of an instance's composite and
+// the version which will show tiles saved since. Given a version parameter,
+// such as the compositeVersion of a session which has saved its tile, it
+// waits until the composite reaches it or compositeWait passes and then
+// reports where the composite got to.
+func CompositeStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	var err error
+	var inst *instance.Instance
+	vars := mux.Vars(r)
+	if instanceID, provided := vars["instanceID"]; provided {
+		inst, err = instance.Open(instanceID)
+		if err != nil {
+			writeOpenError(w, err)
+			return
+		}
+	} else {
+		inst = openDefaultInstance()
+	}
+
+	if param := r.URL.Query().Get("version"); param != "" {
+		version, err := strconv.Atoi(param)
+		if err != nil {
+			http.Error(w, "version must be a composite version number", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), compositeWait)
+		defer cancel()
+		err = inst.WaitForComposite(ctx, version)
+		if err != nil && err != context.DeadlineExceeded && err != context.Canceled {
+			log.Error(errors.Wrap(err, "Failed to wait for composite"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	json, err := json.Marshal(inst.CompositeStatus())
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall composite status"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+func init() {
+	serveCmd.Flags().Duration("stitch-delay", instance.StitchDelay, "How long the composite waits after a tile is saved before it is restitched, saves in the meantime are rendered together")
+	viper.BindPFlag("stitch-delay", serveCmd.Flags().Lookup("stitch-delay"))
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+)
+
+// compositeStatus fetches the composite status of inst, waiting for version
+// if it is given
+func compositeStatus(t *testing.T, inst *instance.Instance, version string) instance.CompositeStatus {
+	t.Helper()
+	target := "/"
+	if version != "" {
+		target += "?version=" + version
+	}
+	w := serve(CompositeStatusHandler, httptest.NewRequest(http.MethodGet, target, nil), map[string]string{"instanceID": inst.ID.String()})
+	if w.Code != http.StatusOK {
+		t.Fatalf("composite status responded %d %s", w.Code, w.Body)
+	}
+	status := instance.CompositeStatus{}
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestCompositeStatus(t *testing.T) {
+	inst := newTestInstance(t)
+	useRenditions(t)
+	s, err := session.NewSession(inst, 2, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	r.Header.Set("Content-Type", "image/png")
+	w := serve(SessionSaveImageHandler, r, map[string]string{"instanceID": inst.ID.String(), "sessionID": s.ID.String()})
+	if w.Code != http.StatusOK {
+		t.Fatalf("save responded %d %s", w.Code, w.Body)
+	}
+	saved := session.Summary{}
+	err = json.Unmarshal(w.Body.Bytes(), &saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the save responds before the composite is restitched
+	status := compositeStatus(t, inst, "")
+	if saved.CompositeVersion != status.Version+1 || status.Pending != saved.CompositeVersion {
+		t.Fatalf("save will show in composite version %d, the composite is at %+v", saved.CompositeVersion, status)
+	}
+
+	stitch(t, inst)
+	status = compositeStatus(t, inst, "1")
+	if status.Version != saved.CompositeVersion || status.Pending != 0 {
+		t.Errorf("composite is at %+v once version %d was stitched", status, saved.CompositeVersion)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/?version=next", nil)
+	if w := serve(CompositeStatusHandler, r, map[string]string{"instanceID": inst.ID.String()}); w.Code != http.StatusBadRequest {
+		t.Errorf("a version which isn't a number responded %d", w.Code)
+	}
+}
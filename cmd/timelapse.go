@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timelapseRenders tracks timelapses being rendered in the background, by
+// instance, composite version and preset. A render which failed is kept
+// until its error has been reported once.
+var timelapseRenders = struct {
+	sync.Mutex
+	running map[string]bool
+	failed  map[string]error
+}{
+	running: make(map[string]bool),
+	failed:  make(map[string]error),
+}
+
+// timelapsePresets are the only timelapses clients can ask for, so that they
+// can't start renders of arbitrary options. The default preset is made from
+// the timelapse flags, the others vary it.
+var timelapsePresets = map[string]func(o *instance.TimelapseOptions){
+	"default": func(o *instance.TimelapseOptions) {},
+	"preview": func(o *instance.TimelapseOptions) {
+		o.Scale = o.Scale / 2
+		o.Palette = "plan9"
+		o.Dither = false
+	},
+	"full": func(o *instance.TimelapseOptions) {
+		o.Scale = 1
+		o.Palette = "adaptive"
+	},
+	"hourly": func(o *instance.TimelapseOptions) { o.Bucket = time.Hour },
+	"daily":  func(o *instance.TimelapseOptions) { o.Bucket = 24 * time.Hour },
+}
+
+// TimelapseHandler serves an animated GIF of the composite being drawn. The
+// first request for a version of the composite starts rendering it in the
+// background and is answered with 202 Accepted until it is ready. Only
+// timelapse-workers renders run at once, requests for another are answered
+// with 503 Service Unavailable until one finishes.
+func TimelapseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, err := instance.Open(vars["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	options, err := timelapseOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f, err := inst.OpenTimelapse(options)
+	if err == nil {
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("ETag", strconv.Quote(fmt.Sprintf("timelapse/%v/%d/%v", inst.ID, inst.CompositeVersion, options)))
+		w.Header().Set("Cache-Control", viper.GetString("image-cache-control"))
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+	if !os.IsNotExist(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Error(errors.Wrap(err, "Failed to open timelapse"))
+		return
+	}
+
+	key := fmt.Sprintf("%v/%d/%v", inst.ID, inst.CompositeVersion, options)
+	timelapseRenders.Lock()
+	if err, failed := timelapseRenders.failed[key]; failed {
+		delete(timelapseRenders.failed, key)
+		timelapseRenders.Unlock()
+		http.Error(w, "rendering the timelapse failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !timelapseRenders.running[key] {
+		if len(timelapseRenders.running) >= viper.GetInt("timelapse-workers") {
+			timelapseRenders.Unlock()
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "too many timelapses are being rendered", http.StatusServiceUnavailable)
+			return
+		}
+		timelapseRenders.running[key] = true
+		go renderTimelapse(inst, options, key)
+	}
+	timelapseRenders.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "rendering",
+	})
+}
+
+func renderTimelapse(inst *instance.Instance, options instance.TimelapseOptions, key string) {
+	started := time.Now()
+	err := inst.SaveTimelapse(options)
+
+	timelapseRenders.Lock()
+	defer timelapseRenders.Unlock()
+	delete(timelapseRenders.running, key)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to render timelapse for instance %v", inst.ID))
+		timelapseRenders.failed[key] = err
+		return
+	}
+	log.Infof("Rendered timelapse for instance %v in %v", inst.ID, time.Since(started))
+}
+
+// timelapseOptions reads the preset query parameter, one of
+// timelapsePresets, and applies it to the configured defaults
+func timelapseOptions(r *http.Request) (instance.TimelapseOptions, error) {
+	options := instance.TimelapseOptions{
+		Scale:   viper.GetFloat64("timelapse-scale"),
+		Delay:   viper.GetDuration("timelapse-delay"),
+		Bucket:  viper.GetDuration("timelapse-bucket"),
+		Palette: viper.GetString("timelapse-palette"),
+		Dither:  viper.GetBool("timelapse-dither"),
+	}
+
+	name := r.URL.Query().Get("preset")
+	if name == "" {
+		name = "default"
+	}
+	preset, ok := timelapsePresets[name]
+	if !ok {
+		names := make([]string, 0, len(timelapsePresets))
+		for name := range timelapsePresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return options, errors.Errorf("preset must be one of %s", strings.Join(names, ", "))
+	}
+	preset(&options)
+	return options, nil
+}
+
+func init() {
+	serveCmd.Flags().Float64("timelapse-scale", 0.25, "Default size of timelapses relative to the source image")
+	serveCmd.Flags().Duration("timelapse-delay", 250*time.Millisecond, "Default time each timelapse frame is shown")
+	serveCmd.Flags().Duration("timelapse-bucket", 0, "Default period of tile saves grouped into each timelapse frame, 0 for a frame per save")
+	serveCmd.Flags().String("timelapse-palette", "plan9", "Default palette for timelapse frames: plan9, websafe or adaptive")
+	serveCmd.Flags().Bool("timelapse-dither", true, "Dither timelapse frames by default")
+	serveCmd.Flags().Int("timelapse-workers", 2, "Number of timelapses rendered at once")
+	serveCmd.Flags().Int("timelapse-variants", instance.TimelapseVariants, "Number of rendered timelapses kept for each instance")
+	for _, flag := range []string{"timelapse-scale", "timelapse-delay", "timelapse-bucket", "timelapse-palette", "timelapse-dither", "timelapse-workers", "timelapse-variants"} {
+		viper.BindPFlag(flag, serveCmd.Flags().Lookup(flag))
+	}
+}
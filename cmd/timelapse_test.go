@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestTimelapsePresets(t *testing.T) {
+	inst := newTestInstance(t)
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	w := serve(TimelapseHandler, httptest.NewRequest(http.MethodGet, "/?preset=huge", nil), vars)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown preset responded %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w = serve(TimelapseHandler, httptest.NewRequest(http.MethodGet, "/?scale=1&delay=20ms", nil), vars)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("first request responded %d %s, want %d", w.Code, w.Body, http.StatusAccepted)
+	}
+
+	// the options in the query are ignored, so it is the default being
+	// rendered
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		timelapseRenders.Lock()
+		running := len(timelapseRenders.running)
+		timelapseRenders.Unlock()
+		if running == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w = serve(TimelapseHandler, httptest.NewRequest(http.MethodGet, "/?preset=default", nil), vars)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/gif" {
+		t.Errorf("rendered timelapse responded %d as %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestTimelapseWorkers(t *testing.T) {
+	inst := newTestInstance(t)
+	vars := map[string]string{"instanceID": inst.ID.String()}
+	previous := viper.GetInt("timelapse-workers")
+	viper.Set("timelapse-workers", 1)
+	t.Cleanup(func() { viper.Set("timelapse-workers", previous) })
+
+	// another render takes the only worker
+	timelapseRenders.Lock()
+	timelapseRenders.running["another"] = true
+	timelapseRenders.Unlock()
+	t.Cleanup(func() {
+		timelapseRenders.Lock()
+		delete(timelapseRenders.running, "another")
+		timelapseRenders.Unlock()
+	})
+
+	w := serve(TimelapseHandler, httptest.NewRequest(http.MethodGet, "/", nil), vars)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("responded %d with Retry-After %q, want %d", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	timelapseRenders.Lock()
+	running := len(timelapseRenders.running)
+	timelapseRenders.Unlock()
+	if running != 1 {
+		t.Errorf("%d renders running, want only the other one", running)
+	}
+}
@@ -0,0 +1,281 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+// candidateOut is a candidate as it is listed, with its votes and where to
+// fetch its image
+type candidateOut struct {
+	tile.Candidate
+	Votes    int    `json:"votes"`
+	ImageUrl string `json:"imageUrl"`
+}
+
+// roundOut is a voting round of a tile as it is listed, without the ballots
+// which would show how each voter voted
+type roundOut struct {
+	Location   tile.Location  `json:"location"`
+	Number     int            `json:"number"`
+	Closed     bool           `json:"closed"`
+	Winner     int            `json:"winner,omitempty"`
+	Candidates []candidateOut `json:"candidates"`
+}
+
+// openVotingTile opens the instance, tile location and voting round a voting
+// request is for, responding with an error and returning nil if they can't
+// be. The round is the current one unless the request names an earlier one.
+func openVotingTile(w http.ResponseWriter, vars map[string]string) (*instance.Instance, *tile.Location, int) {
+	inst, err := instance.Open(vars["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return nil, nil, 0
+	}
+	if inst.Mode != instance.ModeCompetitive {
+		http.Error(w, instance.ErrNotCompetitive.Error(), http.StatusConflict)
+		return nil, nil, 0
+	}
+
+	round := inst.VotingRound
+	if number, provided := vars["round"]; provided {
+		round, _ = strconv.Atoi(number)
+		if round < 1 || round > inst.VotingRound {
+			http.Error(w, fmt.Sprintf("round must be from 1 to %d", inst.VotingRound), http.StatusNotFound)
+			return nil, nil, 0
+		}
+	}
+
+	// earlier voting rounds may have been on the layout of an earlier round
+	location, found := layoutLocation(w, inst.VotingLayout(round), vars)
+	if !found {
+		return nil, nil, 0
+	}
+	return inst, &location, round
+}
+
+// CandidatesHandler lists the candidates submitted for a tile of a
+// competitive instance and the votes for them, in the current voting round
+// or an earlier one
+func CandidatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, location, number := openVotingTile(w, vars)
+	if inst == nil {
+		return
+	}
+
+	round, err := inst.Candidates(*location, number)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to load candidates"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	out := roundOut{
+		Location:   round.Location,
+		Number:     round.Number,
+		Closed:     round.Closed,
+		Winner:     round.Winner,
+		Candidates: make([]candidateOut, len(round.Candidates)),
+	}
+	votes := round.Tally()
+	for n, candidate := range round.Candidates {
+		out.Candidates[n] = candidateOut{
+			Candidate: candidate,
+			Votes:     votes[candidate.Number],
+			ImageUrl:  fmt.Sprintf("/v1/instance/%v/tile/%d/%d/round/%d/candidates/%d", inst.ID, location.X, location.Y, round.Number, candidate.Number),
+		}
+	}
+
+	json, err := json.Marshal(out)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall candidates"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// CandidateImageHandler serves the image of a candidate
+func CandidateImageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, location, round := openVotingTile(w, vars)
+	if inst == nil {
+		return
+	}
+	n, _ := strconv.Atoi(vars["candidate"])
+
+	candidate, data, err := inst.ReadCandidate(*location, round, n)
+	if errors.Cause(err) == instance.ErrNoCandidate {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// candidates never change once they're submitted
+	writeImage(w, r, storedImage{
+		key:      fmt.Sprintf("candidate/%v/%v/%d/%d", inst.ID, location, round, n),
+		format:   candidate.Format,
+		modified: candidate.Created,
+		read: func() ([]byte, error) {
+			return data, nil
+		},
+	})
+}
+
+// VoteHandler casts a vote for a candidate in the current voting round of a
+// tile. The ballot parameter must be a ballot issued by an admin, each
+// ballot has one vote per tile.
+func VoteHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	vars := mux.Vars(r)
+	inst, location, _ := openVotingTile(w, vars)
+	if inst == nil {
+		return
+	}
+	n, _ := strconv.Atoi(vars["candidate"])
+
+	err := inst.Vote(*location, n, r.URL.Query().Get("ballot"))
+	switch errors.Cause(err) {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case instance.ErrInvalidBallot:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case instance.ErrNoCandidate:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case instance.ErrArchived:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Error(errors.Wrap(err, "Failed to record vote"))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// IssueBallotsHandler issues the number of ballots given by the count
+// parameter for voting on a competitive instance. Only admins can issue
+// ballots, they are handed out to voters however the admin chooses.
+func IssueBallotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	if !isAdmin(r) {
+		http.Error(w, "this needs the admin token", http.StatusForbidden)
+		return
+	}
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 1 || count > maxBallots {
+		http.Error(w, fmt.Sprintf("count must be a number from 1 to %d", maxBallots), http.StatusBadRequest)
+		return
+	}
+
+	ballots, err := inst.IssueBallots(count)
+	if errors.Cause(err) == instance.ErrNotCompetitive {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(r, "issue-ballots", inst)
+
+	json, err := json.Marshal(map[string][]string{"ballots": ballots})
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall ballots"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// maxBallots is the most ballots issued by one request
+const maxBallots = 10000
+
+// CloseVotingHandler closes the current voting round of a competitive
+// instance, promoting the winning candidates, and starts the next one. Only
+// admins can close voting rounds.
+func CloseVotingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	if !isAdmin(r) {
+		http.Error(w, "this needs the admin token", http.StatusForbidden)
+		return
+	}
+	inst, err := instance.Open(mux.Vars(r)["instanceID"])
+	if err != nil {
+		writeOpenError(w, err)
+		return
+	}
+
+	closed := inst.VotingRound
+	promoted, err := inst.CloseVotingRound()
+	if cause := errors.Cause(err); cause == instance.ErrNotCompetitive || cause == instance.ErrArchived {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if promoted > 0 {
+		renditions.Invalidate(fmt.Sprintf("composite/%v/", inst.ID))
+		renditions.Invalidate(fmt.Sprintf("tile/%v/", inst.ID))
+	}
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	recordAdminAction(r, "close-voting", inst)
+
+	json, err := json.Marshal(struct {
+		Round    int `json:"round"`
+		Promoted int `json:"promoted"`
+		Next     int `json:"next"`
+	}{closed, promoted, inst.VotingRound})
+	if err != nil {
+		log.Error(errors.Wrap(err, "Failed to marshall voting result"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
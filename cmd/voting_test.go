@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// newCompetitiveInstance creates a competitive instance over the test
+// source, with a candidate submitted for tile 1,1
+func newCompetitiveInstance(t *testing.T) *instance.Instance {
+	t.Helper()
+	newTestInstance(t)
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath: filepath.Join(instance.DataPath, "source.png"),
+		Cols:            instance.DefaultStepCount,
+		Rows:            instance.DefaultStepCount,
+		Mode:            instance.ModeCompetitive,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := tile.Location{X: 1, Y: 1}
+	submission, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.UpdateTile(location, submission)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// votes counts the votes for the candidates of tile 1,1
+func votes(t *testing.T, inst *instance.Instance) map[int]int {
+	t.Helper()
+	round, err := inst.Candidates(tile.Location{X: 1, Y: 1}, inst.VotingRound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return round.Tally()
+}
+
+func TestVoteHandler(t *testing.T) {
+	inst := newCompetitiveInstance(t)
+	useRenditions(t)
+	ballots, err := inst.IssueBallots(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"instanceID": inst.ID.String(), "x": "1", "y": "1", "candidate": "1"}
+	vote := func(query string, remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodPost, "/?"+query, nil)
+		r.RemoteAddr = remoteAddr
+		return serve(VoteHandler, r, vars).Code
+	}
+
+	// anyone can start new sessions, so they can't be what lets them vote
+	for n := 0; n < 2; n++ {
+		w := serve(NewSessionHandler, httptest.NewRequest(http.MethodPost, "/", nil), map[string]string{"instanceID": inst.ID.String(), "x": "2", "y": "2"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("new session responded %d", w.Code)
+		}
+		s := &session.Session{}
+		err := json.Unmarshal(w.Body.Bytes(), s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, query := range []string{"", "session=" + s.ID.String(), "voter=" + s.ID.String(), "ballot=" + s.ID.String()} {
+			if status := vote(query, "192.0.2.1:1234"); status != http.StatusForbidden {
+				t.Errorf("voting with %q responded %d", query, status)
+			}
+		}
+	}
+	if tally := votes(t, inst); len(tally) != 0 {
+		t.Fatalf("votes without a ballot were counted: %v", tally)
+	}
+
+	// the ballot counts once however many addresses it is cast from
+	for _, addr := range []string{"192.0.2.1:1234", "192.0.2.2:1234", "192.0.2.2:1234"} {
+		if status := vote("ballot="+ballots[0], addr); status != http.StatusNoContent {
+			t.Fatalf("voting with a ballot responded %d", status)
+		}
+	}
+	if tally := votes(t, inst); tally[1] != 1 {
+		t.Errorf("one ballot counted %d times", tally[1])
+	}
+
+	vars["candidate"] = "2"
+	if status := vote("ballot="+ballots[0], "192.0.2.1:1234"); status != http.StatusNotFound {
+		t.Errorf("voting for a missing candidate responded %d", status)
+	}
+}
+
+func TestIssueBallotsHandler(t *testing.T) {
+	inst := newCompetitiveInstance(t)
+	useRenditions(t)
+	useAdminToken(t)
+	vars := map[string]string{"instanceID": inst.ID.String()}
+
+	if w := serve(IssueBallotsHandler, adminRequest(http.MethodPost, "/?count=2", ""), vars); w.Code != http.StatusForbidden {
+		t.Fatalf("issuing without the token responded %d", w.Code)
+	}
+	for _, count := range []string{"", "0", "many", "10001"} {
+		if w := serve(IssueBallotsHandler, adminRequest(http.MethodPost, "/?count="+count, testAdminToken), vars); w.Code != http.StatusBadRequest {
+			t.Errorf("issuing %q ballots responded %d", count, w.Code)
+		}
+	}
+
+	w := serve(IssueBallotsHandler, adminRequest(http.MethodPost, "/?count=2", testAdminToken), vars)
+	if w.Code != http.StatusOK {
+		t.Fatalf("issuing responded %d %s", w.Code, w.Body)
+	}
+	issued := struct {
+		Ballots []string `json:"ballots"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issued.Ballots) != 2 || issued.Ballots[0] == issued.Ballots[1] {
+		t.Fatalf("issued %v", issued.Ballots)
+	}
+	for _, ballot := range issued.Ballots {
+		err := inst.Vote(tile.Location{X: 1, Y: 1}, 1, ballot)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	entries := auditTrail(t)
+	if len(entries) != 1 || entries[0].Action != "issue-ballots" || entries[0].Instance != inst.ID {
+		t.Errorf("recorded %v", entries)
+	}
+
+	latest, err := instance.New(filepath.Join(instance.DataPath, "source.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(IssueBallotsHandler, adminRequest(http.MethodPost, "/?count=1", testAdminToken), map[string]string{"instanceID": latest.ID.String()}); w.Code != http.StatusConflict {
+		t.Errorf("issuing ballots for a latest instance responded %d", w.Code)
+	}
+}
@@ -10,4 +10,5 @@ require (
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.7.1
+	golang.org/x/image v0.0.0-20210220032944-ac19c3e999fb
 )
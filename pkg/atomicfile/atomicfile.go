@@ -0,0 +1,91 @@
+// Package atomicfile writes files so that readers only ever see the whole of
+// their previous or new contents, never a file which is half written
+package atomicfile
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// File is written in place of a file which it replaces when it is
+// committed. Until then it is a temporary file beside the one it replaces.
+type File struct {
+	*os.File
+	filename  string
+	perm      os.FileMode
+	committed bool
+}
+
+// Create starts writing a file which will replace filename
+func Create(filename string, perm os.FileMode) (*File, error) {
+	f, err := ioutil.TempFile(path.Dir(filename), "."+path.Base(filename)+".tmp-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Couldn't create temporary file for %s", filename)
+	}
+	return &File{File: f, filename: filename, perm: perm}, nil
+}
+
+// Commit flushes the file to disk and moves it into place
+func (f *File) Commit() error {
+	if f.committed {
+		return nil
+	}
+	err := f.File.Chmod(f.perm)
+	if err == nil {
+		err = f.File.Sync()
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.File.Name())
+		return errors.Wrapf(err, "Failed to write %s", f.filename)
+	}
+
+	err = os.Rename(f.File.Name(), f.filename)
+	if err != nil {
+		os.Remove(f.File.Name())
+		return errors.Wrapf(err, "Failed to replace %s", f.filename)
+	}
+	f.committed = true
+	syncDir(path.Dir(f.filename))
+	return nil
+}
+
+// Close discards the file if it hasn't been committed, leaving the file it
+// would have replaced as it was
+func (f *File) Close() error {
+	if f.committed {
+		return nil
+	}
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// WriteFile replaces filename with data
+func WriteFile(filename string, data []byte, perm os.FileMode) error {
+	f, err := Create(filename, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write %s", filename)
+	}
+	return f.Commit()
+}
+
+// syncDir flushes the rename of a file in dir to disk. Not every platform
+// can sync a folder so failing to is ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,61 @@
+// Package audit keeps a trail of destructive and administrative actions
+package audit
+
+import (
+	"encoding/json"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Entry is a single action recorded in the trail
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Instance uuid.UUID `json:"instance"`
+	// Actor is who carried out the action, e.g. the address of an admin's
+	// request or the user running a command
+	Actor  string `json:"actor"`
+	Detail string `json:"detail,omitempty"`
+}
+
+var mu sync.Mutex
+
+// Path is the file the trail is kept in, one JSON entry per line
+func Path() string {
+	return path.Join(instance.DataPath, "audit.log")
+}
+
+// Record appends an entry to the trail, setting its time if it hasn't been
+func Record(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshall audit entry")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	err = os.MkdirAll(path.Dir(Path()), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create audit folder")
+	}
+	f, err := os.OpenFile(Path(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't open audit trail for writing")
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		return errors.Wrap(err, "Failed to write audit entry")
+	}
+	return nil
+}
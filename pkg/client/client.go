@@ -0,0 +1,359 @@
+// Package client is a Go client for the Donk API
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client makes requests to a Donk server
+type Client struct {
+	// BaseURL is the address of the server, e.g. http://localhost:8000
+	BaseURL    string
+	HTTPClient *http.Client
+	// MaxRetries is how many times a request is retried after a network
+	// error or a response saying the server is unavailable. Requests which
+	// change something are only retried if the server turned them away.
+	MaxRetries int
+	// RetryWait is how long to wait before the first retry, it doubles with
+	// each one after that
+	RetryWait time.Duration
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		MaxRetries: 3,
+		RetryWait:  500 * time.Millisecond,
+	}
+}
+
+// Error is returned when the server responds to a request with an error
+// status. Message is the explanation the server gave, if any.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		message += ": " + e.Message
+	}
+	return message
+}
+
+// Temporary reports whether the request might succeed if it is made again
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// IsNotFound reports whether err is an *Error for something which doesn't
+// exist
+func IsNotFound(err error) bool {
+	e, ok := errors.Cause(err).(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// IsRejected reports whether err is an *Error for a tile image the server
+// wouldn't accept, because it failed validation, was too large or was of an
+// unsupported type
+func IsRejected(err error) bool {
+	e, ok := errors.Cause(err).(*Error)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType:
+		return true
+	}
+	return false
+}
+
+// CreateInstance creates an instance from a source image on the server
+func (c *Client) CreateInstance(ctx context.Context, sourceImage string) (*instance.Instance, error) {
+	p := "/v1/instance/new"
+	if sourceImage != "" {
+		p += "?sourceImage=" + url.QueryEscape(sourceImage)
+	}
+	inst := &instance.Instance{}
+	err := c.doJSON(ctx, http.MethodPost, p, inst)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create instance")
+	}
+	return inst, nil
+}
+
+// Instance fetches an instance
+func (c *Client) Instance(ctx context.Context, instanceID uuid.UUID) (*instance.Instance, error) {
+	inst := &instance.Instance{}
+	err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/v1/instance/%v", instanceID), inst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch instance %v", instanceID)
+	}
+	return inst, nil
+}
+
+// CreateSession starts a session for drawing the tile at location. Tiles
+// saved in the session are credited to contributor, which may be nil.
+func (c *Client) CreateSession(ctx context.Context, instanceID uuid.UUID, location tile.Location, contributor *tile.Contributor) (*session.Session, error) {
+	p := fmt.Sprintf("/v1/instance/%v/session/new/%d/%d", instanceID, location.X, location.Y)
+	if contributor != nil {
+		query := url.Values{}
+		query.Set("name", contributor.Name)
+		if contributor.Handle != "" {
+			query.Set("handle", contributor.Handle)
+		}
+		if contributor.Link != "" {
+			query.Set("link", contributor.Link)
+		}
+		p += "?" + query.Encode()
+	}
+	s := &session.Session{}
+	err := c.doJSON(ctx, http.MethodPost, p, s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create session for tile %v", location)
+	}
+	return s, nil
+}
+
+// Session fetches a session
+func (c *Client) Session(ctx context.Context, instanceID uuid.UUID, sessionID uuid.UUID) (*session.Session, error) {
+	s := &session.Session{}
+	err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/v1/instance/%v/session/%v", instanceID, sessionID), s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch session %v", sessionID)
+	}
+	return s, nil
+}
+
+// Credits lists the contributors credited with each tile of an instance
+func (c *Client) Credits(ctx context.Context, instanceID uuid.UUID) ([]instance.TileCredit, error) {
+	credits := []instance.TileCredit{}
+	err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/v1/instance/%v/credits", instanceID), &credits)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch credits of instance %v", instanceID)
+	}
+	return credits, nil
+}
+
+// Layout fetches the name, location and bounds of each tile of an instance
+func (c *Client) Layout(ctx context.Context, instanceID uuid.UUID) (tile.Layout, error) {
+	layout := tile.Layout{}
+	err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/v1/instance/%v/layout", instanceID), &layout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch layout of instance %v", instanceID)
+	}
+	return layout, nil
+}
+
+// Composite downloads the current composite image of an instance
+func (c *Client) Composite(ctx context.Context, instanceID uuid.UUID) (image.Image, error) {
+	img, err := c.getImage(ctx, fmt.Sprintf("/v1/instance/%v/composite", instanceID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to download composite of instance %v", instanceID)
+	}
+	return img, nil
+}
+
+// Background downloads the background image of a session, which shows its
+// tile as it was when the session was created or last saved
+func (c *Client) Background(ctx context.Context, s *session.Session) (image.Image, error) {
+	img, err := c.getImage(ctx, fmt.Sprintf("/v1/instance/%v/session/%v/background", s.Instance.ID, s.ID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to download background of session %v", s.ID)
+	}
+	return img, nil
+}
+
+// SubmitTile saves img as a new version of the session's tile. It is sent as
+// a PNG so transparent areas show the previous version. Metadata is saved
+// with the version, it may be nil. Name, handle and link fields credit
+// someone other than the session's contributor. The composite is restitched
+// in the background, s is updated with the CompositeVersion which will show
+// the tile, see WaitForComposite.
+func (c *Client) SubmitTile(ctx context.Context, s *session.Session, img image.Image, metadata map[string]string) error {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, img)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode tile image")
+	}
+
+	body := encoded.Bytes()
+	contentType := "image/png"
+	if len(metadata) > 0 {
+		var form bytes.Buffer
+		w := multipart.NewWriter(&form)
+		for name, value := range metadata {
+			w.WriteField(name, value)
+		}
+		part, err := w.CreatePart(map[string][]string{
+			"Content-Disposition": {`form-data; name="image"; filename="tile.png"`},
+			"Content-Type":        {"image/png"},
+		})
+		if err != nil {
+			return errors.Wrap(err, "Failed to write multipart body")
+		}
+		part.Write(body)
+		w.Close()
+		body = form.Bytes()
+		contentType = w.FormDataContentType()
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/v1/instance/%v/session/%v/save", s.Instance.ID, s.ID), contentType, body)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to submit tile for session %v", s.ID)
+	}
+	defer resp.Body.Close()
+
+	saved := session.Session{}
+	err = json.NewDecoder(resp.Body).Decode(&saved)
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshall response")
+	}
+	s.TileVersion = saved.TileVersion
+	s.CompositeVersion = saved.CompositeVersion
+	s.Status = saved.Status
+	s.Updated = saved.Updated
+	return nil
+}
+
+// WaitForComposite waits for the composite of an instance to reach version,
+// such as the CompositeVersion of a session which has submitted its tile. The
+// server gives up waiting after a few seconds so the status returned may be
+// of an earlier version, it can be called again until it isn't.
+func (c *Client) WaitForComposite(ctx context.Context, instanceID uuid.UUID, version int) (instance.CompositeStatus, error) {
+	status := instance.CompositeStatus{}
+	err := c.doJSON(ctx, http.MethodGet, fmt.Sprintf("/v1/instance/%v/composite/status?version=%d", instanceID, version), &status)
+	if err != nil {
+		return status, errors.Wrapf(err, "Failed to fetch composite status of instance %v", instanceID)
+	}
+	return status, nil
+}
+
+func (c *Client) getImage(ctx context.Context, p string) (image.Image, error) {
+	resp, err := c.do(ctx, http.MethodGet, p, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode image")
+	}
+	return img, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method string, p string, v interface{}) error {
+	resp, err := c.do(ctx, method, p, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrap(err, "Failed to unmarshall response")
+	}
+	return nil
+}
+
+// do makes a request, retrying it as described by MaxRetries. A response
+// with an error status is returned as an *Error.
+func (c *Client) do(ctx context.Context, method string, p string, contentType string, body []byte) (*http.Response, error) {
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, method, p, contentType, body)
+		if err == nil {
+			return resp, nil
+		}
+		if attempt >= c.MaxRetries || !c.retryable(method, err) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method string, p string, contentType string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+p, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create request")
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, &Error{
+		Method:     method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(message)),
+	}
+}
+
+// retryable reports whether a request which failed with err can be made
+// again. Only GET requests are retried after network errors, since anything
+// else might have been carried out before the connection failed.
+func (c *Client) retryable(method string, err error) bool {
+	if e, ok := err.(*Error); ok {
+		if e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable {
+			return true
+		}
+		return method == http.MethodGet && e.Temporary()
+	}
+	if _, ok := err.(*url.Error); ok {
+		return method == http.MethodGet
+	}
+	return false
+}
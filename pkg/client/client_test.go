@@ -0,0 +1,207 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/google/uuid"
+)
+
+// dropped stands in for a status, the connection is closed without a
+// response instead
+const dropped = 0
+
+// saves answers tile saves with each of statuses in turn, repeating the last
+// once they run out, and keeps the bodies it was sent
+type saves struct {
+	sync.Mutex
+	statuses     []int
+	bodies       [][]byte
+	contentTypes []string
+}
+
+func (s *saves) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.Lock()
+	status := s.statuses[len(s.statuses)-1]
+	if len(s.bodies) < len(s.statuses) {
+		status = s.statuses[len(s.bodies)]
+	}
+	s.bodies = append(s.bodies, body)
+	s.contentTypes = append(s.contentTypes, r.Header.Get("Content-Type"))
+	s.Unlock()
+
+	if status == dropped {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	w.WriteHeader(status)
+	if status != http.StatusOK {
+		w.Write([]byte("tile rejected"))
+		return
+	}
+	w.Write([]byte(`{"tileVersion": 1, "compositeVersion": 2, "status": "submitted"}`))
+}
+
+func testSession() *session.Session {
+	return &session.Session{ID: uuid.New(), Instance: &instance.Instance{ID: uuid.New()}}
+}
+
+func testTile() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	img.Set(3, 3, color.Black)
+	return img
+}
+
+// TestSubmitTileRetries checks that a tile save is only sent again when the
+// server turned it away without saving it, and that the whole body is sent
+// each time
+func TestSubmitTileRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		metadata map[string]string
+		attempts int
+		ok       bool
+	}{
+		{"saved", []int{200}, nil, 1, true},
+		{"unavailable", []int{503, 200}, nil, 2, true},
+		{"too many requests", []int{429, 503, 200}, nil, 3, true},
+		{"multipart unavailable", []int{503, 200}, map[string]string{"title": "night"}, 2, true},
+		{"gives up", []int{503}, nil, 4, false},
+		// the save may have been made behind a gateway or before the
+		// connection went, so making it again could save a second version
+		{"bad gateway", []int{502, 200}, nil, 1, false},
+		{"gateway timeout", []int{504, 200}, nil, 1, false},
+		{"connection dropped", []int{dropped, 200}, nil, 1, false},
+		{"rejected", []int{400, 200}, nil, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &saves{statuses: test.statuses}
+			ts := httptest.NewServer(server)
+			c := New(ts.URL)
+			c.RetryWait = time.Millisecond
+
+			s := testSession()
+			err := c.SubmitTile(context.Background(), s, testTile(), test.metadata)
+			// closing waits for the handler, so that what it kept can be read
+			ts.Close()
+			if (err == nil) != test.ok {
+				t.Errorf("got %v, want success %t", err, test.ok)
+			}
+			if test.ok && (s.CompositeVersion != 2 || s.Status != session.StatusSubmitted) {
+				t.Errorf("session is %s waiting for composite version %d", s.Status, s.CompositeVersion)
+			}
+			if len(server.bodies) != test.attempts {
+				t.Fatalf("sent %d times, want %d", len(server.bodies), test.attempts)
+			}
+			for n := 1; n < len(server.bodies); n++ {
+				if !bytes.Equal(server.bodies[n], server.bodies[0]) || server.contentTypes[n] != server.contentTypes[0] {
+					t.Errorf("attempt %d sent %d bytes of %s, the first sent %d bytes of %s", n+1,
+						len(server.bodies[n]), server.contentTypes[n], len(server.bodies[0]), server.contentTypes[0])
+				}
+			}
+			checkTileBody(t, server.contentTypes[len(server.bodies)-1], server.bodies[len(server.bodies)-1], test.metadata)
+		})
+	}
+}
+
+// checkTileBody checks that the last body sent holds the whole tile
+func checkTileBody(t *testing.T, contentType string, body []byte, metadata map[string]string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType == "multipart/form-data" {
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if form.Value["title"][0] != metadata["title"] {
+			t.Errorf("sent title %v", form.Value["title"])
+		}
+		f, err := form.File["image"][0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		body, _ = ioutil.ReadAll(f)
+	} else if mediaType != "image/png" {
+		t.Fatalf("sent %s", mediaType)
+	}
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("sent a tile which can't be decoded: %v", err)
+	}
+	if r, _, _, a := img.At(3, 3).RGBA(); r != 0 || a != 0xffff {
+		t.Errorf("sent tile has %v", img.At(3, 3))
+	}
+}
+
+// TestGetRetries checks that reads are retried after the connection drops
+// and gateway errors, which saves are not
+func TestGetRetries(t *testing.T) {
+	for _, statuses := range [][]int{{dropped, 200}, {502, 504, 200}} {
+		server := &saves{statuses: statuses}
+		ts := httptest.NewServer(server)
+		c := New(ts.URL)
+		c.RetryWait = time.Millisecond
+
+		// the body isn't a session, all that matters is how often it was
+		// fetched
+		c.Session(context.Background(), uuid.New(), uuid.New())
+		ts.Close()
+		if len(server.bodies) != len(statuses) {
+			t.Errorf("%v: fetched %d times", statuses, len(server.bodies))
+		}
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	server := &saves{statuses: []int{503}}
+	ts := httptest.NewServer(server)
+	c := New(ts.URL)
+	c.RetryWait = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.SubmitTile(ctx, testSession(), testTile(), nil)
+	ts.Close()
+	if err == nil || len(server.bodies) != 1 {
+		t.Errorf("sent %d times before being cancelled, got %v", len(server.bodies), err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for status, rejected := range map[int]bool{400: true, 413: true, 415: true, 404: false, 500: false} {
+		server := &saves{statuses: []int{status}}
+		ts := httptest.NewServer(server)
+		err := New(ts.URL).SubmitTile(context.Background(), testSession(), testTile(), nil)
+		ts.Close()
+
+		if IsRejected(err) != rejected || IsNotFound(err) != (status == 404) {
+			t.Errorf("%d: rejected is %t and not found is %t", status, IsRejected(err), IsNotFound(err))
+		}
+		if err == nil || !bytes.Contains([]byte(err.Error()), []byte("tile rejected")) {
+			t.Errorf("%d: error %v doesn't give the server's reason", status, err)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package instance
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ArchiveFormats are the formats instances can be exported in
+var ArchiveFormats = []string{"zip", "tar"}
+
+// manifestVersion is the version of the manifests written by Export.
+// Version 1 archives, which had no candidates or ballots, can still be
+// imported.
+const manifestVersion = 2
+
+// Manifest describes the contents of an exported instance. It is stored in
+// the archive as manifest.json, alongside the files it lists:
+//
+//	source.<ext>               the source image
+//	stitch.jpg                 the composite image
+//	ballots                    hashes of the ballots issued for voting
+//	tiles/<x>,<y>/...          tile records, versions and candidates
+//	rounds/<n>/stitch.jpg      the composites earlier rounds ended with
+//	rounds/<n>/source.<ext>    the source of an earlier round which wasn't
+//	                           the composite of the round before, such as
+//	                           the first
+//	rounds/<n>/tiles/...       the tiles of earlier rounds
+//	sessions/<id>/session      session records, if they were exported
+type Manifest struct {
+	Version  int           `json:"version"`
+	Exported time.Time     `json:"exported"`
+	Instance *Instance     `json:"instance"`
+	Files    []ArchiveFile `json:"files"`
+}
+
+// ArchiveFile is a file in an exported instance, with its SHA-256 checksum
+type ArchiveFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// archiveFilePattern matches the names of the files allowed in an archive,
+// so nothing can be imported outside the instance folder
+var archiveFilePattern = regexp.MustCompile(`^(manifest\.json|source\.[a-z]+|stitch\.jpg|ballots|` +
+	`rounds/[0-9]+/(stitch\.jpg|source\.[a-z]+)|` +
+	`(rounds/[0-9]+/)?tiles/[0-9]+,[0-9]+/(tile|[0-9]+\.[a-z]+|candidates/[0-9]+/(round|[0-9]+\.[a-z]+))|` +
+	`sessions/[0-9a-f-]{36}/session)$`)
+
+// archiveWriter adds files to a zip or tar archive
+type archiveWriter interface {
+	add(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z zipArchive) add(name string, size int64, modified time.Time) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (t tarArchive) add(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := t.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modified,
+	})
+	return t.Writer, err
+}
+
+// ExportOptions control what is written by Export
+type ExportOptions struct {
+	// Format is one of ArchiveFormats
+	Format string
+	// Sessions includes the session records. Their IDs are all that's
+	// needed to save to a session, so they shouldn't be given out to
+	// anyone who could not already save to them.
+	Sessions bool
+}
+
+// Export writes a self-contained archive of the instance to w. Session
+// backgrounds, timelapses and other files which can be made again from the
+// rest are left out.
+func (i *Instance) Export(w io.Writer, options ExportOptions) error {
+	instancePath := i.Path()
+	if _, err := os.Stat(path.Join(instancePath, "instance")); err != nil {
+		return errors.Wrapf(err, "Instance %v not found", i.ID)
+	}
+
+	var archive archiveWriter
+	switch options.Format {
+	case "zip":
+		archive = zipArchive{zip.NewWriter(w)}
+	case "tar":
+		archive = tarArchive{tar.NewWriter(w)}
+	default:
+		return errors.Errorf("Unknown archive format %s", options.Format)
+	}
+
+	manifest := &Manifest{
+		Version:  manifestVersion,
+		Exported: time.Now().UTC(),
+		Instance: i,
+		Files:    make([]ArchiveFile, 0),
+	}
+	addFile := func(name string, filePath string) error {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open %s", filePath)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %s", filePath)
+		}
+
+		entry, err := archive.add(name, info.Size(), info.ModTime())
+		if err != nil {
+			return errors.Wrapf(err, "Failed to add %s to archive", name)
+		}
+		hash := sha256.New()
+		size, err := io.Copy(io.MultiWriter(entry, hash), f)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to write %s to archive", name)
+		}
+		manifest.Files = append(manifest.Files, ArchiveFile{
+			Path:   name,
+			Size:   size,
+			SHA256: hex.EncodeToString(hash.Sum(nil)),
+		})
+		return nil
+	}
+
+	err := addFile("source"+strings.ToLower(path.Ext(i.SourceImagePath)), i.SourceImagePath)
+	if err != nil {
+		return err
+	}
+	err = addFile("stitch.jpg", path.Join(instancePath, "stitch.jpg"))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(i.ballotsPath()); err == nil {
+		err = addFile("ballots", i.ballotsPath())
+		if err != nil {
+			return err
+		}
+	}
+
+	// adds every file of a tiles folder which belongs in an archive
+	addTiles := func(name string, tilesPath string) error {
+		return filepath.Walk(tilesPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && filePath == tilesPath {
+					return nil
+				}
+				return errors.Wrap(err, "Failed to list tile folder")
+			}
+			rel, err := filepath.Rel(tilesPath, filePath)
+			if err != nil || info.IsDir() {
+				return err
+			}
+			entryName := path.Join(name, filepath.ToSlash(rel))
+			if !archiveFilePattern.MatchString(entryName) {
+				return nil
+			}
+			return addFile(entryName, filePath)
+		})
+	}
+	err = addTiles("tiles", i.tilesPath())
+	if err != nil {
+		return err
+	}
+
+	for _, round := range i.Rounds {
+		roundName := fmt.Sprintf("rounds/%d", round.Number)
+		err = addFile(roundName+"/stitch.jpg", i.RoundCompositePath(round.Number))
+		if err != nil {
+			return err
+		}
+		// later rounds were drawn over the composite already added
+		if round.SourceImagePath != i.RoundCompositePath(round.Number-1) {
+			err = addFile(roundName+"/source"+strings.ToLower(path.Ext(round.SourceImagePath)), round.SourceImagePath)
+			if err != nil {
+				return err
+			}
+		}
+		err = addTiles(roundName+"/tiles", path.Join(i.roundPath(round.Number), "tiles"))
+		if err != nil {
+			return err
+		}
+	}
+
+	sessionsPath := path.Join(instancePath, "sessions")
+	var sessions []os.FileInfo
+	if options.Sessions {
+		sessions, _ = ioutil.ReadDir(sessionsPath)
+	}
+	for _, s := range sessions {
+		sessionFile := path.Join(sessionsPath, s.Name(), "session")
+		if _, err := os.Stat(sessionFile); err != nil {
+			continue
+		}
+		err = addFile(path.Join("sessions", s.Name(), "session"), sessionFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, _ := json.MarshalIndent(manifest, "", " ")
+	entry, err := archive.add("manifest.json", int64(len(data)), manifest.Exported)
+	if err != nil {
+		return errors.Wrap(err, "Failed to add manifest to archive")
+	}
+	_, err = entry.Write(data)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write manifest to archive")
+	}
+
+	return archive.Close()
+}
+
+// ImportOptions control how an archive is imported
+type ImportOptions struct {
+	// ID replaces the instance's ID in the archive, unless it is uuid.Nil
+	ID uuid.UUID
+}
+
+// Import restores an instance from an archive written by Export, in either
+// format. Every file is checked against the manifest before the instance is
+// put in place, so a damaged archive leaves nothing behind.
+func Import(r io.Reader, options ImportOptions) (*Instance, error) {
+	instancesPath := InstancesPath()
+	err := os.MkdirAll(instancesPath, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create instances folder")
+	}
+
+	staging, err := ioutil.TempDir(instancesPath, ".import-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create import folder")
+	}
+	defer os.RemoveAll(staging)
+
+	checksums, err := extractArchive(r, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path.Join(staging, "manifest.json"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Archive has no manifest")
+	}
+	manifest := &Manifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshall manifest")
+	}
+	if manifest.Version < 1 || manifest.Version > manifestVersion || manifest.Instance == nil {
+		return nil, errors.Errorf("Unsupported manifest version %d", manifest.Version)
+	}
+
+	delete(checksums, "manifest.json")
+	for _, f := range manifest.Files {
+		checksum, found := checksums[f.Path]
+		if !found {
+			return nil, errors.Errorf("Archive is missing %s", f.Path)
+		}
+		if checksum != f.SHA256 {
+			return nil, errors.Errorf("Checksum of %s doesn't match the manifest", f.Path)
+		}
+		delete(checksums, f.Path)
+	}
+	for name := range checksums {
+		return nil, errors.Errorf("Archive has %s which isn't in the manifest", name)
+	}
+
+	i := manifest.Instance
+	if options.ID != uuid.Nil && options.ID != i.ID {
+		err = remapSessions(staging, options.ID)
+		if err != nil {
+			return nil, err
+		}
+		i.ID = options.ID
+	}
+	instancePath := path.Join(instancesPath, i.ID.String())
+	if _, err := os.Stat(instancePath); err == nil {
+		return nil, errors.Errorf("Instance %v already exists", i.ID)
+	}
+
+	// sources of earlier rounds which weren't exported were the composite of
+	// the round before
+	for n := range i.Rounds {
+		if number := i.Rounds[n].Number; number > 1 {
+			i.Rounds[n].SourceImagePath = i.RoundCompositePath(number - 1)
+		}
+	}
+	for _, f := range manifest.Files {
+		if strings.HasPrefix(f.Path, "source.") {
+			i.SourceImagePath = path.Join(instancePath, f.Path)
+		}
+		for n := range i.Rounds {
+			if strings.HasPrefix(f.Path, fmt.Sprintf("rounds/%d/source.", i.Rounds[n].Number)) {
+				i.Rounds[n].SourceImagePath = path.Join(instancePath, f.Path)
+			}
+		}
+	}
+	i.CompositeImageUrl = fmt.Sprintf("/v1/instance/%v/composite", i.ID)
+
+	os.Remove(path.Join(staging, "manifest.json"))
+	err = os.Rename(staging, instancePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to move imported instance into place")
+	}
+	// the source isn't exported in pieces, without them the whole of it is
+	// read instead
+	err = i.cutSource()
+	if err != nil {
+		log.Warn(errors.Wrapf(err, "Failed to cut source image of imported instance %v", i.ID))
+	}
+	err = i.save()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save instance data")
+	}
+
+	log.Infof("Imported instance %v", i.ID)
+	return i, nil
+}
+
+// extractArchive writes the files in a zip or tar archive to dir, returning
+// their checksums
+func extractArchive(r io.Reader, dir string) (map[string]string, error) {
+	checksums := make(map[string]string)
+	extract := func(name string, content io.Reader) error {
+		if !archiveFilePattern.MatchString(name) {
+			return errors.Errorf("Archive has unexpected file %s", name)
+		}
+		if _, found := checksums[name]; found {
+			return errors.Errorf("Archive has %s more than once", name)
+		}
+
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create folder for imported file")
+		}
+		f, err := os.Create(filePath)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create imported file")
+		}
+		defer f.Close()
+
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(f, hash), content)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to extract %s", name)
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	}
+
+	reader := bufio.NewReader(r)
+	magic, _ := reader.Peek(4)
+	if string(magic) != "PK\x03\x04" {
+		archive := tar.NewReader(reader)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return checksums, nil
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to read archive")
+			}
+			if header.Typeflag == tar.TypeDir {
+				continue
+			}
+			if header.Typeflag != tar.TypeReg {
+				return nil, errors.Errorf("Archive entry %s is not a regular file", header.Name)
+			}
+			err = extract(header.Name, archive)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// zip needs random access, so spool the archive to disk first
+	spool, err := ioutil.TempFile(dir, ".archive-")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create temporary file")
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read archive")
+	}
+
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read archive")
+	}
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		content, err := f.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read %s from archive", f.Name)
+		}
+		err = extract(f.Name, content)
+		content.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return checksums, nil
+}
+
+// remapSessions points the imported session records at a new instance ID
+func remapSessions(dir string, id uuid.UUID) error {
+	sessions, _ := ioutil.ReadDir(path.Join(dir, "sessions"))
+	for _, s := range sessions {
+		sessionFile := path.Join(dir, "sessions", s.Name(), "session")
+		data, err := ioutil.ReadFile(sessionFile)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read imported session")
+		}
+		record := make(map[string]interface{})
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to unmarshall imported session %s", s.Name())
+		}
+		record["instanceID"] = id
+		data, _ = json.MarshalIndent(record, "", " ")
+		err = ioutil.WriteFile(sessionFile, data, 0755)
+		if err != nil {
+			return errors.Wrap(err, "Failed to write imported session")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package instance_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+)
+
+// archivedInstance has a few tile versions and a session
+func archivedInstance(t *testing.T) *instance.Instance {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	submit(t, inst, tile.Location{X: 0, Y: 0}, encodePNG(t, 10, 10, color.Black))
+	submit(t, inst, tile.Location{X: 0, Y: 0}, encodePNG(t, 10, 10, color.White))
+	submit(t, inst, tile.Location{X: 5, Y: 5}, encodePNG(t, 10, 10, color.Black))
+	_, err := session.NewSession(inst, 2, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// derivedFiles are made again on import rather than archived, or like the lock
+// file aren't kept at all. Sources are archived but kept under different names.
+var derivedFiles = regexp.MustCompile(`^(instance|lock|timelapse/.*|sessions/[^/]+/background\.jpg|(rounds/[0-9]+/)?source\.[a-z]+)$`)
+
+// instanceFiles lists the files of an instance which are archived
+func instanceFiles(t *testing.T, inst *instance.Instance) []string {
+	t.Helper()
+	instancePath := inst.Path()
+	files := []string{}
+	err := filepath.Walk(instancePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(instancePath, p)
+		if !derivedFiles.MatchString(filepath.ToSlash(rel)) {
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, format := range instance.ArchiveFormats {
+		t.Run(format, func(t *testing.T) {
+			inst := archivedInstance(t)
+
+			var archive bytes.Buffer
+			err := inst.Export(&archive, instance.ExportOptions{Format: format, Sessions: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported, err := instance.Import(&archive, instance.ImportOptions{ID: uuid.New()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := instanceFiles(t, imported), instanceFiles(t, inst); !reflect.DeepEqual(got, want) {
+				t.Errorf("imported files are\n%v\nwant\n%v", got, want)
+			}
+			if _, err := os.Stat(imported.SourceImagePath); err != nil {
+				t.Errorf("imported source: %v", err)
+			}
+			saved, err := imported.Tile(tile.Location{X: 0, Y: 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(saved.Versions) != 2 {
+				t.Errorf("imported tile has %d versions, want 2", len(saved.Versions))
+			}
+		})
+	}
+}
+
+func TestArchiveRounds(t *testing.T) {
+	useTempData(t)
+	inst := completeTestInstance(t)
+	err := inst.StartRound(instance.RoundOptions{Cols: 3, Rows: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit(t, inst, tile.Location{X: 2, Y: 2}, encodePNG(t, 20, 20, color.White))
+
+	var archive bytes.Buffer
+	err = inst.Export(&archive, instance.ExportOptions{Format: "zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := instance.Import(&archive, instance.ImportOptions{ID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := instanceFiles(t, imported), instanceFiles(t, inst); !reflect.DeepEqual(got, want) {
+		t.Errorf("imported files are\n%v\nwant\n%v", got, want)
+	}
+	// the first round's source was outside the instance folder
+	first := imported.FindRound(1)
+	if first == nil || !strings.HasPrefix(first.SourceImagePath, imported.Path()) {
+		t.Fatalf("imported first round %+v", first)
+	}
+	if _, err := os.Stat(first.SourceImagePath); err != nil {
+		t.Errorf("imported first round's source: %v", err)
+	}
+	saved, err := imported.Tile(tile.Location{X: 2, Y: 2})
+	if err != nil || len(saved.Versions) != 1 {
+		t.Errorf("imported tile of the current round: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(imported.Path(), "rounds", "1", "tiles", "1,1", "tile")); err != nil {
+		t.Errorf("imported tiles of the first round: %v", err)
+	}
+}
+
+// TestExportWithoutSessions checks that session records are only archived
+// when asked for
+func TestExportWithoutSessions(t *testing.T) {
+	inst := archivedInstance(t)
+
+	var archive bytes.Buffer
+	err := inst.Export(&archive, instance.ExportOptions{Format: "zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range contents.File {
+		if strings.HasPrefix(f.Name, "sessions/") {
+			t.Errorf("archive has %s", f.Name)
+		}
+	}
+
+	imported, err := instance.Import(&archive, instance.ImportOptions{ID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range instanceFiles(t, imported) {
+		if strings.HasPrefix(f, "sessions/") {
+			t.Errorf("import has %s", f)
+		}
+	}
+}
+
+// TestImportDamaged checks that an archive whose files don't match its
+// manifest is rejected without leaving an instance behind
+func TestImportDamaged(t *testing.T) {
+	inst := archivedInstance(t)
+
+	var archive bytes.Buffer
+	err := inst.Export(&archive, instance.ExportOptions{Format: "zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rewrite the archive with the composite changed
+	var damaged bytes.Buffer
+	w := zip.NewWriter(&damaged)
+	for _, f := range contents.File {
+		entry, err := w.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "stitch.jpg" {
+			entry.Write([]byte("not the composite"))
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(entry, r)
+		r.Close()
+	}
+	w.Close()
+
+	id := uuid.New()
+	_, err = instance.Import(&damaged, instance.ImportOptions{ID: id})
+	if err == nil || !strings.Contains(err.Error(), "stitch.jpg") {
+		t.Errorf("import of a damaged archive returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(instance.InstancesPath(), id.String())); !os.IsNotExist(err) {
+		t.Errorf("damaged import left the instance folder behind: %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package instance
+
+import (
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// compositeBandRows is the most rows of the composite rendered at a time.
+// Bands start on multiples of 16 rows, the height of the blocks the JPEG
+// encoder works through, so that it never goes back to a band before.
+const compositeBandRows = 512
+
+// compositeStream is the composite of an instance rendered a band of rows at
+// a time as they are read, top to bottom, so that the whole of it is never in
+// memory. The source pieces and tiles under the band are kept until the band
+// has passed them.
+type compositeStream struct {
+	i       *Instance
+	regions tile.Layout
+	// cuts are the pieces of the source under the composite
+	cuts   []image.Rectangle
+	bounds image.Rectangle
+	// bands are where each band starts, followed by the bottom of the
+	// composite
+	bands []int
+	// margin is how many rows above and below a band are rendered with it,
+	// so that seams across its top and bottom are treated as they would be
+	// over the whole composite
+	margin int
+
+	band *image.RGBA
+	// top and bottom are the rows of the composite read from band
+	top, bottom int
+	pieces      map[image.Rectangle]image.Image
+	layers      map[tile.Location][]image.Image
+	// bare streams the source alone, without tiles or seams
+	bare bool
+	err  error
+}
+
+// newCompositeStream prepares to render the composite of i
+func (i *Instance) newCompositeStream() *compositeStream {
+	c := &compositeStream{
+		i:       i,
+		regions: i.Regions(),
+		cuts:    i.sourcePieces(),
+		bounds:  image.Rect(0, 0, i.SourceImageWidth, i.SourceImageHeight),
+		pieces:  make(map[image.Rectangle]image.Image),
+		layers:  make(map[tile.Location][]image.Image),
+	}
+	if i.Seam != nil {
+		c.margin = i.Seam.Width
+	}
+
+	// bands break where tiles do, to render as few tiles twice as possible
+	starts := map[int]bool{c.bounds.Min.Y: true}
+	for _, region := range c.regions {
+		starts[region.Bounds.Min.Y/16*16] = true
+	}
+	for y := range starts {
+		if y >= c.bounds.Min.Y && y < c.bounds.Max.Y {
+			c.bands = append(c.bands, y)
+		}
+	}
+	sort.Ints(c.bands)
+	c.bands = append(c.bands, c.bounds.Max.Y)
+	for n := 1; n < len(c.bands); n++ {
+		if c.bands[n]-c.bands[n-1] > compositeBandRows {
+			c.bands = append(c.bands[:n], append([]int{c.bands[n-1] + compositeBandRows}, c.bands[n:]...)...)
+		}
+	}
+	return c
+}
+
+// newSourceStream prepares to render the source of i on its own, as it is
+// before any tiles are drawn
+func (i *Instance) newSourceStream() *compositeStream {
+	c := i.newCompositeStream()
+	c.bare = true
+	c.margin = 0
+	return c
+}
+
+func (c *compositeStream) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (c *compositeStream) Bounds() image.Rectangle {
+	return c.bounds
+}
+
+func (c *compositeStream) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(c.bounds)) {
+		return color.RGBA{}
+	}
+	if c.band == nil || y < c.top || y >= c.bottom {
+		c.render(y)
+	}
+	return c.band.RGBAAt(x, y)
+}
+
+// render renders the band holding row y, dropping the pieces and tiles
+// which are entirely above it
+func (c *compositeStream) render(y int) {
+	n := sort.Search(len(c.bands)-1, func(n int) bool { return c.bands[n+1] > y })
+	c.top, c.bottom = c.bands[n], c.bands[n+1]
+
+	area := image.Rect(c.bounds.Min.X, c.top-c.margin, c.bounds.Max.X, c.bottom+c.margin).Intersect(c.bounds)
+	for bounds := range c.pieces {
+		if bounds.Max.Y <= area.Min.Y {
+			delete(c.pieces, bounds)
+		}
+	}
+	for _, region := range c.regions {
+		if region.Bounds.Max.Y <= area.Min.Y {
+			delete(c.layers, region.Location)
+		}
+	}
+
+	if c.band == nil || c.band.Rect != area {
+		c.band = image.NewRGBA(area)
+	}
+	for _, bounds := range c.cuts {
+		if !bounds.Overlaps(area) {
+			continue
+		}
+		piece, ok := c.pieces[bounds]
+		if !ok {
+			var err error
+			piece, err = c.i.streamSourceCrop(bounds)
+			if err != nil {
+				c.fail(err)
+				continue
+			}
+			c.pieces[bounds] = piece
+		}
+		draw.Draw(c.band, bounds, piece, bounds.Min, draw.Src)
+	}
+	if c.bare {
+		return
+	}
+
+	for _, region := range c.regions {
+		if !region.Bounds.Overlaps(area) {
+			continue
+		}
+		layers, ok := c.layers[region.Location]
+		if !ok {
+			layers = c.readLayers(region.Location)
+			c.layers[region.Location] = layers
+		}
+		bounds := c.i.TileBounds(region.Location)
+		for _, img := range layers {
+			draw.Draw(c.band, bounds, img, img.Bounds().Min, draw.Over)
+		}
+	}
+	c.i.treatSeams(c.band)
+}
+
+// readLayers decodes the versions of the tile at location which are drawn
+// in the composite, in the order they are drawn, like drawTile
+func (c *compositeStream) readLayers(location tile.Location) []image.Image {
+	t, err := c.i.Tile(location)
+	if err != nil {
+		log.Warn(errors.Wrap(err, "failed to load contribution"))
+		return nil
+	}
+	layers := []image.Image{}
+	for _, version := range t.Layers() {
+		img, err := c.i.readTileVersion(location, version)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		layers = append(layers, img)
+	}
+	return layers
+}
+
+// fail keeps the first error rendering the composite, see Err
+func (c *compositeStream) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Err returns the first error met rendering the composite, the parts of it
+// which couldn't be rendered are left transparent
+func (c *compositeStream) Err() error {
+	return c.err
+}
@@ -0,0 +1,159 @@
+package instance
+
+import (
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"os"
+	"path"
+	"strings"
+)
+
+// CreditModes are the ways credits can be rendered into a composite:
+//
+//	overlay: each tile is labelled with whoever drew its latest version
+//	legend: a list of every contributor by tile is added below the composite
+var CreditModes = []string{"overlay", "legend"}
+
+// ContributorCredit is a contributor to a tile and the versions they drew
+type ContributorCredit struct {
+	tile.Contributor
+	Versions []int `json:"versions"`
+}
+
+// TileCredit lists the contributors to a tile, in the order they first drew
+// it
+type TileCredit struct {
+	Name         string              `json:"name"`
+	Location     tile.Location       `json:"location"`
+	Contributors []ContributorCredit `json:"contributors"`
+}
+
+// Credits lists the credited contributors to each tile, in layout order.
+// Tiles with no credited versions are left out.
+func (i *Instance) Credits() ([]TileCredit, error) {
+	credits := []TileCredit{}
+	for _, region := range i.Regions() {
+		t, err := i.Tile(region.Location)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load tile")
+		}
+		credit := TileCredit{Name: region.Name, Location: t.Location}
+		for _, version := range t.Versions {
+			if version.Contributor == nil {
+				continue
+			}
+			found := false
+			for n := range credit.Contributors {
+				if credit.Contributors[n].Contributor == *version.Contributor {
+					credit.Contributors[n].Versions = append(credit.Contributors[n].Versions, version.Number)
+					found = true
+					break
+				}
+			}
+			if !found {
+				credit.Contributors = append(credit.Contributors, ContributorCredit{
+					Contributor: *version.Contributor,
+					Versions:    []int{version.Number},
+				})
+			}
+		}
+		if len(credit.Contributors) > 0 {
+			credits = append(credits, credit)
+		}
+	}
+	return credits, nil
+}
+
+// RenderCredits draws the composite with credits rendered in one of
+// CreditModes
+func (i *Instance) RenderCredits(mode string) (image.Image, error) {
+	file, err := os.Open(path.Join(i.Path(), "stitch.jpg"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open composite")
+	}
+	defer file.Close()
+	composite, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode composite")
+	}
+
+	credits, err := i.Credits()
+	if err != nil {
+		return nil, err
+	}
+
+	// the font is tiny so it is drawn at a scale which suits the composite
+	bounds := composite.Bounds()
+	scale := bounds.Dx() / 1000
+	if scale < 1 {
+		scale = 1
+	}
+	lineHeight := basicfont.Face7x13.Height * scale
+	shade := image.NewUniform(color.NRGBA{A: 160})
+
+	switch mode {
+	case "overlay":
+		canvas := image.NewRGBA(bounds)
+		draw.Draw(canvas, bounds, composite, bounds.Min, draw.Src)
+		for _, credit := range credits {
+			latest := credit.Contributors[0]
+			for _, c := range credit.Contributors[1:] {
+				if c.Versions[len(c.Versions)-1] > latest.Versions[len(latest.Versions)-1] {
+					latest = c
+				}
+			}
+			tileBounds := i.TileBounds(credit.Location).Add(bounds.Min)
+			label := image.Rect(tileBounds.Min.X, tileBounds.Max.Y-lineHeight-2*scale, tileBounds.Max.X, tileBounds.Max.Y)
+			draw.Draw(canvas, label, shade, image.Point{}, draw.Over)
+			drawText(canvas, label.Inset(scale), latest.String(), scale, image.White)
+		}
+		return canvas, nil
+
+	case "legend":
+		lines := []string{"Contributors"}
+		for _, credit := range credits {
+			names := make([]string, len(credit.Contributors))
+			for n, c := range credit.Contributors {
+				names[n] = c.String()
+			}
+			lines = append(lines, credit.Name+": "+strings.Join(names, ", "))
+		}
+		if len(credits) == 0 {
+			lines = append(lines, "none credited")
+		}
+
+		legendHeight := (len(lines) + 1) * lineHeight
+		canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()+legendHeight))
+		draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(canvas, image.Rect(0, 0, bounds.Dx(), bounds.Dy()), composite, bounds.Min, draw.Src)
+		for n, line := range lines {
+			top := bounds.Dy() + lineHeight/2 + n*lineHeight
+			drawText(canvas, image.Rect(lineHeight/2, top, bounds.Dx()-lineHeight/2, top+lineHeight), line, scale, image.Black)
+		}
+		return canvas, nil
+	}
+	return nil, errors.Errorf("Unknown credits mode %s", mode)
+}
+
+// drawText writes text within r at a whole number scale of the basic
+// font, cutting it off at the right edge
+func drawText(dst draw.Image, r image.Rectangle, text string, scale int, src image.Image) {
+	face := basicfont.Face7x13
+	small := image.NewRGBA(image.Rect(0, 0, (r.Dx()+scale-1)/scale, face.Height))
+	drawer := font.Drawer{
+		Dst:  small,
+		Src:  src,
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	drawer.DrawString(text)
+
+	target := image.Rect(r.Min.X, r.Min.Y, r.Min.X+small.Bounds().Dx()*scale, r.Min.Y+face.Height*scale).Intersect(r)
+	draw.NearestNeighbor.Scale(dst, target, small, image.Rect(0, 0, target.Dx()/scale, target.Dy()/scale), draw.Over, nil)
+}
@@ -0,0 +1,139 @@
+package instance_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// submitAs saves a drawing to a tile credited to contributor
+func submitAs(t *testing.T, inst *instance.Instance, location tile.Location, c color.Color, contributor *tile.Contributor) {
+	t.Helper()
+	bounds := inst.TileBounds(location)
+	s, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, bounds.Dx(), bounds.Dy(), c)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Contributor = contributor
+	err = inst.UpdateTile(location, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCredits(t *testing.T) {
+	useTempData(t)
+	inst := newTestInstance(t, 60, 60, 3, 3)
+	ada := &tile.Contributor{Name: "Ada", Handle: "@ada"}
+	grace := &tile.Contributor{Name: "Grace"}
+	shared := tile.Location{X: 1, Y: 0}
+	submitAs(t, inst, shared, color.Black, ada)
+	submitAs(t, inst, shared, color.White, nil)
+	submitAs(t, inst, shared, color.Black, grace)
+	submitAs(t, inst, shared, color.White, ada)
+	submitAs(t, inst, tile.Location{X: 0, Y: 2}, color.Black, grace)
+	submitAs(t, inst, tile.Location{X: 2, Y: 2}, color.Black, nil)
+
+	credits, err := inst.Credits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []instance.TileCredit{
+		{Location: shared, Contributors: []instance.ContributorCredit{
+			{Contributor: *ada, Versions: []int{1, 4}},
+			{Contributor: *grace, Versions: []int{3}},
+		}},
+		{Location: tile.Location{X: 0, Y: 2}, Contributors: []instance.ContributorCredit{
+			{Contributor: *grace, Versions: []int{1}},
+		}},
+	}
+	if len(credits) != len(want) {
+		t.Fatalf("credited %d tiles, want %d: %v", len(credits), len(want), credits)
+	}
+	for n, credit := range credits {
+		if credit.Location != want[n].Location || len(credit.Contributors) != len(want[n].Contributors) {
+			t.Fatalf("tile %d credited %v, want %v", n, credit, want[n])
+		}
+		for c, contributor := range credit.Contributors {
+			expected := want[n].Contributors[c]
+			if contributor.Contributor != expected.Contributor || len(contributor.Versions) != len(expected.Versions) {
+				t.Fatalf("tile %v credited %v, want %v", credit.Location, contributor, expected)
+			}
+			for v := range contributor.Versions {
+				if contributor.Versions[v] != expected.Versions[v] {
+					t.Errorf("tile %v credited %v, want %v", credit.Location, contributor, expected)
+				}
+			}
+		}
+	}
+}
+
+// differs reports whether any pixel within r differs between a and b
+func differs(a, b image.Image, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if !sameColour(a.At(x, y), b.At(x, y), 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestRenderCredits(t *testing.T) {
+	useTempData(t)
+	inst := newTestInstance(t, 60, 60, 3, 3)
+	credited := tile.Location{X: 1, Y: 1}
+	uncredited := tile.Location{X: 0, Y: 0}
+	submitAs(t, inst, credited, color.White, &tile.Contributor{Name: "Ada"})
+	submitAs(t, inst, uncredited, color.White, nil)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := inst.GetStitchedImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overlay, err := inst.RenderCredits("overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overlay.Bounds() != composite.Bounds() {
+		t.Fatalf("overlay is %v", overlay.Bounds())
+	}
+	// only the credited tile is labelled
+	if !differs(overlay, composite, inst.TileBounds(credited)) {
+		t.Error("credited tile isn't labelled")
+	}
+	if differs(overlay, composite, inst.TileBounds(uncredited)) {
+		t.Error("uncredited tile is labelled")
+	}
+
+	legend, err := inst.RenderCredits("legend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legend.Bounds().Dx() != 60 || legend.Bounds().Dy() <= 60 {
+		t.Fatalf("legend is %v, want it below the 60x60 composite", legend.Bounds())
+	}
+	if differs(legend, composite, composite.Bounds()) {
+		t.Error("legend changed the composite")
+	}
+	if !differs(legend, image.White, image.Rect(0, 60, 60, legend.Bounds().Dy())) {
+		t.Error("legend is blank")
+	}
+
+	if _, err := inst.RenderCredits("banner"); err == nil {
+		t.Error("rendered credits in an unknown mode")
+	}
+}
@@ -0,0 +1,22 @@
+package instance
+
+import "time"
+
+// WaitForStitchers waits for the stitchers scheduled with a delay of up to
+// longest to finish, so that a test can change the package's settings
+// without them being read from under it. Stitchers waiting out longer
+// delays are left alone.
+func WaitForStitchers(longest time.Duration) {
+	for {
+		busy := false
+		stitchers.Lock()
+		for _, s := range stitchers.byID {
+			busy = busy || (s.running && s.delay <= longest)
+		}
+		stitchers.Unlock()
+		if !busy {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
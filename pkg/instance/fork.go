@@ -0,0 +1,189 @@
+package instance
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ForkPoint records where a forked instance branched from its parent
+type ForkPoint struct {
+	Parent uuid.UUID `json:"parent"`
+	// Round and CompositeVersion are those of the parent when it was forked
+	Round            int       `json:"round"`
+	CompositeVersion int       `json:"compositeVersion"`
+	Forked           time.Time `json:"forked"`
+}
+
+// ForkOptions describe an instance to be made by Fork
+type ForkOptions struct {
+	// Tiles are the tiles whose versions are carried over to the fork, every
+	// tile is if it is nil
+	Tiles   []tile.Location
+	Title   string
+	Creator string
+	// Share hard links the image files of the parent's source and tile
+	// versions into the fork rather than copying them. They are never
+	// changed once written so the instances can't disturb each other, and
+	// each keeps its files if the other removes them.
+	Share bool
+}
+
+// Fork creates an instance with the same source, layout and tiles as the
+// current round of i. The fork has a history of its own from then on,
+// sessions aren't carried over and nothing done to either instance changes
+// the other.
+func (i *Instance) Fork(options ForkOptions) (*Instance, error) {
+	for _, location := range options.Tiles {
+		if !i.HasTile(location) {
+			return nil, &GridError{i.outsideLayout(location)}
+		}
+	}
+	if options.Title == "" {
+		options.Title = i.Title
+	}
+
+	now := time.Now().UTC()
+	fork := &Instance{
+		ID:                uuid.New(),
+		SourceImagePath:   i.SourceImagePath,
+		SourceImageWidth:  i.SourceImageWidth,
+		SourceImageHeight: i.SourceImageHeight,
+		StepCountX:        i.StepCountX,
+		StepCountY:        i.StepCountY,
+		StepSizeX:         i.StepSizeX,
+		StepSizeY:         i.StepSizeY,
+		OffsetX:           i.OffsetX,
+		OffsetY:           i.OffsetY,
+		Layout:            i.Layout,
+		Seam:              i.Seam,
+		Title:             options.Title,
+		Creator:           options.Creator,
+		KeepTileVersions:  i.KeepTileVersions,
+		Mode:              i.Mode,
+		VotingPeriod:      i.VotingPeriod,
+		Round:             1,
+		State:             StateOpen,
+		Created:           now,
+		ForkedFrom: &ForkPoint{
+			Parent:           i.ID,
+			Round:            i.Round,
+			CompositeVersion: i.CompositeVersion,
+			Forked:           now,
+		},
+	}
+	fork.CompositeImageUrl = fmt.Sprintf("/v1/instance/%v/composite", fork.ID)
+	if fork.Mode == ModeCompetitive {
+		fork.startVotingRound(1)
+	}
+
+	err := fork.EnsurePath()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to ensure instance path")
+	}
+	// sources kept in the parent's folder, from an earlier round or an
+	// import, go with the fork so that it doesn't depend on the parent
+	if strings.HasPrefix(i.SourceImagePath, i.Path()+"/") {
+		fork.SourceImagePath = path.Join(fork.Path(), "source"+strings.ToLower(path.Ext(i.SourceImagePath)))
+		err = placeFile(i.SourceImagePath, fork.SourceImagePath, options.Share)
+		if err != nil {
+			fork.Delete()
+			return nil, errors.Wrap(err, "Failed to carry source image over to fork")
+		}
+	}
+
+	locations := options.Tiles
+	if locations == nil {
+		for _, region := range i.Regions() {
+			locations = append(locations, region.Location)
+		}
+	}
+	for _, location := range locations {
+		err = i.forkTile(fork, location, options.Share)
+		if err != nil {
+			fork.Delete()
+			return nil, err
+		}
+	}
+	fork.countTilesFilled()
+	err = fork.cutSource()
+	if err != nil {
+		fork.Delete()
+		return nil, errors.Wrap(err, "Failed to cut fork source image")
+	}
+
+	// nobody else knows of the fork yet so it needn't be locked
+	err = fork.stitch()
+	if err != nil {
+		fork.Delete()
+		return nil, errors.Wrap(err, "Couldn't stitch fork composite")
+	}
+	log.Infof("Forked instance %v from %v", fork.ID, i.ID)
+	return fork, nil
+}
+
+// forkTile carries the versions of the tile at location over to fork
+func (i *Instance) forkTile(fork *Instance, location tile.Location, share bool) error {
+	t, err := i.Tile(location)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't load tile")
+	}
+	if len(t.Versions) == 0 {
+		return nil
+	}
+
+	err = os.MkdirAll(fork.tilePath(location), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create path for tiles")
+	}
+	kept := make([]tile.Version, 0, len(t.Versions))
+	for _, version := range t.Versions {
+		from := path.Join(i.tilePath(location), version.Filename())
+		if _, err := os.Stat(from); os.IsNotExist(err) {
+			// pruned versions stay pruned
+			continue
+		}
+		err = placeFile(from, path.Join(fork.tilePath(location), version.Filename()), share)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to carry tile %v over to fork", location)
+		}
+		kept = append(kept, version)
+	}
+	t.Versions = kept
+	return fork.saveTile(t)
+}
+
+// placeFile puts a copy of the file at from at to, hard linking it if share
+// is set and the file system allows
+func placeFile(from string, to string, share bool) error {
+	if share {
+		err := os.Link(from, to)
+		if err == nil {
+			return nil
+		}
+		log.Warn(errors.Wrapf(err, "Couldn't link %s, copying it", from))
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,116 @@
+package instance_test
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// tileVersions returns how many versions the tile at location has
+func tileVersions(t *testing.T, inst *instance.Instance, location tile.Location) int {
+	t.Helper()
+	tl, err := inst.Tile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(tl.Versions)
+}
+
+func TestFork(t *testing.T) {
+	useTempData(t)
+	parent := newTestInstance(t, 60, 60, 3, 3)
+	drawn := tile.Location{X: 0, Y: 0}
+	other := tile.Location{X: 2, Y: 1}
+	submit(t, parent, drawn, encodePNG(t, 20, 20, color.Black))
+	submit(t, parent, drawn, encodePNG(t, 20, 20, color.White))
+	submit(t, parent, other, encodePNG(t, 20, 20, color.Black))
+
+	if _, err := parent.Fork(instance.ForkOptions{Tiles: []tile.Location{{X: 3, Y: 0}}}); err == nil {
+		t.Error("forked a tile outside the grid")
+	} else if _, ok := err.(*instance.GridError); !ok {
+		t.Errorf("forking a tile outside the grid returned %v", err)
+	}
+
+	for _, share := range []bool{true, false} {
+		fork, err := parent.Fork(instance.ForkOptions{Title: "fork", Share: share})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fork.ForkedFrom == nil || fork.ForkedFrom.Parent != parent.ID || fork.ForkedFrom.CompositeVersion != parent.CompositeVersion {
+			t.Errorf("fork records %+v", fork.ForkedFrom)
+		}
+		if fork.TilesFilled != 2 || tileVersions(t, fork, drawn) != 2 || tileVersions(t, fork, other) != 1 {
+			t.Errorf("sharing %t, fork has %d tiles filled", share, fork.TilesFilled)
+		}
+
+		// drawing on the fork leaves the parent as it was
+		submit(t, fork, drawn, encodePNG(t, 20, 20, color.Black))
+		if tileVersions(t, parent, drawn) != 2 {
+			t.Error("drawing on the fork added a version to the parent")
+		}
+		first := filepath.Join(parent.Path(), "tiles", drawn.String(), "1.png")
+		forked := filepath.Join(fork.Path(), "tiles", drawn.String(), "1.png")
+		a, err := os.Stat(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(forked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(a, b) != share {
+			t.Errorf("sharing %t, fork's version is the parent's file: %t", share, os.SameFile(a, b))
+		}
+	}
+
+	some, err := parent.Fork(instance.ForkOptions{Tiles: []tile.Location{other}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if some.TilesFilled != 1 || tileVersions(t, some, drawn) != 0 {
+		t.Errorf("fork of one tile has %d tiles filled", some.TilesFilled)
+	}
+
+	// the fork keeps its files when the parent is deleted
+	err = parent.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := instance.Open(some.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = reopened.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForkLaterRound(t *testing.T) {
+	useTempData(t)
+	parent := completeTestInstance(t)
+	err := parent.StartRound(instance.RoundOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fork, err := parent.Fork(instance.ForkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parent's earlier composite is the fork's source, so it goes with it
+	if filepath.Dir(fork.SourceImagePath) != filepath.Clean(fork.Path()) || fork.Round != 1 || fork.ForkedFrom.Round != 2 {
+		t.Errorf("fork of round 2 is drawn over %s in round %d", fork.SourceImagePath, fork.Round)
+	}
+	err = parent.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fork.SourceImagePath); err != nil {
+		t.Errorf("fork lost its source with the parent: %v", err)
+	}
+}
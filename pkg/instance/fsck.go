@@ -0,0 +1,450 @@
+package instance
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/atomicfile"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Problem is something wrong with the files saved for an instance, found by
+// Check
+type Problem struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// Repair describes what was done about the problem, it is empty if
+	// nothing was
+	Repair string `json:"repair,omitempty"`
+}
+
+// CheckOptions control what Check looks at and whether it repairs what it
+// finds
+type CheckOptions struct {
+	// Instances limits the check to these instances, every instance is
+	// checked if it is empty
+	Instances []uuid.UUID
+	// Repair moves bad files into QuarantinePath, salvages records with
+	// trailing data and regenerates stale composites
+	Repair bool
+}
+
+// modTimeSlack allows for filesystems which keep modification times more
+// coarsely than the clock tile versions are stamped with, so that a composite
+// written just after a version isn't taken to be older than it
+const modTimeSlack = time.Second
+
+// QuarantinePath is the folder files removed by a repair are moved to, under
+// a folder for each run which mirrors the layout of DataPath
+func QuarantinePath() string {
+	return path.Join(DataPath, "quarantine")
+}
+
+// Check scans the data folder for instances whose files are damaged or
+// inconsistent with each other
+func Check(options CheckOptions) ([]Problem, error) {
+	c := &checker{
+		repair:     options.Repair,
+		quarantine: path.Join(QuarantinePath(), time.Now().UTC().Format("20060102T150405Z")),
+		problems:   make([]Problem, 0),
+	}
+
+	if len(options.Instances) > 0 {
+		for _, id := range options.Instances {
+			if _, err := os.Stat((&Instance{ID: id}).Path()); err != nil {
+				return nil, errors.Wrapf(ErrNotFound, "Instance %v", id)
+			}
+			c.checkInstance(id)
+		}
+		return c.problems, nil
+	}
+
+	entries, err := ioutil.ReadDir(InstancesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c.problems, nil
+		}
+		return nil, errors.Wrap(err, "Failed to list instances")
+	}
+	for _, entry := range entries {
+		entryPath := path.Join(InstancesPath(), entry.Name())
+		if strings.HasPrefix(entry.Name(), ".import-") {
+			c.report(entryPath, "left behind by an interrupted import")
+			c.moveToQuarantine(entryPath)
+			continue
+		}
+		id, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			c.report(entryPath, "is not an instance")
+			continue
+		}
+		c.checkInstance(id)
+	}
+	return c.problems, nil
+}
+
+type checker struct {
+	repair     bool
+	quarantine string
+	problems   []Problem
+}
+
+func (c *checker) report(p string, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Path:   p,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// repaired records what was done about the last problem reported
+func (c *checker) repaired(format string, args ...interface{}) {
+	c.problems[len(c.problems)-1].Repair = fmt.Sprintf(format, args...)
+}
+
+// moveToQuarantine moves the file or folder at p out of the way when
+// repairing, reporting whether it was
+func (c *checker) moveToQuarantine(p string) bool {
+	if !c.repair {
+		return false
+	}
+
+	rel, err := filepath.Rel(DataPath, p)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to quarantine %s", p))
+		return false
+	}
+	dest := path.Join(c.quarantine, filepath.ToSlash(rel))
+	err = os.MkdirAll(path.Dir(dest), 0755)
+	if err == nil {
+		err = os.Rename(p, dest)
+	}
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to quarantine %s", p))
+		return false
+	}
+	c.repaired("moved to %s", dest)
+	return true
+}
+
+// salvage rewrites a record file which has trailing data after a valid JSON
+// value, keeping a copy of the original in quarantine
+func (c *checker) salvage(p string, data []byte, length int64) {
+	if !c.moveToQuarantine(p) {
+		return
+	}
+	err := atomicfile.WriteFile(p, data[:length], 0755)
+	if err != nil {
+		log.Error(errors.Wrapf(err, "Failed to rewrite %s", p))
+		return
+	}
+	c.problems[len(c.problems)-1].Repair += ", record rewritten"
+}
+
+// decodeRecord unmarshals the JSON record in data into v. A record which was
+// overwritten by a shorter one without being truncated has trailing data,
+// in that case length is the size of the record that could be read.
+func decodeRecord(data []byte, v interface{}) (length int64, err error) {
+	err = json.Unmarshal(data, v)
+	if err == nil {
+		return int64(len(data)), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if decoder.Decode(v) == nil {
+		return decoder.InputOffset(), nil
+	}
+	return 0, err
+}
+
+// imageSize reads the dimensions of the image file at p without decoding it
+func imageSize(p string) (image.Point, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(config.Width, config.Height), nil
+}
+
+func (c *checker) checkInstance(id uuid.UUID) {
+	if c.repair {
+		// the server isn't to change the instance while it's being repaired
+		defer (&Instance{ID: id}).lock()()
+	}
+	instancePath := (&Instance{ID: id}).Path()
+	recordPath := path.Join(instancePath, "instance")
+
+	data, err := ioutil.ReadFile(recordPath)
+	if err != nil {
+		c.report(instancePath, "has no instance record")
+		c.moveToQuarantine(instancePath)
+		return
+	}
+	i := &Instance{}
+	length, err := decodeRecord(data, i)
+	if err != nil {
+		c.report(recordPath, "can't be read: %v", err)
+		c.moveToQuarantine(instancePath)
+		return
+	}
+	if length < int64(len(data)) {
+		c.report(recordPath, "has %d bytes of trailing data", int64(len(data))-length)
+		c.salvage(recordPath, data, length)
+	}
+	if i.ID != id {
+		c.report(recordPath, "is the record for instance %v", i.ID)
+		i.ID = id
+		if c.repair {
+			if err := i.save(); err != nil {
+				log.Error(err)
+			} else {
+				c.repaired("ID corrected")
+			}
+		}
+	}
+	if i.Layout != nil {
+		if err := i.Layout.Check(i.SourceImageWidth, i.SourceImageHeight); err != nil {
+			c.report(recordPath, "has an invalid layout: %v", err)
+			return
+		}
+	} else if i.StepCountX < 1 || i.StepCountY < 1 || i.StepSizeX < 1 || i.StepSizeY < 1 {
+		c.report(recordPath, "has an invalid grid of %dx%d tiles of %dx%d", i.StepCountX, i.StepCountY, i.StepSizeX, i.StepSizeY)
+		return
+	}
+
+	sourceSize, err := imageSize(i.SourceImagePath)
+	sourceOK := err == nil
+	if err != nil {
+		c.report(recordPath, "source image %s can't be read: %v", i.SourceImagePath, err)
+	} else if sourceSize != image.Pt(i.SourceImageWidth, i.SourceImageHeight) {
+		c.report(recordPath, "source image %s is %dx%d, the instance was made from one of %dx%d",
+			i.SourceImagePath, sourceSize.X, sourceSize.Y, i.SourceImageWidth, i.SourceImageHeight)
+		sourceOK = false
+	}
+
+	tilesChanged, lastSaved := c.checkTiles(i)
+	c.checkSessions(i)
+
+	compositePath := path.Join(i.Path(), "stitch.jpg")
+	stale := false
+	if info, err := os.Stat(compositePath); err != nil {
+		c.report(compositePath, "is missing")
+		stale = true
+	} else if size, err := imageSize(compositePath); err != nil {
+		c.report(compositePath, "can't be decoded: %v", err)
+		stale = true
+	} else if size != image.Pt(i.SourceImageWidth, i.SourceImageHeight) {
+		c.report(compositePath, "is %dx%d, the source image is %dx%d", size.X, size.Y, i.SourceImageWidth, i.SourceImageHeight)
+		stale = true
+	} else if info.ModTime().Add(modTimeSlack).Before(lastSaved) {
+		c.report(compositePath, "is older than the latest tile version, saved %s", lastSaved.Format(time.RFC3339))
+		stale = true
+	}
+
+	if c.repair && sourceOK && (stale || tilesChanged) {
+		err := i.stitch()
+		if err != nil {
+			log.Error(errors.Wrapf(err, "Failed to regenerate composite for instance %v", i.ID))
+			return
+		}
+		if stale {
+			c.repaired("regenerated")
+		} else {
+			c.report(compositePath, "included tiles which were repaired")
+			c.repaired("regenerated")
+		}
+	}
+}
+
+// checkTiles checks every tile folder of the instance, returning whether any
+// were repaired and when the latest version was saved
+func (c *checker) checkTiles(i *Instance) (changed bool, lastSaved time.Time) {
+	entries, err := ioutil.ReadDir(i.tilesPath())
+	if err != nil {
+		return false, lastSaved
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(i.tilesPath(), entry.Name())
+		location, err := tile.ParseLocation(entry.Name())
+		if err != nil || !entry.IsDir() {
+			c.report(entryPath, "is not a tile")
+			changed = c.moveToQuarantine(entryPath) || changed
+			continue
+		}
+		if !i.HasTile(location) {
+			c.report(entryPath, "is outside %s", i.describeLayout())
+			changed = c.moveToQuarantine(entryPath) || changed
+			continue
+		}
+
+		tileChanged, saved := c.checkTile(i, location)
+		changed = changed || tileChanged
+		if saved.After(lastSaved) {
+			lastSaved = saved
+		}
+	}
+	return changed, lastSaved
+}
+
+func (c *checker) checkTile(i *Instance, location tile.Location) (changed bool, lastSaved time.Time) {
+	tilePath := i.tilePath(location)
+	recordPath := path.Join(tilePath, "tile")
+
+	t := &tile.Tile{Location: location}
+	data, err := ioutil.ReadFile(recordPath)
+	if err == nil {
+		length, err := decodeRecord(data, t)
+		if err != nil {
+			c.report(recordPath, "can't be read: %v", err)
+			return c.moveToQuarantine(tilePath), lastSaved
+		}
+		if length < int64(len(data)) {
+			c.report(recordPath, "has %d bytes of trailing data", int64(len(data))-length)
+			c.salvage(recordPath, data, length)
+		}
+	} else if !os.IsNotExist(err) {
+		c.report(recordPath, "can't be read: %v", err)
+		return false, lastSaved
+	}
+
+	// problems which are repaired by rewriting the record
+	dirty := make([]int, 0)
+	if t.Location != location {
+		c.report(recordPath, "is the record for tile %v", t.Location)
+		t.Location = location
+		dirty = append(dirty, len(c.problems)-1)
+	}
+
+	bounds := i.TileBounds(location)
+	// candidates of competitive instances are kept alongside the versions
+	known := map[string]bool{"tile": true, "candidates": true}
+	kept := make([]tile.Version, 0, len(t.Versions))
+	for _, version := range t.Versions {
+		known[version.Filename()] = true
+		versionPath := path.Join(tilePath, version.Filename())
+		size, err := imageSize(versionPath)
+		switch {
+		case os.IsNotExist(err):
+			c.report(versionPath, "is missing")
+		case err != nil:
+			c.report(versionPath, "can't be decoded: %v", err)
+			c.moveToQuarantine(versionPath)
+		case size != bounds.Size():
+			c.report(versionPath, "is %dx%d, the tile is %dx%d", size.X, size.Y, bounds.Dx(), bounds.Dy())
+			c.moveToQuarantine(versionPath)
+		default:
+			kept = append(kept, version)
+			if version.Created.After(lastSaved) {
+				lastSaved = version.Created
+			}
+			continue
+		}
+		dirty = append(dirty, len(c.problems)-1)
+	}
+
+	files, _ := ioutil.ReadDir(tilePath)
+	for _, f := range files {
+		if !known[f.Name()] {
+			filePath := path.Join(tilePath, f.Name())
+			c.report(filePath, "is not a version of the tile")
+			c.moveToQuarantine(filePath)
+		}
+	}
+
+	if len(dirty) == 0 || !c.repair {
+		return false, lastSaved
+	}
+	t.Versions = kept
+	err = i.saveTile(t)
+	if err != nil {
+		log.Error(err)
+		return false, lastSaved
+	}
+	for _, n := range dirty {
+		if c.problems[n].Repair != "" {
+			c.problems[n].Repair += ", "
+		}
+		c.problems[n].Repair += "tile record corrected"
+	}
+	return true, lastSaved
+}
+
+// sessionRecord is the part of a saved session which can be checked here,
+// the rest of it belongs to the session package
+type sessionRecord struct {
+	ID         uuid.UUID     `json:"id"`
+	InstanceID uuid.UUID     `json:"instanceID"`
+	Location   tile.Location `json:"location"`
+	Round      int           `json:"round"`
+}
+
+// currentRound reports whether the session is from the instance's current
+// round, records saved before there were rounds are from the first
+func (r *sessionRecord) currentRound(i *Instance) bool {
+	round, current := r.Round, i.Round
+	if round == 0 {
+		round = 1
+	}
+	if current == 0 {
+		current = 1
+	}
+	return round == current
+}
+
+func (c *checker) checkSessions(i *Instance) {
+	sessionsPath := path.Join(i.Path(), "sessions")
+	entries, err := ioutil.ReadDir(sessionsPath)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		sessionPath := path.Join(sessionsPath, entry.Name())
+		id, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			c.report(sessionPath, "is not a session")
+			c.moveToQuarantine(sessionPath)
+			continue
+		}
+
+		recordPath := path.Join(sessionPath, "session")
+		data, err := ioutil.ReadFile(recordPath)
+		if err != nil {
+			c.report(sessionPath, "is an orphaned session with no record")
+			c.moveToQuarantine(sessionPath)
+			continue
+		}
+		record := &sessionRecord{}
+		length, err := decodeRecord(data, record)
+		switch {
+		case err != nil:
+			c.report(recordPath, "can't be read: %v", err)
+			c.moveToQuarantine(sessionPath)
+		case record.ID != id || record.InstanceID != i.ID:
+			c.report(recordPath, "is the record for session %v of instance %v", record.ID, record.InstanceID)
+			c.moveToQuarantine(sessionPath)
+		case record.currentRound(i) && !i.HasTile(record.Location):
+			c.report(recordPath, "is for tile %v, outside %s", record.Location, i.describeLayout())
+			c.moveToQuarantine(sessionPath)
+		case length < int64(len(data)):
+			c.report(recordPath, "has %d bytes of trailing data", int64(len(data))-length)
+			c.salvage(recordPath, data, length)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package instance_test
+
+import (
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+)
+
+// check runs fsck over an instance, reporting paths within it
+func check(t *testing.T, inst *instance.Instance, repair bool) []instance.Problem {
+	t.Helper()
+	problems, err := instance.Check(instance.CheckOptions{Instances: []uuid.UUID{inst.ID}, Repair: repair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range problems {
+		problems[n].Path = strings.TrimPrefix(problems[n].Path, inst.Path()+"/")
+	}
+	return problems
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage breaks the instance, returning the path of the problem
+		// within the instance folder
+		damage func(t *testing.T, inst *instance.Instance) string
+		reason string
+	}{
+		{"missing version", func(t *testing.T, inst *instance.Instance) string {
+			remove(t, inst.Path(), "tiles/0,0/2.png")
+			return "tiles/0,0/2.png"
+		}, "is missing"},
+		{"undecodable version", func(t *testing.T, inst *instance.Instance) string {
+			write(t, inst.Path(), "tiles/0,0/1.png", "not a png")
+			return "tiles/0,0/1.png"
+		}, "can't be decoded"},
+		{"version of the wrong size", func(t *testing.T, inst *instance.Instance) string {
+			write(t, inst.Path(), "tiles/0,0/1.png", string(encodePNG(t, 12, 10, color.Black)))
+			return "tiles/0,0/1.png"
+		}, "the tile is 10x10"},
+		{"stray file", func(t *testing.T, inst *instance.Instance) string {
+			write(t, inst.Path(), "tiles/0,0/notes.txt", "hello")
+			return "tiles/0,0/notes.txt"
+		}, "is not a version"},
+		{"tile outside the grid", func(t *testing.T, inst *instance.Instance) string {
+			write(t, inst.Path(), "tiles/9,9/tile", "{}")
+			return "tiles/9,9"
+		}, "outside the 6x6 grid"},
+		{"tile record with trailing data", func(t *testing.T, inst *instance.Instance) string {
+			appendTo(t, inst.Path(), "tiles/0,0/tile", "ersions\": []}")
+			return "tiles/0,0/tile"
+		}, "trailing data"},
+		{"orphaned session", func(t *testing.T, inst *instance.Instance) string {
+			s, err := session.NewSession(inst, 1, 1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join("sessions", s.ID.String())
+			remove(t, inst.Path(), filepath.Join(p, "session"))
+			return p
+		}, "orphaned session"},
+		{"missing composite", func(t *testing.T, inst *instance.Instance) string {
+			remove(t, inst.Path(), "stitch.jpg")
+			return "stitch.jpg"
+		}, "is missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inst := newTestInstance(t, 60, 60, 6, 6)
+			submit(t, inst, tile.Location{X: 0, Y: 0}, encodePNG(t, 10, 10, color.Black))
+			submit(t, inst, tile.Location{X: 0, Y: 0}, encodePNG(t, 10, 10, color.White))
+			if problems := check(t, inst, false); len(problems) != 0 {
+				t.Fatalf("healthy instance has problems %v", problems)
+			}
+
+			p := test.damage(t, inst)
+			found := false
+			for _, problem := range check(t, inst, false) {
+				found = found || (problem.Path == p && strings.Contains(problem.Reason, test.reason))
+				if problem.Repair != "" {
+					t.Errorf("%s was repaired without asking: %s", problem.Path, problem.Repair)
+				}
+			}
+			if !found {
+				t.Fatalf("problem with %s %q not found in %v", p, test.reason, check(t, inst, false))
+			}
+
+			for _, problem := range check(t, inst, true) {
+				if problem.Path == p && problem.Repair == "" {
+					t.Errorf("%s %s was not repaired", problem.Path, problem.Reason)
+				}
+			}
+			if problems := check(t, inst, false); len(problems) != 0 {
+				t.Errorf("repaired instance still has problems %v", problems)
+			}
+			if _, err := instance.Open(inst.ID.String()); err != nil {
+				t.Errorf("repaired instance can't be opened: %v", err)
+			}
+		})
+	}
+}
+
+// TestCheckDataFolder checks that what doesn't belong in the instances
+// folder is found when every instance is checked
+func TestCheckDataFolder(t *testing.T) {
+	useTempData(t)
+	write(t, instance.InstancesPath(), ".import-123/manifest.json", "{}")
+	write(t, instance.InstancesPath(), "notes.txt", "hello")
+
+	problems, err := instance.Check(instance.CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("found %v", problems)
+	}
+	for _, problem := range problems {
+		switch filepath.Base(problem.Path) {
+		case ".import-123":
+			if !strings.Contains(problem.Reason, "interrupted import") || problem.Repair == "" {
+				t.Errorf("import left behind is %+v", problem)
+			}
+		case "notes.txt":
+			if !strings.Contains(problem.Reason, "not an instance") || problem.Repair != "" {
+				t.Errorf("stray file is %+v", problem)
+			}
+		default:
+			t.Errorf("unexpected problem %+v", problem)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(instance.InstancesPath(), ".import-123")); !os.IsNotExist(err) {
+		t.Errorf("import left behind is still there: %v", err)
+	}
+
+	_, err = instance.Check(instance.CheckOptions{Instances: []uuid.UUID{uuid.New()}})
+	if err == nil {
+		t.Error("checking an unknown instance succeeded")
+	}
+}
+
+func write(t *testing.T, dir, name, data string) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(p, []byte(data), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendTo(t *testing.T, dir, name, data string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func remove(t *testing.T, dir, name string) {
+	t.Helper()
+	err := os.Remove(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,15 +3,19 @@ package instance
 import (
 	"fmt"
 	"encoding/json"
+	"github.com/andrewmyhre/donk-server/pkg/atomicfile"
 	"github.com/andrewmyhre/donk-server/pkg/tile"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"image"
 	"image/jpeg"
+	_ "image/png"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"time"
 )
 
 type Instance struct {
@@ -24,26 +28,211 @@ type Instance struct {
 	StepCountY int `json:"stepCountY"`
 	StepSizeX int `json:"stepSizeX"`
 	StepSizeY int `json:"stepSizeY"`
+	CompositeVersion int `json:"compositeVersion"`
+	// PendingCompositeVersion is the composite version which will show the
+	// tiles saved since the composite was last rendered, zero if there are
+	// none
+	PendingCompositeVersion int `json:"pendingCompositeVersion,omitempty"`
+	Title string `json:"title"`
+	Creator string `json:"creator"`
+	State string `json:"state"`
+	// TilesFilled is the number of tiles which have at least one version
+	TilesFilled int `json:"tilesFilled"`
+	Created time.Time `json:"created"`
+	// Updated is when a tile was last saved, the zero time if none has been
+	Updated time.Time `json:"updated"`
+	// Archived is when the instance was archived, the zero time if it isn't
+	Archived time.Time `json:"archived,omitempty"`
+	// KeepTileVersions is how many versions of each tile are kept when old
+	// ones are pruned, all of them are kept if it is zero
+	KeepTileVersions int `json:"keepTileVersions,omitempty"`
+	// Mode is how saved tiles are taken up, one of Modes
+	Mode string `json:"mode,omitempty"`
+	// VotingRound is the number of the current voting round of a competitive
+	// instance, starting from 1
+	VotingRound int `json:"votingRound,omitempty"`
+	// VotingPeriod is how long each voting round lasts before it is closed
+	// by the janitor, rounds are only closed by an admin if it is zero
+	VotingPeriod time.Duration `json:"votingPeriod,omitempty"`
+	// VotingCloses is when the current voting round is due to close
+	VotingCloses time.Time `json:"votingCloses,omitempty"`
+	// Round is the number of the current round, starting from 1. Each round
+	// after the first is drawn over the composite of the one before.
+	Round int `json:"round"`
+	// RoundStarted is when the current round started, the zero time for
+	// the first
+	RoundStarted time.Time `json:"roundStarted,omitempty"`
+	// OffsetX and OffsetY move the grid of the current round away from the
+	// top left corner of the source image
+	OffsetX int `json:"offsetX,omitempty"`
+	OffsetY int `json:"offsetY,omitempty"`
+	// Layout is where each tile of the current round is over the source
+	// image when they aren't in a uniform grid, the step counts and sizes
+	// are zero if it is set
+	Layout tile.Layout `json:"layout,omitempty"`
+	// Seam is how the edges where tiles meet are treated in the composite,
+	// they are left hard if it is nil
+	Seam *Seam `json:"seam,omitempty"`
+	// Rounds are the earlier rounds, in order
+	Rounds []Round `json:"rounds,omitempty"`
+	// ForkedFrom is where the instance was forked from, nil if it wasn't
+	ForkedFrom *ForkPoint `json:"forkedFrom,omitempty"`
+	// saved is set once the instance record has been saved or loaded, see
+	// refresh
+	saved bool
+}
+
+// States an instance can be in
+const (
+	// StateOpen instances have tiles which haven't been drawn yet
+	StateOpen = "open"
+	// StateComplete instances have had every tile drawn, they can still be
+	// drawn over
+	StateComplete = "complete"
+	// StateArchived instances are read-only and hidden from listings until
+	// they are restored
+	StateArchived = "archived"
+)
+
+// States are all the states an instance can be in
+var States = []string{StateOpen, StateComplete, StateArchived}
+
+// Modes an instance can be in
+const (
+	// ModeLatest instances take each save as the tile's next version
+	ModeLatest = "latest"
+	// ModeCompetitive instances take each save as a candidate for the tile,
+	// the candidate with the most votes becomes its next version when the
+	// voting round closes
+	ModeCompetitive = "competitive"
+)
+
+// Modes are the modes an instance can be in
+var Modes = []string{ModeLatest, ModeCompetitive}
+
+// Options describe an instance to be created by NewWithOptions
+type Options struct {
+	SourceImagePath string
+	// Cols and Rows are the number of tiles the source image is divided into,
+	// laid out in Pattern
+	Cols int
+	Rows int
+	// Pattern is one of Patterns, PatternGrid if it is empty
+	Pattern string
+	// Layout places each tile explicitly, Cols, Rows and Pattern are ignored
+	// if it is given
+	Layout tile.Layout
+	Title string
+	Creator string
+	KeepTileVersions int
+	// Mode is one of Modes, ModeLatest if it is empty
+	Mode string
+	VotingPeriod time.Duration
+	// Seam is made by NewSeam, nil leaves the edges between tiles hard
+	Seam *Seam
+}
+
+// DataPath is the folder instances are stored under
+var DataPath = "data"
+
+// DefaultStepCount is the number of columns and rows of tiles in an instance
+// made by New
+const DefaultStepCount = 6
+
+// ErrNotFound is returned when opening an instance which doesn't exist
+var ErrNotFound = errors.New("Instance not found")
+
+// ErrArchived is returned when changing an instance which has been archived
+var ErrArchived = errors.New("Instance is archived")
+
+// InstancesPath is the folder holding every instance
+func InstancesPath() string {
+	return path.Join(DataPath, "instances")
+}
+
+// Path is the folder holding the instance's data
+func (i *Instance) Path() string {
+	return path.Join(InstancesPath(), i.ID.String())
 }
 
 func New(sourceImagePath string) (*Instance, error) {
+	return NewWithOptions(Options{
+		SourceImagePath: sourceImagePath,
+		Cols: DefaultStepCount,
+		Rows: DefaultStepCount,
+	})
+}
+
+// NewWithOptions creates an instance whose source image is divided into
+// options.Cols by options.Rows tiles laid out in options.Pattern, or into the
+// tiles of options.Layout. Problems with the layout are returned as a
+// *GridError.
+func NewWithOptions(options Options) (*Instance, error) {
+	cols, rows := options.Cols, options.Rows
+	if options.Layout == nil && (cols < 1 || rows < 1) {
+		return nil, &GridError{fmt.Sprintf("grid must have at least one column and row, not %dx%d", cols, rows)}
+	}
+	if options.Pattern == "" {
+		options.Pattern = PatternGrid
+	}
+	if options.Pattern != PatternGrid && options.Pattern != PatternBrick {
+		return nil, &GridError{fmt.Sprintf("pattern must be one of %v, not %s", Patterns, options.Pattern)}
+	}
+	if options.Mode == "" {
+		options.Mode = ModeLatest
+	}
+	if options.Mode != ModeLatest && options.Mode != ModeCompetitive {
+		return nil, errors.Errorf("Mode must be one of %v, not %s", Modes, options.Mode)
+	}
+
 	instance := &Instance{
 		ID: uuid.New(),
-		SourceImagePath: sourceImagePath,
-		StepCountX: 6,
-		StepCountY: 6,
+		SourceImagePath: options.SourceImagePath,
+		Title: options.Title,
+		Creator: options.Creator,
+		KeepTileVersions: options.KeepTileVersions,
+		Mode: options.Mode,
+		Seam: options.Seam,
+		Round: 1,
+		State: StateOpen,
+		Created: time.Now().UTC(),
+	}
+	if instance.Mode == ModeCompetitive {
+		instance.VotingPeriod = options.VotingPeriod
+		instance.startVotingRound(1)
+	}
+
+	if options.Layout == nil && options.Pattern == PatternGrid {
+		instance.StepCountX = cols
+		instance.StepCountY = rows
 	}
 
 	err := instance.readSourceImageAttributes()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read source image attributes")
 	}
+	switch {
+	case options.Layout != nil:
+		instance.Layout, err = checkLayout(options.Layout, instance.SourceImageWidth, instance.SourceImageHeight)
+	case options.Pattern == PatternBrick:
+		instance.Layout, err = checkLayout(tile.BrickLayout(cols, rows, instance.SourceImageWidth, instance.SourceImageHeight),
+			instance.SourceImageWidth, instance.SourceImageHeight)
+	case instance.StepSizeX < 1 || instance.StepSizeY < 1:
+		err = &GridError{fmt.Sprintf("source image is too small for a %dx%d grid", cols, rows)}
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	instance.CompositeImageUrl=fmt.Sprintf("/v1/instance/%v/composite", instance.ID)
 	err = instance.EnsurePath()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to ensure instance path")
 	}
+	err = instance.cutSource()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to cut source image")
+	}
 	err = instance.save()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to save instance data")
@@ -53,10 +242,12 @@ func New(sourceImagePath string) (*Instance, error) {
 	return instance, nil
 }
 
+// Open loads a saved instance. ErrNotFound is returned if there isn't one
+// with instanceID.
 func Open(instanceID string) (*Instance, error) {
 	instanceUUID, err := uuid.Parse(instanceID)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(ErrNotFound, instanceID + " is not a valid instance ID")
 	}
 	i := &Instance{
 		ID: instanceUUID,
@@ -68,38 +259,122 @@ func Open(instanceID string) (*Instance, error) {
 	return i, err
 }
 
+// List loads every saved instance, ordered by ID
+func List() ([]*Instance, error) {
+	entries, err := ioutil.ReadDir(InstancesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Instance{}, nil
+		}
+		return nil, errors.Wrap(err, "Failed to list instances")
+	}
+
+	instances := make([]*Instance, 0, len(entries))
+	for _, entry := range entries {
+		// skips imports in progress as well as anything else
+		if _, err := uuid.Parse(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		i, err := Open(entry.Name())
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "Failed to open instance %s", entry.Name()))
+			continue
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+// Archive makes the instance read-only and hides it from listings
+func (i *Instance) Archive() error {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return err
+	}
+	if i.State == StateArchived {
+		return nil
+	}
+	i.State = StateArchived
+	i.Archived = time.Now().UTC()
+	err = i.save()
+	if err != nil {
+		return errors.Wrap(err, "Failed to save instance data")
+	}
+	log.Infof("Archived instance %v", i.ID)
+	return nil
+}
+
+// Restore undoes Archive
+func (i *Instance) Restore() error {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return err
+	}
+	if i.State != StateArchived {
+		return nil
+	}
+	i.Archived = time.Time{}
+	i.State = StateOpen
+	if i.TilesFilled >= i.TileCount() {
+		i.State = StateComplete
+	}
+	err = i.save()
+	if err != nil {
+		return errors.Wrap(err, "Failed to save instance data")
+	}
+	log.Infof("Restored instance %v", i.ID)
+	return nil
+}
+
+// Delete removes the instance and everything saved for it
+func (i *Instance) Delete() error {
+	defer i.lock()()
+	defer i.forgetStitcher()
+	defer i.forgetSource()
+	err := os.RemoveAll(i.Path())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete instance %v", i.ID)
+	}
+	log.Infof("Deleted instance %v", i.ID)
+	return nil
+}
+
+// readSourceImageAttributes sets the size of the source image, and of the
+// grid over it, from the header of the image without decoding all of it
 func (i *Instance) readSourceImageAttributes() error {
 	reader, err := os.Open(i.SourceImagePath)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to open %s for reading", i.SourceImagePath)
 	}
-	source, _, err := image.Decode(reader)
+	defer reader.Close()
+
+	config, _, err := image.DecodeConfig(reader)
 	if err != nil {
-		return errors.Wrap(err, "Failed to decode source image")
+		return errors.Wrap(err, "Failed to decode source image header")
 	}
 
-	log.Infof("Source image bounds: min: %d,%d max: %d,%d", source.Bounds().Min.X, source.Bounds().Min.Y, source.Bounds().Max.X, source.Bounds().Max.Y)
-	i.SourceImageWidth = source.Bounds().Max.X - source.Bounds().Min.X
-	i.SourceImageHeight = source.Bounds().Max.Y - source.Bounds().Min.Y
-	i.StepSizeX = i.SourceImageWidth / i.StepCountX
-	i.StepSizeY = i.SourceImageHeight / i.StepCountY
+	log.Infof("Source image size: %dx%d", config.Width, config.Height)
+	i.SourceImageWidth = config.Width
+	i.SourceImageHeight = config.Height
+	// instances with a layout have no grid to size
+	if i.StepCountX > 0 && i.StepCountY > 0 {
+		i.StepSizeX = (i.SourceImageWidth - i.OffsetX) / i.StepCountX
+		i.StepSizeY = (i.SourceImageHeight - i.OffsetY) / i.StepCountY
+	}
 	log.Infof("New instance: width=%d, height=%d, stepSizeX=%d, stepSizeY=%d", i.SourceImageWidth, i.SourceImageHeight, i.StepSizeX, i.StepSizeY)
 	return nil
 }
 
 func (i *Instance) save() error {
-	filePath := path.Join("data","instances",i.ID.String(),"instance")
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		return errors.Wrap(err, "Couldn't open instance data file for writing")
-	}
-	defer f.Close()
-
+	filePath := path.Join(i.Path(), "instance")
 	json, _ := json.MarshalIndent(i, "", " ")
-	_, err = f.Write(json)
+	err := atomicfile.WriteFile(filePath, json, 0755)
 	if err != nil {
 		return errors.Wrap(err, "Failed to write json to file")
 	}
+	i.saved = true
 
 	return nil
 }
@@ -107,14 +382,13 @@ func (i *Instance) save() error {
 func (i *Instance) load() error {
 	instance := &Instance{}
 
-	filePath := path.Join("data","instances",i.ID.String(),"instance")
-
-	if _, err := os.Stat(filePath); err != nil {
-		return nil
-	}
+	filePath := path.Join(i.Path(), "instance")
 
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
 		return errors.Wrap(err, "Failed to load instance file")
 	}
 
@@ -124,19 +398,59 @@ func (i *Instance) load() error {
 	}
 
 	i.SourceImagePath = instance.SourceImagePath
+	i.CompositeImageUrl = instance.CompositeImageUrl
 	i.SourceImageWidth = instance.SourceImageWidth
 	i.SourceImageHeight = instance.SourceImageHeight
 	i.StepCountX = instance.StepCountX
 	i.StepCountY = instance.StepCountY
 	i.StepSizeX = instance.StepSizeX
 	i.StepSizeY = instance.StepSizeY
+	i.CompositeVersion = instance.CompositeVersion
+	i.PendingCompositeVersion = instance.PendingCompositeVersion
+	i.Title = instance.Title
+	i.Creator = instance.Creator
+	i.State = instance.State
+	i.TilesFilled = instance.TilesFilled
+	i.Created = instance.Created
+	i.Updated = instance.Updated
+	i.Archived = instance.Archived
+	i.KeepTileVersions = instance.KeepTileVersions
+	i.Mode = instance.Mode
+	i.VotingRound = instance.VotingRound
+	i.VotingPeriod = instance.VotingPeriod
+	i.VotingCloses = instance.VotingCloses
+	i.Round = instance.Round
+	i.RoundStarted = instance.RoundStarted
+	i.OffsetX = instance.OffsetX
+	i.OffsetY = instance.OffsetY
+	i.Layout = instance.Layout
+	i.Seam = instance.Seam
+	i.Rounds = instance.Rounds
+	i.ForkedFrom = instance.ForkedFrom
+	// instances saved before they had rounds are in their first
+	if i.Round == 0 {
+		i.Round = 1
+	}
+	if i.Mode == "" {
+		i.Mode = ModeLatest
+	}
 
+	// instances saved before they had a state don't record how many of their
+	// tiles are filled either
+	if i.State == "" {
+		i.countTilesFilled()
+		if info, err := os.Stat(filePath); err == nil {
+			i.Created = info.ModTime().UTC()
+		}
+	}
+
+	i.saved = true
 	log.Infof("Loaded instance %v", i.ID)
 	return nil
 }
 
 func (i *Instance) EnsurePath() error {
-	p := path.Join("data", "instances", i.ID.String())
+	p := i.Path()
 	if s, err := os.Stat(p); err != nil || !s.IsDir() {
 		err := os.MkdirAll(p, 0755)
 		if err != nil {
@@ -149,7 +463,7 @@ func (i *Instance) EnsurePath() error {
 }
 
 func (i *Instance) GetStitchedImage() ([]byte, error) {
-	imageDataPath := path.Join("data", "instances", i.ID.String(), "stitch.jpg")
+	imageDataPath := path.Join(i.Path(), "stitch.jpg")
 	imageData, err := ioutil.ReadFile(imageDataPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to read image file")
@@ -157,80 +471,76 @@ func (i *Instance) GetStitchedImage() ([]byte, error) {
 	return imageData, nil
 }
 
-func (i *Instance) StitchSessionImage() error {
-	instanceDataPath := path.Join("data", "instances", i.ID.String())
-	instanceTilesPath := path.Join("data", "instances", i.ID.String(), "tiles")
-
-	if _, err := os.Stat(instanceTilesPath); err != nil {
-		err = os.MkdirAll(instanceTilesPath, 0755)
-		if err != nil {
-			return errors.Wrap(err, "Failed to create tiles folder for instance")
-		}
+// decodeSourceImage reads the source image from disk, see readSourceImage
+func (i *Instance) decodeSourceImage() (image.Image, error) {
+	reader, err := os.Open(i.SourceImagePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open %s for reading", i.SourceImagePath)
 	}
+	defer reader.Close()
 
-	tiles, err := ioutil.ReadDir(instanceTilesPath)
+	source, _, err := image.Decode(reader)
 	if err != nil {
-		return errors.Wrap(err, "Failed to list subfolders for instance")
+		return nil, errors.Wrap(err, "Failed to decode source image")
 	}
+	return source, nil
+}
 
-	contributions := make([]string,0)
-
-	for _, f := range tiles {
-		if !f.IsDir() {
-			if path.Ext(f.Name()) == ".jpg" {
-				contributions=append(contributions, f.Name())
-			}
+// countTilesFilled sets TilesFilled and the State which follows from it by
+// loading every tile
+func (i *Instance) countTilesFilled() {
+	i.TilesFilled = 0
+	for _, region := range i.Regions() {
+		t, err := i.Tile(region.Location)
+		if err == nil && t.Latest() != nil {
+			i.TilesFilled++
 		}
 	}
+	i.State = StateOpen
+	if i.TilesFilled >= i.TileCount() {
+		i.State = StateComplete
+	}
+}
 
-	reader, err := os.Open(i.SourceImagePath)
+// CompositeModified returns the time the composite image was last saved, or
+// the zero time if it hasn't been
+func (i *Instance) CompositeModified() time.Time {
+	info, err := os.Stat(path.Join(i.Path(), "stitch.jpg"))
 	if err != nil {
-		return errors.Wrapf(err, "Failed to open %s for reading", i.SourceImagePath)
+		return time.Time{}
 	}
-	source, _, err := image.Decode(reader)
+	return info.ModTime()
+}
+
+// StitchSessionImage renders the composite again from the source image and
+// every tile, and saves it as the next composite version
+func (i *Instance) StitchSessionImage() error {
+	defer i.lock()()
+	err := i.refresh()
 	if err != nil {
-		return errors.Wrap(err, "Failed to decode source image")
-	}
-
-	newImageSize := image.Rect(source.Bounds().Min.X,source.Bounds().Min.Y,source.Bounds().Max.X,source.Bounds().Max.Y)
-	stitchedImage := image.NewRGBA(newImageSize)
-
-	for tY := 0; tY < i.StepCountY; tY++ {
-		for tX := 0; tX < i.StepCountX; tX++ {
-			offsetX := i.StepSizeX * tX
-			offsetY := i.StepSizeY * tY
-			tileImagePath := path.Join(instanceTilesPath, fmt.Sprintf("%d,%d.jpg", tX, tY))
-			if _, err := os.Stat(tileImagePath); err == nil {
-				contrReader, err := os.Open(tileImagePath)
-				if err != nil {
-					log.Warn(errors.Wrap(err, "failed to open contribution"))
-					continue
-				}
-
-				contrImage, _, err := image.Decode(contrReader)
-				if err != nil {
-					log.Warn(errors.Wrap(err, "failed to decode contribution"))
-					continue
-				}
-
-				bounds := contrImage.Bounds()
-				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-					for x := bounds.Min.X; x < bounds.Max.X; x++ {
-						stitchedImage.Set(offsetX+x,offsetY+y,contrImage.At(x,y))
-					}
-				}
-			} else {
-				for y := 0; y < i.StepSizeY; y++ {
-					for x := 0; x < i.StepSizeX; x++ {
-						stitchedImage.Set(offsetX+x, offsetY+y, source.At(offsetX+x, offsetY+y))
-					}
-				}
-			}
+		return err
+	}
+	return i.stitch()
+}
+
+// stitch is StitchSessionImage for callers which hold the instance's lock
+func (i *Instance) stitch() error {
+	instanceDataPath := i.Path()
+	instanceTilesPath := i.tilesPath()
+
+	if _, err := os.Stat(instanceTilesPath); err != nil {
+		err = os.MkdirAll(instanceTilesPath, 0755)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create tiles folder for instance")
 		}
 	}
 
+	// rendered a band at a time as the encoder gets to it, rather than all
+	// at once, so that large sources fit in memory
+	stitchedImage := i.newCompositeStream()
+
 	stitchedImageFilename := path.Join(instanceDataPath,"stitch.jpg")
-	stitchedImageWriter, err := os.OpenFile(stitchedImageFilename,os.O_RDWR|os.O_CREATE, 0755)
+	stitchedImageWriter, err := atomicfile.Create(stitchedImageFilename, 0755)
 	if err != nil {
 		return errors.Wrap(err, "Couldn't open image file for writing")
 	}
@@ -238,44 +548,133 @@ func (i *Instance) StitchSessionImage() error {
 	err = jpeg.Encode(stitchedImageWriter, stitchedImage, &jpeg.Options{
 		Quality: 90,
 	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode stitched image")
+	}
+	if err := stitchedImage.Err(); err != nil {
+		return errors.Wrap(err, "Failed to render stitched image")
+	}
+	// readers see the previous composite until the new one is complete
+	err = stitchedImageWriter.Commit()
+	if err != nil {
+		return err
+	}
 
 	log.Infof("Saved %s", stitchedImageFilename)
 
+	i.CompositeVersion++
+	// every tile saved before the lock was taken is in this version
+	i.PendingCompositeVersion = 0
+	err = i.save()
+	if err != nil {
+		return errors.Wrap(err, "Failed to save instance data")
+	}
+	if Stitched != nil {
+		Stitched(i.ID)
+	}
 
 	return nil
 }
 
-func (i *Instance) UpdateTile(location tile.Location, imageData []byte) error {
-	fileName := fmt.Sprintf("%d,%d.jpg", location.X, location.Y)
-	instanceTilesPath := path.Join("data", "instances", i.ID.String(), "tiles")
-	outFilePath := path.Join(instanceTilesPath, fileName)
+// ReadTileImage reads an image submitted for the tile at location, checking
+// it against tile.DefaultLimits and the size of the tile. Problems with the
+// image are returned as a *tile.ValidationError.
+func (i *Instance) ReadTileImage(location tile.Location, r io.Reader) (*tile.Submission, error) {
+	if !i.HasTile(location) {
+		return nil, &tile.ValidationError{Reason: i.outsideLayout(location)}
+	}
 
-	if _, err := os.Stat(instanceTilesPath); err != nil && os.IsNotExist(err) {
-		err := os.MkdirAll(instanceTilesPath, 0755)
-		if err != nil {
-			return errors.Wrap(err, "Failed to create path for tiles")
-		}
+	bounds := i.TileBounds(location)
+	return tile.DefaultLimits.Read(r, bounds.Dx(), bounds.Dy())
+}
+
+// UpdateTile saves a submission read by ReadTileImage as a new version of the
+// tile at location and schedules the composite to be restitched, it doesn't
+// wait for it. PendingCompositeVersion is the composite version which will
+// show it. Transparent areas of a PNG show the previous version of the tile
+// when it is rendered. On a competitive instance the submission becomes a
+// candidate in the current voting round instead. ErrArchived is returned if
+// the instance is archived.
+func (i *Instance) UpdateTile(location tile.Location, submission *tile.Submission) error {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return err
+	}
+	if i.State == StateArchived {
+		return ErrArchived
+	}
+	if i.Mode == ModeCompetitive {
+		_, err := i.addCandidate(location, submission)
+		return err
 	}
 
-	imageFile, err := os.OpenFile(outFilePath,os.O_RDWR|os.O_CREATE, 0755)
+	version := tile.Version{
+		Format: submission.Format,
+		Opaque: true,
+		Created: time.Now().UTC(),
+		Metadata: submission.Metadata,
+		Contributor: submission.Contributor,
+	}
+	if o, ok := submission.Image.(interface{ Opaque() bool }); ok {
+		version.Opaque = o.Opaque()
+	}
+	err = i.addVersion(location, version, submission.Data)
 	if err != nil {
-		return errors.Wrap(err, "Couldn't open image file for writing")
+		return err
 	}
-	defer imageFile.Close()
 
-	_, err = imageFile.Write(imageData)
+	i.PendingCompositeVersion = i.CompositeVersion + 1
+	err = i.save()
 	if err != nil {
+		return errors.Wrap(err, "Failed to save instance data")
+	}
+	i.scheduleStitch()
+
+	return nil
+}
+
+// addVersion saves data as the next version of the tile at location, which
+// is numbered to follow the latest one. The caller saves the instance.
+func (i *Instance) addVersion(location tile.Location, version tile.Version, data []byte) error {
+	t, err := i.Tile(location)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't load tile")
+	}
+
+	version.Number = 1
+	if latest := t.Latest(); latest != nil {
+		version.Number = latest.Number + 1
+	} else {
+		i.TilesFilled++
+	}
+
+	tilePath := i.tilePath(location)
+	outFilePath := path.Join(tilePath, version.Filename())
+
+	if _, err := os.Stat(tilePath); err != nil && os.IsNotExist(err) {
+		err := os.MkdirAll(tilePath, 0755)
 		if err != nil {
-			return errors.Wrap(err, "Couldn't write image data")
+			return errors.Wrap(err, "Failed to create path for tiles")
 		}
 	}
 
+	err = atomicfile.WriteFile(outFilePath, data, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't write image data")
+	}
+
 	log.Infof("Saved %s", outFilePath)
 
-	err = i.StitchSessionImage()
+	t.Versions = append(t.Versions, version)
+	err = i.saveTile(t)
 	if err != nil {
-		return errors.Wrap(err, "Couldn't update instance stitch image")
+		return errors.Wrap(err, "Couldn't save tile data")
 	}
 
+	i.Updated = version.Created
+	if i.State == StateOpen && i.TilesFilled >= i.TileCount() {
+		i.State = StateComplete
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,248 @@
+package instance_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// useTempData points instance.DataPath at a fresh folder for the test, and
+// has composites restitched as soon as tiles are saved. Any stitch the test
+// scheduled is finished before they are put back.
+func useTempData(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "donk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, previousDelay := instance.DataPath, instance.StitchDelay
+	instance.DataPath, instance.StitchDelay = dir, time.Millisecond
+	t.Cleanup(func() {
+		instance.WaitForStitchers(time.Second)
+		instance.DataPath, instance.StitchDelay = previous, previousDelay
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+// fill returns a width by height image filled with c
+func fill(width, height int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// encodePNG encodes a width by height image filled with c
+func encodePNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := png.Encode(&buf, fill(width, height, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeTestSource saves a plain width by height source image in the data
+// folder, which useTempData must have set up
+func writeTestSource(t *testing.T, width, height int) string {
+	t.Helper()
+	source := filepath.Join(instance.DataPath, "source.png")
+	err := ioutil.WriteFile(source, encodePNG(t, width, height, color.NRGBA{200, 200, 200, 255}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+// newTestInstance creates an instance over a plain width by height source in
+// a cols by rows grid
+func newTestInstance(t *testing.T, width, height, cols, rows int) *instance.Instance {
+	t.Helper()
+	useTempData(t)
+	inst, err := instance.NewWithOptions(instance.Options{SourceImagePath: writeTestSource(t, width, height), Cols: cols, Rows: rows})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// submit reads data as an image for the tile at location and saves it, then
+// waits for the composite to show it
+func submit(t *testing.T, inst *instance.Instance, location tile.Location, data []byte) {
+	t.Helper()
+	s, err := inst.ReadTileImage(location, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.UpdateTile(location, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForComposite(t, inst)
+}
+
+// waitForComposite waits for the composite version pending on inst to be
+// rendered
+func waitForComposite(t *testing.T, inst *instance.Instance) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := inst.WaitForComposite(ctx, inst.PendingCompositeVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sameColour reports whether two colours are within tolerance of each other
+// in every channel, to allow for JPEG compression
+func sameColour(a, b color.Color, tolerance int) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8), int(a1>>8) - int(a2>>8)} {
+		if d < -tolerance || d > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNewWithOptions(t *testing.T) {
+	useTempData(t)
+	source := writeTestSource(t, 60, 40)
+	tests := []struct {
+		cols, rows int
+		ok         bool
+	}{
+		{3, 2, true},
+		{1, 1, true},
+		{60, 40, true},
+		{0, 2, false},
+		{3, -1, false},
+		{61, 2, false},
+	}
+	for _, test := range tests {
+		inst, err := instance.NewWithOptions(instance.Options{SourceImagePath: source, Cols: test.cols, Rows: test.rows})
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%dx%d: created an instance", test.cols, test.rows)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%dx%d: %v", test.cols, test.rows, err)
+			continue
+		}
+		if inst.StepSizeX != 60/test.cols || inst.StepSizeY != 40/test.rows {
+			t.Errorf("%dx%d: tiles are %dx%d", test.cols, test.rows, inst.StepSizeX, inst.StepSizeY)
+		}
+	}
+}
+
+func TestListAndDelete(t *testing.T) {
+	useTempData(t)
+	instances, err := instance.List()
+	if err != nil || len(instances) != 0 {
+		t.Fatalf("listed %d instances before any were made, %v", len(instances), err)
+	}
+
+	source := writeTestSource(t, 60, 40)
+	made := map[uuid.UUID]bool{}
+	for n := 0; n < 3; n++ {
+		inst, err := instance.NewWithOptions(instance.Options{SourceImagePath: source, Cols: 3, Rows: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		made[inst.ID] = true
+	}
+	// anything else in the folder is skipped
+	err = os.MkdirAll(filepath.Join(instance.InstancesPath(), ".import-123"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err = instance.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != len(made) {
+		t.Fatalf("listed %d instances, want %d", len(instances), len(made))
+	}
+	for n, inst := range instances {
+		if !made[inst.ID] {
+			t.Errorf("listed unknown instance %v", inst.ID)
+		}
+		if n > 0 && instances[n-1].ID.String() >= inst.ID.String() {
+			t.Errorf("%v is listed after %v", inst.ID, instances[n-1].ID)
+		}
+	}
+
+	deleted := instances[0]
+	err = deleted.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = instance.Open(deleted.ID.String())
+	if errors.Cause(err) != instance.ErrNotFound {
+		t.Errorf("opening a deleted instance returned %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(deleted.Path()); !os.IsNotExist(err) {
+		t.Errorf("deleted instance's folder is still there: %v", err)
+	}
+	if instances, _ := instance.List(); len(instances) != len(made)-1 {
+		t.Errorf("listed %d instances after a delete", len(instances))
+	}
+
+	_, err = instance.Open("not-an-id")
+	if errors.Cause(err) != instance.ErrNotFound {
+		t.Errorf("opening an invalid ID returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	inst := newTestInstance(t, 20, 20, 1, 1)
+	submit(t, inst, tile.Location{}, encodePNG(t, 20, 20, color.Black))
+	if inst.State != instance.StateComplete {
+		t.Fatalf("instance with every tile drawn is %s", inst.State)
+	}
+
+	err := inst.Archive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := inst.ReadTileImage(tile.Location{}, bytes.NewReader(encodePNG(t, 20, 20, color.White)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.UpdateTile(tile.Location{}, s); errors.Cause(err) != instance.ErrArchived {
+		t.Errorf("saving to an archived instance returned %v", err)
+	}
+
+	err = inst.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.State != instance.StateComplete || !restored.Archived.IsZero() {
+		t.Errorf("restored instance is %s, archived at %v", restored.State, restored.Archived)
+	}
+}
@@ -0,0 +1,80 @@
+package instance
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// Patterns an instance's tiles can be laid out in when it is made from a
+// number of columns and rows
+const (
+	// PatternGrid is a uniform grid of tiles
+	PatternGrid = "grid"
+	// PatternBrick offsets every other row by half a tile, see
+	// tile.BrickLayout
+	PatternBrick = "brick"
+)
+
+// Patterns are the patterns tiles can be laid out in
+var Patterns = []string{PatternGrid, PatternBrick}
+
+// Regions returns the layout of the instance's tiles: its Layout if it has
+// one, otherwise the grid described by its step counts, sizes and offset
+func (i *Instance) Regions() tile.Layout {
+	if i.Layout != nil {
+		return i.Layout
+	}
+	return tile.GridLayout(i.StepCountX, i.StepCountY, i.StepSizeX, i.StepSizeY, i.OffsetX, i.OffsetY)
+}
+
+// TileCount is the number of tiles in the instance's layout
+func (i *Instance) TileCount() int {
+	if i.Layout != nil {
+		return len(i.Layout)
+	}
+	return i.StepCountX * i.StepCountY
+}
+
+// FindTile returns the location of the tile called name
+func (i *Instance) FindTile(name string) (tile.Location, bool) {
+	region := i.Regions().Named(name)
+	if region == nil {
+		return tile.Location{}, false
+	}
+	return region.Location, true
+}
+
+// describeLayout names the instance's layout for messages
+func (i *Instance) describeLayout() string {
+	if i.Layout != nil {
+		return fmt.Sprintf("the layout of %d tiles", len(i.Layout))
+	}
+	return fmt.Sprintf("the %dx%d grid", i.StepCountX, i.StepCountY)
+}
+
+// outsideLayout is the error for a tile location the instance doesn't have
+func (i *Instance) outsideLayout(location tile.Location) string {
+	return fmt.Sprintf("tile %v is outside %s", location, i.describeLayout())
+}
+
+// checkLayout prepares a layout given for an image of width by height. If
+// none of its tiles were given a location they are numbered along a single
+// row in the order they're listed. Problems are returned as a *GridError.
+func checkLayout(layout tile.Layout, width, height int) (tile.Layout, error) {
+	layout = append(tile.Layout{}, layout...)
+	located := false
+	for _, region := range layout {
+		located = located || region.Location != tile.Location{}
+	}
+	if !located {
+		for n := range layout {
+			layout[n].Location = tile.Location{X: n}
+		}
+	}
+
+	err := layout.Check(width, height)
+	if err != nil {
+		return nil, &GridError{err.Error()}
+	}
+	return layout, nil
+}
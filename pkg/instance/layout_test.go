@@ -0,0 +1,119 @@
+package instance_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// composite decodes the current composite of inst
+func composite(t *testing.T, inst *instance.Instance) image.Image {
+	t.Helper()
+	data, err := inst.GetStitchedImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestLayout(t *testing.T) {
+	useTempData(t)
+	sky := tile.Region{Name: "sky", Bounds: image.Rect(0, 0, 60, 30)}
+	sun := tile.Region{Name: "sun", Bounds: image.Rect(40, 0, 60, 20)}
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath: writeTestSource(t, 60, 40),
+		Layout:          tile.Layout{sky, sun},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tiles given without locations are numbered along a row
+	skyAt, _ := inst.FindTile("sky")
+	sunAt, found := inst.FindTile("sun")
+	if !found || skyAt != (tile.Location{X: 0}) || sunAt != (tile.Location{X: 1}) {
+		t.Fatalf("sky is at %v, sun at %v", skyAt, sunAt)
+	}
+	if inst.TileCount() != 2 || inst.HasTile(tile.Location{X: 0, Y: 1}) {
+		t.Errorf("layout has %d tiles", inst.TileCount())
+	}
+
+	// the sun is drawn over the sky, whichever was saved last
+	submit(t, inst, sunAt, encodePNG(t, 20, 20, color.White))
+	submit(t, inst, skyAt, encodePNG(t, 60, 30, color.Black))
+	if inst.State != instance.StateComplete {
+		t.Errorf("instance is %s with both tiles drawn", inst.State)
+	}
+	img := composite(t, inst)
+	for _, test := range []struct {
+		x, y int
+		want color.Color
+	}{
+		{50, 10, color.White},
+		{10, 10, color.Black},
+		{50, 25, color.Black},
+		{10, 35, color.NRGBA{200, 200, 200, 255}},
+	} {
+		if got := img.At(test.x, test.y); !sameColour(got, test.want, 8) {
+			t.Errorf("composite at %d,%d is %v, want %v", test.x, test.y, got, test.want)
+		}
+	}
+
+	// the next round keeps the layout unless it's given a grid
+	err = inst.StartRound(instance.RoundOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.TileBounds(sunAt) != sun.Bounds {
+		t.Errorf("sun covers %v in the second round", inst.TileBounds(sunAt))
+	}
+	submit(t, inst, skyAt, encodePNG(t, 60, 30, color.Black))
+	submit(t, inst, sunAt, encodePNG(t, 20, 20, color.Black))
+	err = inst.StartRound(instance.RoundOptions{Cols: 2, Rows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Layout != nil || inst.TileCount() != 4 || inst.TileBounds(tile.Location{X: 1, Y: 1}) != image.Rect(30, 20, 60, 40) {
+		t.Errorf("third round has %d tiles", inst.TileCount())
+	}
+}
+
+func TestBrickInstance(t *testing.T) {
+	useTempData(t)
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath: writeTestSource(t, 60, 40),
+		Cols:            3,
+		Rows:            2,
+		Pattern:         instance.PatternBrick,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the half brick at the end of the offset row is sized to fit
+	end := tile.Location{X: 3, Y: 1}
+	if bounds := inst.TileBounds(end); bounds != image.Rect(50, 20, 60, 40) {
+		t.Fatalf("half brick covers %v", bounds)
+	}
+	submit(t, inst, end, encodePNG(t, 10, 20, color.White))
+	if got := composite(t, inst).At(55, 30); !sameColour(got, color.White, 8) {
+		t.Errorf("half brick is drawn as %v", got)
+	}
+	s, err := inst.ReadTileImage(end, bytes.NewReader(encodePNG(t, 20, 20, color.White)))
+	if err == nil {
+		err = inst.UpdateTile(end, s)
+	}
+	if err == nil {
+		t.Error("saved a whole brick over a half brick")
+	}
+
+	if _, err := instance.NewWithOptions(instance.Options{SourceImagePath: writeTestSource(t, 60, 40), Cols: 3, Rows: 2, Pattern: "herringbone"}); err == nil {
+		t.Error("created an instance in an unknown pattern")
+	}
+}
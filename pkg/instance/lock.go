@@ -0,0 +1,68 @@
+package instance
+
+import (
+	"github.com/google/uuid"
+	"path"
+	"sync"
+)
+
+// instanceLock is held while an instance is being changed. holders counts
+// those holding or waiting for it, so that it is only dropped once nobody is.
+type instanceLock struct {
+	sync.Mutex
+	holders int
+}
+
+// locks holds a lock for each instance which is being changed by this
+// process. Instances are opened afresh for each request, so the lock is kept
+// by ID rather than on the Instance.
+var locks = struct {
+	sync.Mutex
+	byID map[uuid.UUID]*instanceLock
+}{byID: make(map[uuid.UUID]*instanceLock)}
+
+func (i *Instance) lockPath() string {
+	return path.Join(i.Path(), "lock")
+}
+
+// lock holds the instance's lock until the function it returns is called.
+// Tiles, candidates and the instance record and composite are only changed
+// while it is held, so that concurrent saves don't lose each other's
+// versions. Other processes, such as the CLI run beside the server, are kept
+// out by a lock on the lock file in the instance folder where the system
+// supports one.
+func (i *Instance) lock() func() {
+	locks.Lock()
+	l, ok := locks.byID[i.ID]
+	if !ok {
+		l = &instanceLock{}
+		locks.byID[i.ID] = l
+	}
+	l.holders++
+	locks.Unlock()
+
+	l.Lock()
+	unlockFile := lockFile(i.lockPath())
+	return func() {
+		unlockFile()
+		locks.Lock()
+		l.holders--
+		if l.holders == 0 {
+			delete(locks.byID, i.ID)
+		}
+		locks.Unlock()
+		l.Unlock()
+	}
+}
+
+// refresh reloads the instance record once its lock is held, so that changes
+// saved by whoever held it before aren't overwritten. An instance which hasn't
+// been saved yet is left as it is, but ErrNotFound is returned for one which
+// has been deleted since it was opened, rather than bringing it back.
+func (i *Instance) refresh() error {
+	err := i.load()
+	if err == ErrNotFound && !i.saved {
+		return nil
+	}
+	return err
+}
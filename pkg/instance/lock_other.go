@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package instance
+
+// lockFile doesn't lock anything on systems without flock, instances are
+// only locked against changes from within the process
+func lockFile(lockPath string) func() {
+	return func() {}
+}
@@ -0,0 +1,85 @@
+package instance_test
+
+import (
+	"bytes"
+	"image/color"
+	"sync"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// TestConcurrentSaves saves to every tile at once from instances opened
+// separately, as requests do. Run it with -race.
+func TestConcurrentSaves(t *testing.T) {
+	inst := newTestInstance(t, 60, 40, 3, 2)
+	const saves = 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, saves*inst.TileCount())
+	for _, region := range inst.Regions() {
+		for n := 0; n < saves; n++ {
+			data := encodePNG(t, region.Bounds.Dx(), region.Bounds.Dy(), color.NRGBA{uint8(n * 40), 0, 0, 255})
+			wg.Add(1)
+			go func(location tile.Location) {
+				defer wg.Done()
+				opened, err := instance.Open(inst.ID.String())
+				if err != nil {
+					errs <- err
+					return
+				}
+				s, err := opened.ReadTileImage(location, bytes.NewReader(data))
+				if err == nil {
+					err = opened.UpdateTile(location, s)
+				}
+				errs <- err
+			}(region.Location)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	reopened, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no save was lost to another made at the same time
+	for _, region := range reopened.Regions() {
+		if n := tileVersions(t, reopened, region.Location); n != saves {
+			t.Errorf("tile %v has %d versions, want %d", region.Location, n, saves)
+		}
+	}
+	if reopened.TilesFilled != reopened.TileCount() || reopened.State != instance.StateComplete {
+		t.Errorf("instance is %s with %d tiles filled", reopened.State, reopened.TilesFilled)
+	}
+}
+
+func TestSaveAfterDelete(t *testing.T) {
+	inst := newTestInstance(t, 60, 40, 3, 2)
+	stale, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := tile.Location{X: 1, Y: 1}
+	s, err := stale.ReadTileImage(location, bytes.NewReader(encodePNG(t, 20, 20, color.Black)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.UpdateTile(location, s); err == nil {
+		t.Error("saved a tile of a deleted instance")
+	}
+	if _, err := instance.Open(inst.ID.String()); err != instance.ErrNotFound {
+		t.Errorf("opening the deleted instance returned %v", err)
+	}
+}
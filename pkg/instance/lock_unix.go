@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package instance
+
+import (
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"syscall"
+)
+
+// lockFile holds an exclusive lock on the file at lockPath until the
+// function it returns is called, waiting for any other process holding it.
+// An instance whose folder doesn't exist yet has nothing to lock.
+func lockFile(lockPath string) func() {
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn(errors.Wrapf(err, "Couldn't open %s, other processes aren't locked out", lockPath))
+		}
+		return func() {}
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		log.Warn(errors.Wrapf(err, "Couldn't lock %s, other processes aren't locked out", lockPath))
+		f.Close()
+		return func() {}
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package instance_test
+
+import (
+	"image/color"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// TestLockFile holds the lock file as another process, such as the CLI,
+// would and checks that saves wait for it
+func TestLockFile(t *testing.T) {
+	inst := newTestInstance(t, 60, 40, 3, 2)
+	f, err := os.OpenFile(filepath.Join(inst.Path(), "lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location := tile.Location{X: 0, Y: 0}
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		submit(t, inst, location, encodePNG(t, 20, 20, color.Black))
+	}()
+	select {
+	case <-saved:
+		t.Fatal("saved a tile while another process held the lock")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-saved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tile wasn't saved once the lock was released")
+	}
+	if n := tileVersions(t, inst, location); n != 1 {
+		t.Errorf("tile has %d versions", n)
+	}
+}
@@ -0,0 +1,293 @@
+package instance
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sorts are the orders instances can be listed in:
+//
+//	created: when the instance was created
+//	activity: when a tile was last saved, or the instance created if none
+//	  has been
+//	completion: the proportion of tiles which have been drawn
+var Sorts = []string{"created", "activity", "completion"}
+
+// Summary is the description of an instance returned when listing them
+type Summary struct {
+	ID                uuid.UUID `json:"id"`
+	Title             string    `json:"title"`
+	Creator           string    `json:"creator"`
+	State             string    `json:"state"`
+	Cols              int       `json:"cols"`
+	Rows              int       `json:"rows"`
+	Tiles             int       `json:"tiles"`
+	TilesFilled       int       `json:"tilesFilled"`
+	Created           time.Time `json:"created"`
+	Updated           time.Time `json:"updated"`
+	CompositeImageUrl string    `json:"compositeImageUrl"`
+}
+
+// Summary describes the instance for a listing
+func (i *Instance) Summary() Summary {
+	return Summary{
+		ID:                i.ID,
+		Title:             i.Title,
+		Creator:           i.Creator,
+		State:             i.State,
+		Cols:              i.StepCountX,
+		Rows:              i.StepCountY,
+		Tiles:             i.TileCount(),
+		TilesFilled:       i.TilesFilled,
+		Created:           i.Created,
+		Updated:           i.Updated,
+		CompositeImageUrl: i.CompositeImageUrl,
+	}
+}
+
+func (s Summary) lastActive() time.Time {
+	if s.Updated.IsZero() {
+		return s.Created
+	}
+	return s.Updated
+}
+
+func (s Summary) completion() float64 {
+	if s.Tiles == 0 {
+		return 0
+	}
+	return float64(s.TilesFilled) / float64(s.Tiles)
+}
+
+// Query selects a page of instances to list
+type Query struct {
+	// State and Creator only list instances which match them, if they are
+	// given. Archived instances are left out unless State asks for them.
+	State   string
+	Creator string
+	// Sort is one of Sorts, instances are listed in descending order unless
+	// Ascending is set
+	Sort      string
+	Ascending bool
+	// Cursor continues a listing from the end of a previous page
+	Cursor string
+	Limit  int
+}
+
+// QueryError is returned for a query which can't be answered
+type QueryError struct {
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return e.Reason
+}
+
+// Page is a page of instances listed by Find
+type Page struct {
+	Instances []Summary `json:"instances"`
+	// NextCursor continues the listing with the next page, it is empty if
+	// this is the last one
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// cursor marks the last instance on a page. It holds everything the
+// instances are sorted by so that the next page starts in the right place
+// even if that instance has since changed or been removed.
+type cursor struct {
+	Sort        string    `json:"s"`
+	Ascending   bool      `json:"a,omitempty"`
+	ID          uuid.UUID `json:"i"`
+	Created     time.Time `json:"c"`
+	Updated     time.Time `json:"u"`
+	TilesFilled int       `json:"f"`
+	Tiles       int       `json:"t"`
+}
+
+func (c cursor) summary() Summary {
+	return Summary{
+		ID:          c.ID,
+		Created:     c.Created,
+		Updated:     c.Updated,
+		TilesFilled: c.TilesFilled,
+		Tiles:       c.Tiles,
+	}
+}
+
+// Find lists the instances selected by q
+func Find(q Query) (*Page, error) {
+	if q.State != "" && !contains(States, q.State) {
+		return nil, &QueryError{"state must be one of " + strings.Join(States, ", ")}
+	}
+	if q.Sort == "" {
+		q.Sort = Sorts[0]
+	}
+	less, ok := sortOrders[q.Sort]
+	if !ok {
+		return nil, &QueryError{"sort must be one of " + strings.Join(Sorts, ", ")}
+	}
+	before := func(a, b Summary) bool {
+		if q.Ascending {
+			a, b = b, a
+		}
+		if less(a, b) != less(b, a) {
+			return less(b, a)
+		}
+		// ties are broken by ID so that every instance has a place in the
+		// order for cursors to refer to
+		return strings.Compare(a.ID.String(), b.ID.String()) < 0
+	}
+
+	var after *Summary
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort || c.Ascending != q.Ascending {
+			return nil, &QueryError{"cursor is not valid for this listing"}
+		}
+		key := c.summary()
+		after = &key
+	}
+
+	all, err := listSummaries()
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]Summary, 0, len(all))
+	for _, s := range all {
+		// archived instances are only listed when they're asked for
+		if s.State != q.State && (q.State != "" || s.State == StateArchived) {
+			continue
+		}
+		if q.Creator != "" && s.Creator != q.Creator {
+			continue
+		}
+		if after != nil && !before(*after, s) {
+			continue
+		}
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(a, b int) bool {
+		return before(summaries[a], summaries[b])
+	})
+
+	page := &Page{Instances: summaries}
+	if q.Limit > 0 && len(summaries) > q.Limit {
+		page.Instances = summaries[:q.Limit]
+		last := page.Instances[q.Limit-1]
+		page.NextCursor = encodeCursor(cursor{
+			Sort:        q.Sort,
+			Ascending:   q.Ascending,
+			ID:          last.ID,
+			Created:     last.Created,
+			Updated:     last.Updated,
+			TilesFilled: last.TilesFilled,
+			Tiles:       last.Tiles,
+		})
+	}
+	return page, nil
+}
+
+// summaryCache keeps the summary of each instance along with the size and
+// modification time of the record it was read from, so that listing doesn't
+// load every instance for every page
+var summaryCache = struct {
+	sync.Mutex
+	byID map[uuid.UUID]cachedSummary
+}{
+	byID: make(map[uuid.UUID]cachedSummary),
+}
+
+type cachedSummary struct {
+	modified time.Time
+	size     int64
+	summary  Summary
+}
+
+// listSummaries summarises every saved instance, only opening those whose
+// records have changed since they were last summarised
+func listSummaries() ([]Summary, error) {
+	entries, err := ioutil.ReadDir(InstancesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Summary{}, nil
+		}
+		return nil, errors.Wrap(err, "Failed to list instances")
+	}
+
+	summaryCache.Lock()
+	defer summaryCache.Unlock()
+	current := make(map[uuid.UUID]cachedSummary, len(entries))
+	summaries := make([]Summary, 0, len(entries))
+	for _, entry := range entries {
+		id, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		info, err := os.Stat(path.Join(InstancesPath(), entry.Name(), "instance"))
+		if err != nil {
+			continue
+		}
+
+		cached, found := summaryCache.byID[id]
+		if !found || !cached.modified.Equal(info.ModTime()) || cached.size != info.Size() {
+			i, err := Open(entry.Name())
+			if err != nil {
+				log.Warn(errors.Wrapf(err, "Failed to open instance %s", entry.Name()))
+				continue
+			}
+			cached = cachedSummary{modified: info.ModTime(), size: info.Size(), summary: i.Summary()}
+		}
+		current[id] = cached
+		summaries = append(summaries, cached.summary)
+	}
+	summaryCache.byID = current
+	return summaries, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sortOrders compare summaries in ascending order for each of Sorts
+var sortOrders = map[string]func(a, b Summary) bool{
+	"created": func(a, b Summary) bool {
+		return a.Created.Before(b.Created)
+	},
+	"activity": func(a, b Summary) bool {
+		return a.lastActive().Before(b.lastActive())
+	},
+	"completion": func(a, b Summary) bool {
+		return a.completion() < b.completion()
+	},
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	c := cursor{}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
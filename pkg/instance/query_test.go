@@ -0,0 +1,165 @@
+package instance_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+)
+
+// queryInstances makes instances with 0 to n-1 of their 4 tiles filled,
+// made by alternating creators
+func queryInstances(t *testing.T, n int) []*instance.Instance {
+	useTempData(t)
+	source := writeTestSource(t, 20, 20)
+	made := make([]*instance.Instance, n)
+	for m := range made {
+		inst, err := instance.NewWithOptions(instance.Options{SourceImagePath: source, Cols: 2, Rows: 2, Creator: []string{"ann", "bob"}[m%2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for filled := 0; filled < m && filled < 4; filled++ {
+			submit(t, inst, tile.Location{X: filled % 2, Y: filled / 2}, encodePNG(t, 10, 10, color.Black))
+		}
+		made[m] = inst
+	}
+	return made
+}
+
+// findAll follows cursors through every page of a listing
+func findAll(t *testing.T, q instance.Query) []instance.Summary {
+	t.Helper()
+	all := []instance.Summary{}
+	for pages := 0; ; pages++ {
+		page, err := instance.Find(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, page.Instances...)
+		if page.NextCursor == "" || pages > 100 {
+			return all
+		}
+		q.Cursor = page.NextCursor
+	}
+}
+
+func TestFind(t *testing.T) {
+	made := queryInstances(t, 6)
+
+	for _, sort := range instance.Sorts {
+		for _, ascending := range []bool{false, true} {
+			all := findAll(t, instance.Query{Sort: sort, Ascending: ascending, Limit: 4})
+			if len(all) != len(made) {
+				t.Errorf("%s ascending %t: listed %d instances, want %d", sort, ascending, len(all), len(made))
+			}
+			seen := map[uuid.UUID]bool{}
+			for _, s := range all {
+				if seen[s.ID] {
+					t.Errorf("%s ascending %t: %v listed twice", sort, ascending, s.ID)
+				}
+				seen[s.ID] = true
+			}
+		}
+	}
+
+	all := findAll(t, instance.Query{Sort: "completion", Limit: 2})
+	for n := 1; n < len(all); n++ {
+		if all[n].TilesFilled > all[n-1].TilesFilled {
+			t.Errorf("%d tiles filled is listed after %d", all[n].TilesFilled, all[n-1].TilesFilled)
+		}
+	}
+
+	complete := findAll(t, instance.Query{State: instance.StateComplete})
+	if len(complete) != 2 {
+		t.Errorf("%d complete instances, want 2", len(complete))
+	}
+	for _, s := range findAll(t, instance.Query{Creator: "ann"}) {
+		if s.Creator != "ann" {
+			t.Errorf("listed an instance by %s", s.Creator)
+		}
+	}
+}
+
+func TestFindRejects(t *testing.T) {
+	queryInstances(t, 2)
+	page, err := instance.Find(instance.Query{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, q := range map[string]instance.Query{
+		"unknown state":            {State: "finished"},
+		"unknown sort":             {Sort: "title"},
+		"malformed cursor":         {Cursor: "!!"},
+		"cursor for another sort":  {Sort: "activity", Cursor: page.NextCursor},
+		"cursor for another order": {Ascending: true, Cursor: page.NextCursor},
+	} {
+		_, err := instance.Find(q)
+		if _, ok := err.(*instance.QueryError); !ok {
+			t.Errorf("%s: got %v, want a query error", name, err)
+		}
+	}
+}
+
+// TestFindWithoutTiles checks that an instance whose record has no tiles is
+// listed as having none of them filled
+func TestFindWithoutTiles(t *testing.T) {
+	made := queryInstances(t, 5)
+	recordPath := filepath.Join(made[0].Path(), "instance")
+	data, err := ioutil.ReadFile(recordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{}
+	json.Unmarshal(data, &record)
+	record["stepCountX"] = 0
+	data, _ = json.Marshal(record)
+	err = ioutil.WriteFile(recordPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ascending := range []bool{false, true} {
+		all := findAll(t, instance.Query{Sort: "completion", Ascending: ascending, Limit: 1})
+		if len(all) != len(made) {
+			t.Fatalf("ascending %t: listed %d instances, want %d", ascending, len(all), len(made))
+		}
+		least := all[len(all)-1]
+		if ascending {
+			least = all[0]
+		}
+		if least.ID != made[0].ID {
+			t.Errorf("ascending %t: instance without tiles isn't listed as the least complete", ascending)
+		}
+	}
+}
+
+// TestFindChanges checks that listings follow instances being saved and
+// deleted
+func TestFindChanges(t *testing.T) {
+	made := queryInstances(t, 2)
+	if complete := findAll(t, instance.Query{State: instance.StateComplete}); len(complete) != 0 {
+		t.Fatalf("%d complete instances", len(complete))
+	}
+
+	for _, location := range []tile.Location{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 0, Y: 1}, {X: 1, Y: 1}} {
+		submit(t, made[0], location, encodePNG(t, 10, 10, color.Black))
+	}
+	complete := findAll(t, instance.Query{State: instance.StateComplete})
+	if len(complete) != 1 || complete[0].ID != made[0].ID || complete[0].TilesFilled != 4 {
+		t.Errorf("complete instances are %+v, want %v", complete, made[0].ID)
+	}
+
+	err := made[1].Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := findAll(t, instance.Query{}); len(all) != 1 {
+		t.Errorf("listed %d instances after a delete", len(all))
+	}
+}
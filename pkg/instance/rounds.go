@@ -0,0 +1,259 @@
+package instance
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// ErrIncomplete is returned when starting a new round of an instance whose
+// tiles haven't all been drawn
+var ErrIncomplete = errors.New("Instance is not complete")
+
+// GridError is returned for a grid or layout which doesn't fit the source
+// image
+type GridError struct {
+	Reason string
+}
+
+func (e *GridError) Error() string {
+	return e.Reason
+}
+
+// Round is a finished round of an instance. The composite it ended with is
+// kept, and became the source image of the round after it.
+type Round struct {
+	Number          int    `json:"number"`
+	SourceImagePath string `json:"sourceImagePath"`
+	Cols            int    `json:"cols"`
+	Rows            int    `json:"rows"`
+	OffsetX         int    `json:"offsetX,omitempty"`
+	OffsetY         int    `json:"offsetY,omitempty"`
+	// Layout is the round's layout if its tiles weren't in a grid
+	Layout      tile.Layout `json:"layout,omitempty"`
+	TilesFilled int         `json:"tilesFilled"`
+	// CompositeVersion is the version of the composite the round ended with
+	CompositeVersion int `json:"compositeVersion"`
+	// LastVotingRound is the voting round a competitive instance was in when
+	// the round finished. Voting rounds are numbered on from it in the next
+	// round.
+	LastVotingRound int       `json:"lastVotingRound,omitempty"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+}
+
+// RoundOptions describe the tiles of a new round, either a grid or a
+// Layout. If neither Cols, Rows nor Layout are given the round before's
+// layout is kept, otherwise Cols and Rows are kept from it if they are
+// zero.
+type RoundOptions struct {
+	Cols    int
+	Rows    int
+	OffsetX int
+	OffsetY int
+	Layout  tile.Layout
+}
+
+func (i *Instance) roundPath(round int) string {
+	return path.Join(i.Path(), "rounds", strconv.Itoa(round))
+}
+
+// RoundCompositePath is the composite an earlier round ended with
+func (i *Instance) RoundCompositePath(round int) string {
+	return path.Join(i.roundPath(round), "stitch.jpg")
+}
+
+// FindRound returns the record of an earlier round, or nil if there isn't
+// one numbered round
+func (i *Instance) FindRound(round int) *Round {
+	for n := range i.Rounds {
+		if i.Rounds[n].Number == round {
+			return &i.Rounds[n]
+		}
+	}
+	return nil
+}
+
+// votingRoundOf returns the record of the earlier round a voting round was
+// held in, or nil if it is from the current round
+func (i *Instance) votingRoundOf(votingRound int) *Round {
+	for n := range i.Rounds {
+		if votingRound <= i.Rounds[n].LastVotingRound {
+			return &i.Rounds[n]
+		}
+	}
+	return nil
+}
+
+// VotingLayout returns the layout of the tiles during a voting round, which
+// may have been held in an earlier round
+func (i *Instance) VotingLayout(votingRound int) tile.Layout {
+	round := i.votingRoundOf(votingRound)
+	if round == nil {
+		return i.Regions()
+	}
+	if round.Layout != nil {
+		return round.Layout
+	}
+	// every round's composite is the size of the first round's source
+	return tile.GridLayout(round.Cols, round.Rows,
+		(i.SourceImageWidth-round.OffsetX)/round.Cols, (i.SourceImageHeight-round.OffsetY)/round.Rows,
+		round.OffsetX, round.OffsetY)
+}
+
+// StartRound finishes the current round of a complete instance and starts
+// the next one, drawn over the composite the current round ended with. The
+// tiles and composite of the current round are kept in its round folder,
+// and the new round starts with no tiles drawn on the layout made from
+// options.
+// Sessions of the current round can't save tiles once it has finished.
+func (i *Instance) StartRound(options RoundOptions) error {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return err
+	}
+	if i.State == StateArchived {
+		return ErrArchived
+	}
+	if i.State != StateComplete {
+		return ErrIncomplete
+	}
+	if options.Layout == nil && options.Cols == 0 && options.Rows == 0 {
+		options.Layout = i.Layout
+	}
+	var layout tile.Layout
+	if options.Layout != nil {
+		// the composite is the same size as the source it was drawn over
+		layout, err = checkLayout(options.Layout, i.SourceImageWidth, i.SourceImageHeight)
+		if err != nil {
+			return err
+		}
+		options.Cols, options.Rows, options.OffsetX, options.OffsetY = 0, 0, 0, 0
+	} else {
+		if options.Cols == 0 {
+			options.Cols = i.StepCountX
+		}
+		if options.Rows == 0 {
+			options.Rows = i.StepCountY
+		}
+		if options.Cols < 1 || options.Rows < 1 {
+			return &GridError{fmt.Sprintf("grid must have at least one column and row, not %dx%d", options.Cols, options.Rows)}
+		}
+		if options.OffsetX < 0 || options.OffsetY < 0 ||
+			(i.SourceImageWidth-options.OffsetX)/options.Cols < 1 || (i.SourceImageHeight-options.OffsetY)/options.Rows < 1 {
+			return &GridError{fmt.Sprintf("the composite is too small for a %dx%d grid offset by %d,%d",
+				options.Cols, options.Rows, options.OffsetX, options.OffsetY)}
+		}
+	}
+
+	// the composite kept for the round has to show every tile saved in it,
+	// including those still waiting for the stitcher
+	if i.StitchPending() {
+		err = i.stitch()
+		if err != nil {
+			return errors.Wrap(err, "Couldn't update instance stitch image")
+		}
+	}
+
+	finished := Round{
+		Number:           i.Round,
+		SourceImagePath:  i.SourceImagePath,
+		Cols:             i.StepCountX,
+		Rows:             i.StepCountY,
+		OffsetX:          i.OffsetX,
+		OffsetY:          i.OffsetY,
+		Layout:           i.Layout,
+		TilesFilled:      i.TilesFilled,
+		CompositeVersion: i.CompositeVersion,
+		LastVotingRound:  i.VotingRound,
+		Started:          i.RoundStarted,
+		Finished:         time.Now().UTC(),
+	}
+	if finished.Started.IsZero() {
+		finished.Started = i.Created
+	}
+
+	// the next round is made ready on a copy, so nothing is moved if its
+	// source can't be used
+	next := *i
+	next.Rounds = append(append([]Round{}, i.Rounds...), finished)
+	next.Round++
+	next.RoundStarted = finished.Finished
+	next.SourceImagePath = path.Join(i.Path(), "stitch.jpg")
+	next.StepCountX = options.Cols
+	next.StepCountY = options.Rows
+	next.OffsetX = options.OffsetX
+	next.OffsetY = options.OffsetY
+	next.Layout = layout
+	next.StepSizeX, next.StepSizeY = 0, 0
+	next.TilesFilled = 0
+	next.State = StateOpen
+	if next.Mode == ModeCompetitive {
+		next.startVotingRound(i.VotingRound + 1)
+	}
+	err = next.readSourceImageAttributes()
+	if err != nil {
+		return errors.Wrap(err, "failed to read source image attributes")
+	}
+
+	// everything moved from here on is put back if a later step fails
+	undo := []func(){}
+	rollback := func() {
+		for n := len(undo) - 1; n >= 0; n-- {
+			undo[n]()
+		}
+	}
+
+	roundPath := i.roundPath(finished.Number)
+	err = os.MkdirAll(roundPath, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create path for round")
+	}
+	undo = append(undo, func() { os.RemoveAll(roundPath) })
+	err = os.Rename(next.SourceImagePath, i.RoundCompositePath(finished.Number))
+	if err != nil {
+		rollback()
+		return errors.Wrap(err, "Failed to keep composite of round")
+	}
+	undo = append(undo, func() { os.Rename(i.RoundCompositePath(finished.Number), path.Join(i.Path(), "stitch.jpg")) })
+	next.SourceImagePath = i.RoundCompositePath(finished.Number)
+	if _, err := os.Stat(i.tilesPath()); err == nil {
+		err = os.Rename(i.tilesPath(), path.Join(roundPath, "tiles"))
+		if err != nil {
+			rollback()
+			return errors.Wrap(err, "Failed to keep tiles of round")
+		}
+		undo = append(undo, func() {
+			os.RemoveAll(i.tilesPath())
+			os.Rename(path.Join(roundPath, "tiles"), i.tilesPath())
+		})
+	}
+
+	// the previous source won't be rendered again
+	i.forgetSource()
+	undo = append(undo, func() { os.RemoveAll(next.sourceTilesPath()) })
+	err = next.cutSource()
+	if err != nil {
+		rollback()
+		return errors.Wrap(err, "failed to cut source image")
+	}
+	// the composite starts out as the source, restitching saves the instance
+	// with the new round
+	err = next.stitch()
+	if err != nil {
+		rollback()
+		return errors.Wrap(err, "Couldn't update instance stitch image")
+	}
+	// the previous round's pieces won't be rendered again either
+	os.RemoveAll(i.sourceTilesPath())
+	*i = next
+
+	log.Infof("Started round %d of instance %v", i.Round, i.ID)
+	return nil
+}
@@ -0,0 +1,172 @@
+package instance_test
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// completeTestInstance has every tile of its 2x2 grid drawn
+func completeTestInstance(t *testing.T) *instance.Instance {
+	t.Helper()
+	inst := newTestInstance(t, 60, 60, 2, 2)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			submit(t, inst, tile.Location{X: x, Y: y}, encodePNG(t, 30, 30, color.Black))
+		}
+	}
+	if inst.State != instance.StateComplete {
+		t.Fatalf("instance is %s after drawing every tile", inst.State)
+	}
+	return inst
+}
+
+func TestStartRound(t *testing.T) {
+	useTempData(t)
+	open := newTestInstance(t, 60, 60, 2, 2)
+	if err := open.StartRound(instance.RoundOptions{}); err != instance.ErrIncomplete {
+		t.Errorf("starting a round of an open instance returned %v", err)
+	}
+
+	inst := completeTestInstance(t)
+	for _, options := range []instance.RoundOptions{
+		{Cols: 61},
+		{Cols: 2, Rows: 2, OffsetX: 60},
+		{OffsetY: -1},
+	} {
+		if _, ok := inst.StartRound(options).(*instance.GridError); !ok {
+			t.Errorf("started a round with %+v", options)
+		}
+	}
+
+	err := inst.StartRound(instance.RoundOptions{Cols: 3, Rows: 3, OffsetX: 3, OffsetY: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Round != 2 || len(reopened.Rounds) != 1 || reopened.State != instance.StateOpen || reopened.TilesFilled != 0 {
+		t.Fatalf("started round %d after %d rounds, %s with %d tiles", reopened.Round, len(reopened.Rounds), reopened.State, reopened.TilesFilled)
+	}
+	finished := reopened.FindRound(1)
+	if finished == nil || finished.Cols != 2 || finished.TilesFilled != 4 {
+		t.Fatalf("recorded the first round as %+v", finished)
+	}
+	if reopened.SourceImagePath != reopened.RoundCompositePath(1) {
+		t.Errorf("second round is drawn over %s", reopened.SourceImagePath)
+	}
+	if bounds := reopened.TileBounds(tile.Location{X: 0, Y: 0}); bounds.Min.X != 3 || bounds.Dx() != 19 {
+		t.Errorf("first tile of the second round covers %v", bounds)
+	}
+	tl, err := reopened.Tile(tile.Location{X: 0, Y: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.Latest() != nil {
+		t.Error("second round started with the first round's tiles")
+	}
+	if _, err := os.Stat(filepath.Join(inst.Path(), "rounds", "1", "tiles", "0,0", "tile")); err != nil {
+		t.Errorf("first round's tiles weren't kept: %v", err)
+	}
+}
+
+func TestStartRoundRollback(t *testing.T) {
+	useTempData(t)
+	inst := completeTestInstance(t)
+	// the tiles can't be moved over a folder which is already there
+	blocking := filepath.Join(inst.Path(), "rounds", "1", "tiles", "0,0")
+	err := os.MkdirAll(blocking, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inst.StartRound(instance.RoundOptions{}); err == nil {
+		t.Fatal("started a round whose tiles couldn't be kept")
+	}
+	reopened, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Round != 1 || reopened.Round != 1 || reopened.State != instance.StateComplete {
+		t.Fatalf("failed round left the instance in round %d, %s", reopened.Round, reopened.State)
+	}
+	if _, err := os.Stat(filepath.Join(inst.Path(), "stitch.jpg")); err != nil {
+		t.Errorf("composite wasn't put back: %v", err)
+	}
+	if tl, err := reopened.Tile(tile.Location{X: 1, Y: 1}); err != nil || tl.Latest() == nil {
+		t.Errorf("tiles weren't put back: %v", err)
+	}
+
+	// nothing is left behind to stop it working the next time
+	if err := reopened.StartRound(instance.RoundOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEarlierRoundCandidates(t *testing.T) {
+	useTempData(t)
+	inst := newCompetitiveInstance(t)
+	ballot := issue(t, inst, 1)[0]
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 3; x++ {
+			location := tile.Location{X: x, Y: y}
+			submit(t, inst, location, encodePNG(t, 20, 20, color.Black))
+			vote(t, inst, location, 1, ballot)
+		}
+	}
+	if _, err := inst.CloseVotingRound(); err != nil {
+		t.Fatal(err)
+	}
+	corner := tile.Location{X: 2, Y: 2}
+	submit(t, inst, corner, encodePNG(t, 20, 20, color.White))
+
+	err := inst.StartRound(instance.RoundOptions{Cols: 2, Rows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// voting rounds are numbered on so they can be told apart from the
+	// first round's
+	if inst.VotingRound != 3 {
+		t.Fatalf("second round started in voting round %d", inst.VotingRound)
+	}
+	first, err := inst.Candidates(corner, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Closed || first.Winner != 1 {
+		t.Errorf("first voting round of %v is closed %t with winner %d", corner, first.Closed, first.Winner)
+	}
+	second, err := inst.Candidates(corner, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Candidates) != 1 {
+		t.Errorf("second voting round of %v has %d candidates", corner, len(second.Candidates))
+	}
+	if _, _, err := inst.ReadCandidate(corner, 2, 1); err != nil {
+		t.Error(err)
+	}
+	if region := inst.VotingLayout(2).Find(corner); region == nil || region.Bounds != image.Rect(40, 40, 60, 60) {
+		t.Errorf("%v was on the layout of voting round 2 at %v", corner, region)
+	}
+	if inst.VotingLayout(3).Find(corner) != nil {
+		t.Errorf("%v is on the layout of voting round 3", corner)
+	}
+
+	location := tile.Location{X: 1, Y: 1}
+	submit(t, inst, location, encodePNG(t, 30, 30, color.White))
+	current, err := inst.Candidates(location, inst.VotingRound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current.Candidates) != 1 {
+		t.Errorf("current voting round has %d candidates", len(current.Candidates))
+	}
+}
@@ -0,0 +1,239 @@
+package instance
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Seam styles, for the edges where tiles meet in the composite
+const (
+	// SeamNone leaves tiles meeting at hard edges
+	SeamNone = "none"
+	// SeamFeather blends the tiles either side of each edge into each other
+	// across an overlap
+	SeamFeather = "feather"
+	// SeamGrout draws a line along each edge, like the grout between tiles
+	SeamGrout = "grout"
+)
+
+// SeamStyles are the ways the edges between tiles can be treated
+var SeamStyles = []string{SeamNone, SeamFeather, SeamGrout}
+
+// Defaults for the width and colour of seams which don't give them
+const (
+	DefaultFeatherWidth = 16
+	DefaultGroutWidth   = 4
+	DefaultGroutColour  = "#ffffff"
+)
+
+// Seam is how the edges where tiles meet are treated when the composite is
+// rendered. Saved tiles are never changed by it.
+type Seam struct {
+	Style string `json:"style"`
+	// Width is the overlap blended across by SeamFeather, or the width of
+	// the line drawn by SeamGrout, in pixels
+	Width int `json:"width"`
+	// Colour is the colour of grout lines, as #rrggbb
+	Colour string `json:"colour,omitempty"`
+}
+
+// SeamError is returned for a seam treatment which can't be applied
+type SeamError struct {
+	Reason string
+}
+
+func (e *SeamError) Error() string {
+	return e.Reason
+}
+
+// NewSeam checks a seam treatment, filling in the default width and colour
+// for its style if they aren't given. It returns nil for SeamNone or no
+// style, and problems as a *SeamError.
+func NewSeam(style string, width int, colour string) (*Seam, error) {
+	if style == "" || style == SeamNone {
+		return nil, nil
+	}
+	if width < 0 || width > 256 {
+		return nil, &SeamError{fmt.Sprintf("seam width must be from 1 to 256 pixels, not %d", width)}
+	}
+
+	seam := &Seam{Style: style, Width: width}
+	switch style {
+	case SeamFeather:
+		if seam.Width == 0 {
+			seam.Width = DefaultFeatherWidth
+		}
+		if seam.Width < 2 {
+			return nil, &SeamError{"feathered seams must be at least 2 pixels wide"}
+		}
+	case SeamGrout:
+		if seam.Width == 0 {
+			seam.Width = DefaultGroutWidth
+		}
+		seam.Colour = colour
+		if seam.Colour == "" {
+			seam.Colour = DefaultGroutColour
+		}
+		if _, err := parseColour(seam.Colour); err != nil {
+			return nil, &SeamError{err.Error()}
+		}
+	default:
+		return nil, &SeamError{fmt.Sprintf("seam style must be one of %v, not %s", SeamStyles, style)}
+	}
+	return seam, nil
+}
+
+// parseColour reads a colour written as #rrggbb
+func parseColour(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 0xff}
+	var rest string
+	n, _ := fmt.Sscanf(s, "#%02x%02x%02x%s", &c.R, &c.G, &c.B, &rest)
+	if n != 3 || len(s) != 7 {
+		return c, errors.Errorf("colour must be written as #rrggbb, not %q", s)
+	}
+	return c, nil
+}
+
+// SetSeam changes how the edges between the instance's tiles are treated,
+// seam is nil to leave them hard, and restitches the composite with it
+func (i *Instance) SetSeam(seam *Seam) error {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return err
+	}
+	if i.State == StateArchived {
+		return ErrArchived
+	}
+	i.Seam = seam
+	// restitching saves the instance with the new treatment
+	err = i.stitch()
+	if err != nil {
+		return errors.Wrap(err, "Couldn't update instance stitch image")
+	}
+	return nil
+}
+
+// edge is a stretch of the line where two tiles meet. At is the x of a
+// vertical edge or the y of a horizontal one, From and To are how far it
+// runs along it.
+type edge struct {
+	vertical bool
+	at       int
+	from, to int
+}
+
+// edges finds where the tiles of a layout meet side by side or one above
+// the other. Tiles which overlap don't have an edge between them.
+func edges(layout tile.Layout) []edge {
+	found := []edge{}
+	for _, a := range layout {
+		for _, b := range layout {
+			if a.Bounds.Max.X == b.Bounds.Min.X {
+				from, to := max(a.Bounds.Min.Y, b.Bounds.Min.Y), min(a.Bounds.Max.Y, b.Bounds.Max.Y)
+				if from < to {
+					found = append(found, edge{vertical: true, at: a.Bounds.Max.X, from: from, to: to})
+				}
+			}
+			if a.Bounds.Max.Y == b.Bounds.Min.Y {
+				from, to := max(a.Bounds.Min.X, b.Bounds.Min.X), min(a.Bounds.Max.X, b.Bounds.Max.X)
+				if from < to {
+					found = append(found, edge{at: a.Bounds.Max.Y, from: from, to: to})
+				}
+			}
+		}
+	}
+	return found
+}
+
+// treatSeams applies the instance's seam treatment to its composite
+func (i *Instance) treatSeams(composite *image.RGBA) {
+	if i.Seam == nil {
+		return
+	}
+	found := edges(i.Regions())
+	switch i.Seam.Style {
+	case SeamFeather:
+		// vertical edges are blended first so that the corners where edges
+		// cross are blended both ways
+		featherEdges(composite, found, i.Seam.Width, true)
+		featherEdges(composite, found, i.Seam.Width, false)
+	case SeamGrout:
+		colour, _ := parseColour(i.Seam.Colour)
+		groutEdges(composite, found, i.Seam.Width, colour)
+	}
+}
+
+// featherEdges blends across the vertical or horizontal edges in img. Over
+// width pixels centred on each edge the tile before it fades into the tile
+// after it. Neither tile has pixels beyond the edge so each is mirrored
+// across it.
+func featherEdges(img *image.RGBA, found []edge, width int, vertical bool) {
+	before := image.NewRGBA(img.Rect)
+	copy(before.Pix, img.Pix)
+
+	half := width / 2
+	for _, e := range found {
+		if e.vertical != vertical {
+			continue
+		}
+		for along := e.from; along < e.to; along++ {
+			for across := e.at - half; across < e.at+half; across++ {
+				// the share of the tile after the edge, rising from near 0
+				// to near 1 across the overlap
+				share := (float64(across-e.at+half) + 0.5) / float64(2*half)
+				beforeAt, afterAt := across, across
+				if across >= e.at {
+					beforeAt = 2*e.at - 1 - across
+				} else {
+					afterAt = 2*e.at - 1 - across
+				}
+
+				point, a, b := image.Pt(across, along), image.Pt(beforeAt, along), image.Pt(afterAt, along)
+				if !vertical {
+					point, a, b = image.Pt(along, across), image.Pt(along, beforeAt), image.Pt(along, afterAt)
+				}
+				if !point.In(img.Rect) || !a.In(img.Rect) || !b.In(img.Rect) {
+					continue
+				}
+
+				dst := img.Pix[img.PixOffset(point.X, point.Y):]
+				pa := before.Pix[before.PixOffset(a.X, a.Y):]
+				pb := before.Pix[before.PixOffset(b.X, b.Y):]
+				for c := 0; c < 4; c++ {
+					dst[c] = uint8(float64(pa[c])*(1-share) + float64(pb[c])*share + 0.5)
+				}
+			}
+		}
+	}
+}
+
+// groutEdges draws a line of colour width pixels wide centred on each edge
+func groutEdges(img *image.RGBA, found []edge, width int, colour color.RGBA) {
+	src := image.NewUniform(colour)
+	for _, e := range found {
+		line := image.Rect(e.at-width/2, e.from, e.at-width/2+width, e.to)
+		if !e.vertical {
+			line = image.Rect(e.from, e.at-width/2, e.to, e.at-width/2+width)
+		}
+		draw.Draw(img, line, src, image.Point{}, draw.Src)
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,136 @@
+package instance_test
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// grey is the colour of the test source
+var grey = color.NRGBA{200, 200, 200, 255}
+
+// fillTiles draws every tile of inst in the colour chosen for its location
+func fillTiles(t *testing.T, inst *instance.Instance, colour func(location tile.Location) color.Color) {
+	t.Helper()
+	for _, region := range inst.Regions() {
+		bounds := region.Bounds
+		submit(t, inst, region.Location, encodePNG(t, bounds.Dx(), bounds.Dy(), colour(region.Location)))
+	}
+}
+
+// pixel is the colour expected at a point of a composite
+type pixel struct {
+	x, y int
+	want color.Color
+}
+
+// checkPixels compares the composite of inst with the pixels expected,
+// allowing for JPEG compression
+func checkPixels(t *testing.T, inst *instance.Instance, pixels []pixel) {
+	t.Helper()
+	img := composite(t, inst)
+	for _, p := range pixels {
+		if got := img.At(p.x, p.y); !sameColour(got, p.want, 24) {
+			t.Errorf("composite at %d,%d is %v, want %v", p.x, p.y, got, p.want)
+		}
+	}
+}
+
+func setSeam(t *testing.T, inst *instance.Instance, style string, width int, colour string) {
+	t.Helper()
+	seam, err := instance.NewSeam(style, width, colour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.SetSeam(seam)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroutSeams(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 3, 3)
+	fillTiles(t, inst, func(tile.Location) color.Color { return color.Black })
+	setSeam(t, inst, instance.SeamGrout, 4, "#ffffff")
+
+	checkPixels(t, inst, []pixel{
+		// lines are centred on the edges between tiles
+		{19, 10, color.White},
+		{20, 10, color.White},
+		{10, 40, color.White},
+		{20, 20, color.White},
+		{14, 10, color.Black},
+		{10, 45, color.Black},
+		// the outside of the composite isn't an edge between tiles
+		{0, 10, color.Black},
+		{59, 10, color.Black},
+		{10, 0, color.Black},
+		{10, 59, color.Black},
+		{59, 59, color.Black},
+	})
+}
+
+func TestFeatherSeams(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 3, 3)
+	// the left column is black and the rest white
+	fillTiles(t, inst, func(location tile.Location) color.Color {
+		if location.X == 0 {
+			return color.Black
+		}
+		return color.White
+	})
+	setSeam(t, inst, instance.SeamFeather, 8, "")
+
+	img := composite(t, inst)
+	// across the edge at x=20 the black tile fades into the white one
+	last := -1
+	for x := 15; x < 25; x++ {
+		r, _, _, _ := img.At(x, 10).RGBA()
+		if int(r) < last-0x800 {
+			t.Errorf("feather darkens at %d,10", x)
+		}
+		last = int(r)
+	}
+	checkPixels(t, inst, []pixel{
+		{19, 10, color.Gray{0x70}},
+		{20, 10, color.Gray{0x90}},
+		{12, 10, color.Black},
+		{28, 10, color.White},
+		// tiles of the same colour blend into themselves
+		{40, 10, color.White},
+		// pixels on the outside of the composite are left as they were,
+		// including along the edges where the feather meets the border
+		{0, 0, color.Black},
+		{0, 59, color.Black},
+		{59, 0, color.White},
+		{19, 0, color.Gray{0x70}},
+		{19, 59, color.Gray{0x70}},
+	})
+}
+
+func TestSeamsAtGridEdge(t *testing.T) {
+	// a grid offset from the corner leaves some of the source uncovered
+	inst := newTestInstance(t, 60, 60, 1, 1)
+	fillTiles(t, inst, func(tile.Location) color.Color { return grey })
+	err := inst.StartRound(instance.RoundOptions{Cols: 3, Rows: 3, OffsetX: 10, OffsetY: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillTiles(t, inst, func(tile.Location) color.Color { return color.Black })
+	setSeam(t, inst, instance.SeamGrout, 4, "#ffffff")
+
+	// the tiles are 16 pixels square, from 10 to 58
+	checkPixels(t, inst, []pixel{
+		{26, 20, color.White},
+		{42, 20, color.White},
+		{20, 26, color.White},
+		// the edges of the grid aren't between tiles
+		{11, 20, color.Black},
+		{56, 20, color.Black},
+		{20, 56, color.Black},
+		{5, 20, grey},
+		{20, 5, grey},
+	})
+}
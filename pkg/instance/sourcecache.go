@@ -0,0 +1,237 @@
+package instance
+
+import (
+	"container/list"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SourceCacheBytes is the memory used to keep decoded source images, and the
+// areas of them under each tile, between renders. Nothing is kept if it is
+// zero.
+var SourceCacheBytes int64 = 512 << 20
+
+// sourceCache holds decoded images up to SourceCacheBytes, discarding the
+// least recently used when it is full. It works like rendition.Cache but
+// images which are being decoded are only decoded once, however many renders
+// are waiting for them.
+type sourceCache struct {
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+	decodes map[string]*sourceDecode
+}
+
+type sourceEntry struct {
+	key  string
+	img  image.Image
+	size int64
+}
+
+// sourceDecode is an image being decoded for a key, done is closed once img
+// or err is set
+type sourceDecode struct {
+	done chan struct{}
+	img  image.Image
+	err  error
+}
+
+// sources is shared by every instance. Keys start with the instance ID.
+var sources = &sourceCache{
+	order:   list.New(),
+	entries: make(map[string]*list.Element),
+	decodes: make(map[string]*sourceDecode),
+}
+
+// get returns the image cached under key, or calls decode to produce it and
+// caches the result. The image is shared so it must not be drawn on.
+func (c *sourceCache) get(key string, decode func() (image.Image, error)) (image.Image, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		img := e.Value.(*sourceEntry).img
+		c.mu.Unlock()
+		return img, nil
+	}
+	if d, ok := c.decodes[key]; ok {
+		c.mu.Unlock()
+		<-d.done
+		return d.img, d.err
+	}
+	d := &sourceDecode{done: make(chan struct{})}
+	c.decodes[key] = d
+	c.mu.Unlock()
+
+	d.img, d.err = decode()
+
+	c.mu.Lock()
+	delete(c.decodes, key)
+	if d.err == nil {
+		c.add(key, d.img)
+	}
+	c.mu.Unlock()
+	close(d.done)
+	return d.img, d.err
+}
+
+// peek returns the image cached under key without decoding it if it isn't
+func (c *sourceCache) peek(key string) (image.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*sourceEntry).img, true
+}
+
+// add caches img under key, the caller must hold mu
+func (c *sourceCache) add(key string, img image.Image) {
+	size := imageBytes(img)
+	if size > SourceCacheBytes {
+		return
+	}
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&sourceEntry{key, img, size})
+	c.size += size
+
+	for c.size > SourceCacheBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *sourceCache) remove(e *list.Element) {
+	en := c.order.Remove(e).(*sourceEntry)
+	delete(c.entries, en.key)
+	c.size -= en.size
+}
+
+// invalidate discards every image whose key starts with prefix
+func (c *sourceCache) invalidate(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+		}
+	}
+}
+
+// imageBytes is roughly how much memory a decoded image takes
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	case *image.Paletted:
+		return int64(len(img.Pix))
+	}
+	b := img.Bounds()
+	return int64(b.Dx()) * int64(b.Dy()) * 4
+}
+
+// sourceKey is what the instance's source image is cached under. It changes
+// whenever the source does, so that an image decoded from an earlier source
+// is never used. ok is false if the source can't be read.
+func (i *Instance) sourceKey() (string, bool) {
+	info, err := os.Stat(i.SourceImagePath)
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%v/%s@%d", i.ID, i.SourceImagePath, info.ModTime().UnixNano()), true
+}
+
+// readSourceImage returns the decoded source image, which is kept in sources
+// after it has been decoded once. It is shared so it must not be drawn on.
+func (i *Instance) readSourceImage() (image.Image, error) {
+	key, ok := i.sourceKey()
+	if !ok {
+		return i.decodeSourceImage()
+	}
+	return sources.get(key, i.decodeSourceImage)
+}
+
+// sourceCropKey is what the area of the source image within bounds is cached
+// under. It is keyed off the piece cut by cutSource if there is one, so that
+// it can be read without the original source, otherwise off the source. ok
+// is false if neither can be read.
+func (i *Instance) sourceCropKey(bounds image.Rectangle) (string, bool) {
+	piecePath := i.sourceTilePath(bounds)
+	if info, err := os.Stat(piecePath); err == nil {
+		return fmt.Sprintf("%v/%s@%d", i.ID, piecePath, info.ModTime().UnixNano()), true
+	}
+	key, ok := i.sourceKey()
+	if !ok {
+		return "", false
+	}
+	return key + "/" + bounds.String(), true
+}
+
+// sourceCrop returns the area of the source image within bounds, which is
+// kept in sources so that the tile there can be rendered again without the
+// whole source. It is read from the piece cut by cutSource if there is one.
+// It is shared so it must not be drawn on.
+func (i *Instance) sourceCrop(bounds image.Rectangle) (image.Image, error) {
+	key, ok := i.sourceCropKey(bounds)
+	if !ok {
+		return i.readSourceCrop(bounds)
+	}
+	return sources.get(key, func() (image.Image, error) {
+		return i.readSourceCrop(bounds)
+	})
+}
+
+// streamSourceCrop is sourceCrop for renders which pass over every tile once,
+// such as the composite. It uses the cached crop if there is one but doesn't
+// cache the crops it reads, which would push out those kept for sessions.
+func (i *Instance) streamSourceCrop(bounds image.Rectangle) (image.Image, error) {
+	if key, ok := i.sourceCropKey(bounds); ok {
+		if crop, ok := sources.peek(key); ok {
+			return crop, nil
+		}
+	}
+	return i.readSourceCrop(bounds)
+}
+
+// readSourceCrop reads the piece of the source within bounds, only decoding
+// the whole source to crop it if there isn't one
+func (i *Instance) readSourceCrop(bounds image.Rectangle) (image.Image, error) {
+	piece, err := i.readSourceTile(bounds)
+	if !os.IsNotExist(err) {
+		return piece, err
+	}
+	return i.cropSourceImage(bounds)
+}
+
+// cropSourceImage cuts the area within bounds from the whole source image,
+// for instances made before sources were cut into pieces or imported
+func (i *Instance) cropSourceImage(bounds image.Rectangle) (image.Image, error) {
+	source, err := i.readSourceImage()
+	if err != nil {
+		return nil, err
+	}
+	crop := image.NewRGBA(bounds.Intersect(source.Bounds()))
+	draw.Draw(crop, crop.Bounds(), source, crop.Bounds().Min, draw.Src)
+	return crop, nil
+}
+
+// forgetSource discards the decoded source images of the instance, once its
+// source has changed or it has been deleted
+func (i *Instance) forgetSource() {
+	sources.invalidate(i.ID.String() + "/")
+}
@@ -0,0 +1,123 @@
+package instance
+
+import (
+	"container/list"
+	"fmt"
+	"image"
+	"sync"
+	"testing"
+)
+
+func newSourceCache() *sourceCache {
+	return &sourceCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		decodes: make(map[string]*sourceDecode),
+	}
+}
+
+func useSourceCacheBytes(t *testing.T, size int64) {
+	previous := SourceCacheBytes
+	SourceCacheBytes = size
+	t.Cleanup(func() { SourceCacheBytes = previous })
+}
+
+func TestSourceCacheEviction(t *testing.T) {
+	// each image is 4 bytes
+	useSourceCacheBytes(t, 10)
+	c := newSourceCache()
+	decodes := 0
+	get := func(key string, width int) {
+		_, err := c.get(key, func() (image.Image, error) {
+			decodes++
+			return image.NewGray(image.Rect(0, 0, width, 1)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("1/a", 4)
+	get("1/b", 4)
+	get("1/a", 4)
+	// b is the least recently used, so it makes room for c
+	get("2/c", 4)
+	get("1/a", 4)
+	if decodes != 3 {
+		t.Errorf("decoded %d times, want a kept", decodes)
+	}
+	get("1/b", 4)
+	if decodes != 4 {
+		t.Errorf("decoded %d times, want b decoded again", decodes)
+	}
+
+	// anything larger than the whole cache is never kept
+	get("1/huge", 11)
+	get("1/huge", 11)
+	if decodes != 6 {
+		t.Errorf("decoded %d times, want huge decoded each time", decodes)
+	}
+
+	// only the images of instance 1 are discarded
+	get("2/c", 4)
+	c.invalidate("1/")
+	get("1/b", 4)
+	get("2/c", 4)
+	if decodes != 8 || c.size != 8 {
+		t.Errorf("decoded %d times holding %d bytes, want only b decoded again", decodes, c.size)
+	}
+
+	_, err := c.get("1/failed", func() (image.Image, error) { return nil, fmt.Errorf("no") })
+	if err == nil {
+		t.Error("decode error wasn't returned")
+	}
+	if _, ok := c.entries["1/failed"]; ok {
+		t.Error("failed decode was cached")
+	}
+}
+
+func TestSourceCacheDecodesOnce(t *testing.T) {
+	useSourceCacheBytes(t, 1<<20)
+	c := newSourceCache()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	decodes := 0
+	decode := func() (image.Image, error) {
+		mu.Lock()
+		decodes++
+		mu.Unlock()
+		<-release
+		return image.NewGray(image.Rect(0, 0, 10, 10)), nil
+	}
+
+	const renders = 8
+	var wg sync.WaitGroup
+	images := make(chan image.Image, renders)
+	for n := 0; n < renders; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			img, err := c.get("source", decode)
+			if err != nil {
+				t.Error(err)
+			}
+			images <- img
+		}()
+	}
+	close(release)
+	wg.Wait()
+	close(images)
+
+	if decodes != 1 {
+		t.Errorf("%d renders decoded the source %d times", renders, decodes)
+	}
+	var first image.Image
+	for img := range images {
+		if first == nil {
+			first = img
+		}
+		if img != first {
+			t.Error("renders were given different images")
+		}
+	}
+}
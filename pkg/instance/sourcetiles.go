@@ -0,0 +1,182 @@
+package instance
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/atomicfile"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// sourceTilesPath is the folder holding the source image cut into pieces for
+// the current round, see cutSource
+func (i *Instance) sourceTilesPath() string {
+	return path.Join(i.Path(), "source-tiles", strconv.Itoa(i.Round))
+}
+
+// sourceTilePath is where the piece of the source image within bounds is
+// kept
+func (i *Instance) sourceTilePath(bounds image.Rectangle) string {
+	return path.Join(i.sourceTilesPath(), fmt.Sprintf("%d,%d-%d,%d.png", bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y))
+}
+
+// sourcePieces are the areas the source image is cut into: the bounds of
+// each tile, and whatever of the image no tile covers
+func (i *Instance) sourcePieces() []image.Rectangle {
+	area := image.Rect(0, 0, i.SourceImageWidth, i.SourceImageHeight)
+	pieces := []image.Rectangle{}
+	seen := make(map[image.Rectangle]bool)
+	for _, region := range i.Regions() {
+		bounds := region.Bounds.Intersect(area)
+		if !bounds.Empty() && !seen[bounds] {
+			seen[bounds] = true
+			pieces = append(pieces, bounds)
+		}
+	}
+	return append(pieces, uncovered(area, pieces)...)
+}
+
+// uncovered returns rectangles making up the parts of area which aren't in
+// any of covered. The area is sliced at the top and bottom of every covered
+// rectangle and the gaps in each slice are merged with the same gap in the
+// slice above.
+func uncovered(area image.Rectangle, covered []image.Rectangle) []image.Rectangle {
+	ys := []int{area.Min.Y, area.Max.Y}
+	for _, r := range covered {
+		r = r.Intersect(area)
+		if !r.Empty() {
+			ys = append(ys, r.Min.Y, r.Max.Y)
+		}
+	}
+	sort.Ints(ys)
+
+	gaps := []image.Rectangle{}
+	// open are the gaps of the slice above, which may carry on into this one
+	open := []int{}
+	for n := 1; n < len(ys); n++ {
+		top, bottom := ys[n-1], ys[n]
+		if top == bottom {
+			continue
+		}
+
+		spans := []image.Rectangle{}
+		for _, r := range covered {
+			if r.Min.Y <= top && r.Max.Y >= bottom {
+				spans = append(spans, r.Intersect(area))
+			}
+		}
+		sort.Slice(spans, func(a, b int) bool { return spans[a].Min.X < spans[b].Min.X })
+
+		row := []image.Rectangle{}
+		x := area.Min.X
+		for _, span := range spans {
+			if span.Min.X > x {
+				row = append(row, image.Rect(x, top, span.Min.X, bottom))
+			}
+			x = max(x, span.Max.X)
+		}
+		if x < area.Max.X {
+			row = append(row, image.Rect(x, top, area.Max.X, bottom))
+		}
+
+		next := []int{}
+		for _, gap := range row {
+			merged := false
+			for _, g := range open {
+				if gaps[g].Min.X == gap.Min.X && gaps[g].Max.X == gap.Max.X && gaps[g].Max.Y == top {
+					gaps[g].Max.Y = bottom
+					next = append(next, g)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				gaps = append(gaps, gap)
+				next = append(next, len(gaps)-1)
+			}
+		}
+		open = next
+	}
+	return gaps
+}
+
+// cutSource saves the source image in pieces, one for each tile and more for
+// anything between them, so that composites and tiles can be rendered
+// without the whole of a very large source. Pieces cut for an earlier round
+// are left for the caller to remove once the round has started. The whole
+// source has to be decoded once to cut it.
+func (i *Instance) cutSource() error {
+	source, err := i.decodeSourceImage()
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(i.sourceTilesPath())
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove old source tiles")
+	}
+	err = os.MkdirAll(i.sourceTilesPath(), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create source tiles folder")
+	}
+
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	pieces := i.sourcePieces()
+	for _, bounds := range pieces {
+		piece := image.NewRGBA(bounds)
+		draw.Draw(piece, bounds, source, bounds.Min, draw.Src)
+
+		writer, err := atomicfile.Create(i.sourceTilePath(bounds), 0644)
+		if err != nil {
+			return errors.Wrap(err, "Couldn't open source tile for writing")
+		}
+		err = encoder.Encode(writer, piece)
+		if err == nil {
+			err = writer.Commit()
+		}
+		writer.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save source tile %v", bounds)
+		}
+	}
+	log.Infof("Cut source image of instance %v into %d pieces", i.ID, len(pieces))
+	return nil
+}
+
+// readSourceTile decodes the piece of the source image within bounds cut by
+// cutSource. An error satisfying os.IsNotExist is returned if there isn't a
+// piece with exactly those bounds.
+func (i *Instance) readSourceTile(bounds image.Rectangle) (image.Image, error) {
+	reader, err := os.Open(i.sourceTilePath(bounds))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	img, err := png.Decode(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode source tile %v", bounds)
+	}
+	if img.Bounds().Size() != bounds.Size() {
+		return nil, errors.Errorf("Source tile %v is %v", bounds, img.Bounds().Size())
+	}
+
+	// PNGs don't keep where they were in the source, they always start at 0,0
+	switch img := img.(type) {
+	case *image.RGBA:
+		img.Rect = bounds
+		return img, nil
+	case *image.NRGBA:
+		img.Rect = bounds
+		return img, nil
+	}
+	moved := image.NewRGBA(bounds)
+	draw.Draw(moved, bounds, img, img.Bounds().Min, draw.Src)
+	return moved, nil
+}
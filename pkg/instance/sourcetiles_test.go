@@ -0,0 +1,177 @@
+package instance_test
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// TestRenderWithoutSource checks that tiles and the composite are rendered
+// from the pieces cut from the source once the source itself has gone
+func TestRenderWithoutSource(t *testing.T) {
+	useTempData(t)
+	// the grid leaves the right and bottom edges of the source uncovered
+	inst, err := instance.NewWithOptions(instance.Options{SourceImagePath: writeTestSource(t, 64, 44), Cols: 3, Rows: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := tile.Location{X: 1, Y: 0}
+	submit(t, inst, location, encodePNG(t, 21, 22, color.Black))
+
+	err = os.Remove(inst.SourceImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, region := range inst.Regions() {
+		tl, err := inst.Tile(region.Location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := inst.RenderTile(tl)
+		if err != nil {
+			t.Fatalf("rendering tile %v: %v", region.Location, err)
+		}
+		if img.Bounds() != region.Bounds {
+			t.Errorf("tile %v rendered as %v, want %v", region.Location, img.Bounds(), region.Bounds)
+		}
+	}
+
+	err = inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, inst, []pixel{
+		{30, 10, color.Black},
+		{10, 10, grey},
+		// the edges are cut into pieces of their own
+		{63, 10, grey},
+		{10, 43, grey},
+		{63, 43, grey},
+	})
+}
+
+// TestStartRoundCutsSource checks that each round is rendered from pieces
+// cut from its own source, and the previous round's are removed
+func TestStartRoundCutsSource(t *testing.T) {
+	inst := completeTestInstance(t)
+	err := inst.StartRound(instance.RoundOptions{Cols: 3, Rows: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pieces, err := filepath.Glob(filepath.Join(inst.Path(), "source-tiles", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pieces) != 1 || filepath.Base(pieces[0]) != "2" {
+		t.Errorf("source is cut for rounds %v", pieces)
+	}
+
+	err = os.Remove(inst.SourceImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := inst.Tile(tile.Location{X: 2, Y: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := inst.RenderTile(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second round is drawn over the first round's black tiles
+	if got := img.At(50, 50); !sameColour(got, color.Black, 24) {
+		t.Errorf("second round source is %v", got)
+	}
+}
+
+// TestSeamsAcrossBands puts the edge between two tiles on the boundary
+// between bands of the composite, which are rendered separately
+func TestSeamsAcrossBands(t *testing.T) {
+	// bands start where tiles do, the edge is at 608
+	inst := newTestInstance(t, 40, 1216, 1, 2)
+	fillTiles(t, inst, func(location tile.Location) color.Color {
+		if location.Y == 0 {
+			return color.Black
+		}
+		return color.White
+	})
+
+	setSeam(t, inst, instance.SeamGrout, 4, "#ff0000")
+	red := color.NRGBA{255, 0, 0, 255}
+	checkPixels(t, inst, []pixel{
+		{20, 603, color.Black},
+		{20, 606, red},
+		{20, 607, red},
+		{20, 608, red},
+		{20, 609, red},
+		{20, 612, color.White},
+		// a band also breaks at 512, away from any edge
+		{20, 511, color.Black},
+		{20, 512, color.Black},
+	})
+
+	setSeam(t, inst, instance.SeamFeather, 8, "")
+	img := composite(t, inst)
+	last := -1
+	for y := 600; y < 616; y++ {
+		r, _, _, _ := img.At(20, y).RGBA()
+		if int(r) < last-0x800 {
+			t.Errorf("feather darkens at 20,%d", y)
+		}
+		last = int(r)
+	}
+	if r, _, _, _ := img.At(20, 607).RGBA(); r < 0x4000 || r > 0xc000 {
+		t.Errorf("feather is %#x at 20,607, just above the band boundary", r)
+	}
+	if r, _, _, _ := img.At(20, 608).RGBA(); r < 0x4000 || r > 0xc000 {
+		t.Errorf("feather is %#x at 20,608, just below the band boundary", r)
+	}
+}
+
+// TestSourcePiecesCover checks the pieces a source is cut into for layouts
+// which leave parts of it uncovered
+func TestSourcePiecesCover(t *testing.T) {
+	useTempData(t)
+	tests := []struct {
+		name    string
+		options instance.Options
+	}{
+		{"uneven grid", instance.Options{Cols: 7, Rows: 4}},
+		{"brick", instance.Options{Cols: 3, Rows: 3, Pattern: instance.PatternBrick}},
+		{"sparse layout", instance.Options{Layout: tile.Layout{
+			{Name: "sun", Bounds: image.Rect(40, 0, 60, 20)},
+			{Name: "boat", Bounds: image.Rect(5, 25, 25, 40)},
+		}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.SourceImagePath = writeTestSource(t, 61, 43)
+			inst, err := instance.NewWithOptions(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.Remove(inst.SourceImagePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// every pixel of the composite is drawn from a piece
+			err = inst.StitchSessionImage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			img := composite(t, inst)
+			for y := 0; y < 43; y += 3 {
+				for x := 0; x < 61; x += 3 {
+					if got := img.At(x, y); !sameColour(got, grey, 24) {
+						t.Fatalf("%d,%d is %v", x, y, got)
+					}
+				}
+			}
+		})
+	}
+}
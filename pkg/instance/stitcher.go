@@ -0,0 +1,194 @@
+package instance
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// StitchDelay is how long the composite waits after a tile is saved before
+// it is restitched. Every tile saved in the meantime is rendered into the
+// same composite version.
+var StitchDelay = 2 * time.Second
+
+// Stitched is called with the ID of an instance each time a new version of
+// its composite has been written, if it is set. Anything kept from the
+// previous composite can be dropped from then on.
+var Stitched func(id uuid.UUID)
+
+// CompositeStatus is how up to date the composite of an instance is
+type CompositeStatus struct {
+	// Version is the composite version which has been rendered
+	Version int `json:"compositeVersion"`
+	// Pending is the composite version which will show the tiles saved
+	// since, zero if there are none
+	Pending int `json:"pendingCompositeVersion,omitempty"`
+}
+
+// stitcher restitches the composite of one instance in the background
+type stitcher struct {
+	// scheduled is set while the worker is waiting out StitchDelay
+	scheduled bool
+	// running is set while the worker goroutine is alive
+	running bool
+	// delay is the StitchDelay in force when the stitch was scheduled
+	delay time.Duration
+	// stitched is closed and replaced whenever the worker has rendered
+	stitched chan struct{}
+}
+
+// stitchers holds a stitcher for each instance whose composite has been
+// scheduled or waited for by this process, kept by ID like locks
+var stitchers = struct {
+	sync.Mutex
+	byID map[uuid.UUID]*stitcher
+}{byID: make(map[uuid.UUID]*stitcher)}
+
+// stitcherFor returns the stitcher of an instance, the caller must hold
+// stitchers
+func stitcherFor(id uuid.UUID) *stitcher {
+	s, ok := stitchers.byID[id]
+	if !ok {
+		s = &stitcher{stitched: make(chan struct{})}
+		stitchers.byID[id] = s
+	}
+	return s
+}
+
+// CompositeStatus returns the version of the composite and the version which
+// will show any tiles saved since it was rendered
+func (i *Instance) CompositeStatus() CompositeStatus {
+	return CompositeStatus{Version: i.CompositeVersion, Pending: i.PendingCompositeVersion}
+}
+
+// StitchPending reports whether tiles have been saved which aren't in the
+// composite yet
+func (i *Instance) StitchPending() bool {
+	return i.PendingCompositeVersion > i.CompositeVersion
+}
+
+// scheduleStitch restitches the composite in the background once StitchDelay
+// has passed, unless it is already due to be
+func (i *Instance) scheduleStitch() {
+	stitchers.Lock()
+	defer stitchers.Unlock()
+	s := stitcherFor(i.ID)
+	if s.scheduled {
+		return
+	}
+	s.scheduled = true
+	s.delay = StitchDelay
+	if !s.running {
+		s.running = true
+		go runStitcher(i.ID, s)
+	}
+}
+
+// runStitcher restitches the composite of an instance each time it is
+// scheduled, until nothing more is
+func runStitcher(id uuid.UUID, s *stitcher) {
+	for {
+		stitchers.Lock()
+		delay := s.delay
+		stitchers.Unlock()
+		time.Sleep(delay)
+
+		stitchers.Lock()
+		s.scheduled = false
+		stitchers.Unlock()
+
+		err := stitchPending(id)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "Failed to restitch composite of instance %v", id))
+		}
+
+		stitchers.Lock()
+		close(s.stitched)
+		s.stitched = make(chan struct{})
+		if !s.scheduled {
+			s.running = false
+			stitchers.Unlock()
+			return
+		}
+		stitchers.Unlock()
+	}
+}
+
+// stitchPending restitches the composite of an instance if tiles have been
+// saved since it was last rendered. Saves which come in while it is
+// rendering are left for the next one.
+func stitchPending(id uuid.UUID) error {
+	inst, err := Open(id.String())
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	defer inst.lock()()
+	err = inst.refresh()
+	if err != nil {
+		return err
+	}
+	if !inst.StitchPending() {
+		return nil
+	}
+	return inst.stitch()
+}
+
+// ResumeStitches schedules the composites of every instance with tiles saved
+// since it was last rendered, which were left pending when the process that
+// saved them stopped
+func ResumeStitches() error {
+	instances, err := List()
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if i.StitchPending() {
+			log.Infof("Resuming pending stitch of instance %v", i.ID)
+			i.scheduleStitch()
+		}
+	}
+	return nil
+}
+
+// WaitForComposite waits until the composite has been rendered at version or
+// later, or until ctx is done. The instance is reloaded with the composite
+// version it reached. Only composites rendered by this process are noticed
+// before the instance is loaded again.
+func (i *Instance) WaitForComposite(ctx context.Context, version int) error {
+	for {
+		// taken before loading so that a render in between isn't missed
+		stitchers.Lock()
+		stitched := stitcherFor(i.ID).stitched
+		stitchers.Unlock()
+
+		err := i.load()
+		if err != nil {
+			return err
+		}
+		if i.CompositeVersion >= version {
+			return nil
+		}
+
+		select {
+		case <-stitched:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// forgetStitcher drops the stitcher of an instance which has been deleted
+func (i *Instance) forgetStitcher() {
+	stitchers.Lock()
+	if s, ok := stitchers.byID[i.ID]; ok && !s.running {
+		delete(stitchers.byID, i.ID)
+	}
+	stitchers.Unlock()
+}
@@ -0,0 +1,164 @@
+package instance_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/google/uuid"
+)
+
+// TestStitched checks that whatever is kept from the composite is only told
+// to go once the version showing the saved tile has been written
+func TestStitched(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+
+	versions := make(chan int, 1)
+	instance.Stitched = func(id uuid.UUID) {
+		saved, err := instance.Open(id.String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		versions <- saved.CompositeVersion
+	}
+	t.Cleanup(func() { instance.Stitched = nil })
+
+	location := tile.Location{X: 2, Y: 1}
+	s, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.UpdateTile(location, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := inst.PendingCompositeVersion
+	if pending != inst.CompositeVersion+1 {
+		t.Fatalf("saving a tile left composite version %d pending", pending)
+	}
+	select {
+	case version := <-versions:
+		if version != pending {
+			t.Errorf("composite was version %d when it was stitched, want %d", version, pending)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("composite was never stitched")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = inst.WaitForComposite(ctx, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.CompositeVersion != pending || inst.StitchPending() {
+		t.Errorf("composite is version %d once version %d was waited for", inst.CompositeVersion, pending)
+	}
+}
+
+// TestCoalescedStitches saves several tiles before the stitcher wakes and
+// checks that they all go into one composite version
+func TestCoalescedStitches(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	instance.StitchDelay = 100 * time.Millisecond
+	before := inst.CompositeVersion
+
+	for x := 0; x < 3; x++ {
+		location := tile.Location{X: x}
+		s, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = inst.UpdateTile(location, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.PendingCompositeVersion != before+1 {
+			t.Errorf("tile %d is pending in composite version %d, want %d", x, inst.PendingCompositeVersion, before+1)
+		}
+	}
+	waitForComposite(t, inst)
+	if inst.CompositeVersion != before+1 {
+		t.Errorf("three saves made %d composite versions", inst.CompositeVersion-before)
+	}
+	img := composite(t, inst)
+	for x := 0; x < 3; x++ {
+		if got := img.At(x*10+5, 5); !sameColour(got, color.Black, 24) {
+			t.Errorf("tile %d is drawn as %v", x, got)
+		}
+	}
+}
+
+// TestResumeStitches leaves a stitch pending as a process which stopped
+// before its stitcher woke would, and checks that it is picked up again
+func TestResumeStitches(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	recordPath := filepath.Join(inst.Path(), "instance")
+	data, err := ioutil.ReadFile(recordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record["pendingCompositeVersion"] = inst.CompositeVersion + 1
+	data, err = json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(recordPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = instance.ResumeStitches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst.PendingCompositeVersion = inst.CompositeVersion + 1
+	waitForComposite(t, inst)
+	if inst.StitchPending() {
+		t.Errorf("composite is version %d with version %d pending", inst.CompositeVersion, inst.PendingCompositeVersion)
+	}
+}
+
+// TestStartRoundStitchesPending starts a round before the stitcher has
+// woken and checks that the round's composite shows every tile
+func TestStartRoundStitchesPending(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 2, 2)
+	instance.StitchDelay = time.Hour
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			location := tile.Location{X: x, Y: y}
+			s, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 30, 30, color.Black)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = inst.UpdateTile(location, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !inst.StitchPending() {
+		t.Fatal("tiles were stitched before the stitcher woke")
+	}
+
+	err := inst.StartRound(instance.RoundOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := composite(t, inst).At(45, 45); !sameColour(got, color.Black, 24) {
+		t.Errorf("round composite shows %v where the last tile was drawn", got)
+	}
+}
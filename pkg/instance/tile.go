@@ -0,0 +1,173 @@
+package instance
+
+import (
+	"encoding/json"
+	"github.com/andrewmyhre/donk-server/pkg/atomicfile"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+func (i *Instance) tilesPath() string {
+	return path.Join(i.Path(), "tiles")
+}
+
+func (i *Instance) tilePath(location tile.Location) string {
+	return path.Join(i.tilesPath(), location.String())
+}
+
+// HasTile reports whether the instance's layout has a tile at location
+func (i *Instance) HasTile(location tile.Location) bool {
+	return i.Regions().Find(location) != nil
+}
+
+// TileBounds returns the region of the source image covered by the tile at
+// location, which is empty if the layout doesn't have one there
+func (i *Instance) TileBounds(location tile.Location) image.Rectangle {
+	region := i.Regions().Find(location)
+	if region == nil {
+		return image.Rectangle{}
+	}
+	return region.Bounds
+}
+
+// Tile loads the record of saved versions for the tile at location. A tile
+// which has never been drawn is returned with no versions.
+func (i *Instance) Tile(location tile.Location) (*tile.Tile, error) {
+	t := &tile.Tile{
+		Location: location,
+	}
+
+	filePath := path.Join(i.tilePath(location), "tile")
+	if _, err := os.Stat(filePath); err != nil {
+		return t, nil
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load tile file")
+	}
+
+	err = json.Unmarshal(data, t)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshall tile data file")
+	}
+	return t, nil
+}
+
+func (i *Instance) saveTile(t *tile.Tile) error {
+	filePath := path.Join(i.tilePath(t.Location), "tile")
+	json, _ := json.MarshalIndent(t, "", " ")
+	err := atomicfile.WriteFile(filePath, json, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write json to file")
+	}
+
+	return nil
+}
+
+func (i *Instance) readTileVersion(location tile.Location, version tile.Version) (image.Image, error) {
+	reader, err := os.Open(path.Join(i.tilePath(location), version.Filename()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open contribution")
+	}
+	defer reader.Close()
+
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode contribution")
+	}
+	return img, nil
+}
+
+// drawTile composites the saved versions of t over dst, which should already
+// hold the source image for the tile's region
+func (i *Instance) drawTile(dst draw.Image, t *tile.Tile) {
+	bounds := i.TileBounds(t.Location)
+	for _, version := range t.Layers() {
+		img, err := i.readTileVersion(t.Location, version)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		draw.Draw(dst, bounds, img, img.Bounds().Min, draw.Over)
+	}
+}
+
+// RenderTile returns the tile as it appears in the composite: the source
+// image with every contributing version drawn over it
+func (i *Instance) RenderTile(t *tile.Tile) (image.Image, error) {
+	bounds := i.TileBounds(t.Location)
+	source, err := i.sourceCrop(bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := image.NewRGBA(bounds)
+	draw.Draw(rendered, bounds, source, bounds.Min, draw.Src)
+	i.drawTile(rendered, t)
+
+	return rendered, nil
+}
+
+// PruneTileVersions removes versions of each tile beyond the most recent
+// KeepTileVersions. Versions which still show through a later transparent
+// one are kept however old they are. It returns how many versions were
+// removed and the bytes that freed, or with dryRun how many would have been.
+func (i *Instance) PruneTileVersions(dryRun bool) (int, int64, error) {
+	if i.KeepTileVersions < 1 {
+		return 0, 0, nil
+	}
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pruned, freed := 0, int64(0)
+	for _, region := range i.Regions() {
+		t, err := i.Tile(region.Location)
+		if err != nil {
+			return pruned, freed, errors.Wrap(err, "Couldn't load tile")
+		}
+
+		cut := len(t.Versions) - i.KeepTileVersions
+		// versions beneath the layers are covered by an opaque one
+		if hidden := len(t.Versions) - len(t.Layers()); hidden < cut {
+			cut = hidden
+		}
+		if cut <= 0 {
+			continue
+		}
+
+		for _, version := range t.Versions[:cut] {
+			versionPath := path.Join(i.tilePath(t.Location), version.Filename())
+			if info, err := os.Stat(versionPath); err == nil {
+				freed += info.Size()
+			}
+			if !dryRun {
+				err := os.Remove(versionPath)
+				if err != nil && !os.IsNotExist(err) {
+					return pruned, freed, errors.Wrap(err, "Failed to remove tile version")
+				}
+			}
+			pruned++
+		}
+		if dryRun {
+			continue
+		}
+
+		t.Versions = t.Versions[cut:]
+		err = i.saveTile(t)
+		if err != nil {
+			return pruned, freed, errors.Wrap(err, "Couldn't save tile data")
+		}
+		log.Infof("Pruned %d versions of tile %v of instance %v", cut, t.Location, i.ID)
+	}
+	return pruned, freed, nil
+}
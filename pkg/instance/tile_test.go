@@ -0,0 +1,115 @@
+package instance_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// TestTransparentTiles saves an opaque tile, a partly transparent one over
+// it and then another opaque one, checking what shows through each time
+func TestTransparentTiles(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	location := tile.Location{X: 1, Y: 1}
+	red, blue, green := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}, color.NRGBA{0, 255, 0, 255}
+
+	submit(t, inst, location, encodePNG(t, 10, 10, red))
+
+	// the left half is transparent
+	half := fill(10, 10, blue)
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 5; x++ {
+			half.Set(x, y, color.NRGBA{})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, half)
+	submit(t, inst, location, buf.Bytes())
+
+	drawn, err := inst.Tile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, err := inst.RenderTile(drawn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rendered.At(12, 15); !sameColour(got, red, 0) {
+		t.Errorf("transparent half shows %v, want the version beneath it", got)
+	}
+	if got := rendered.At(17, 15); !sameColour(got, blue, 0) {
+		t.Errorf("opaque half shows %v, want the new version", got)
+	}
+
+	buf.Reset()
+	jpeg.Encode(&buf, fill(10, 10, green), nil)
+	submit(t, inst, location, buf.Bytes())
+
+	saved, err := inst.Tile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []tile.Version{{Number: 1, Format: "png", Opaque: true}, {Number: 2, Format: "png"}, {Number: 3, Format: "jpeg", Opaque: true}}
+	if len(saved.Versions) != len(want) {
+		t.Fatalf("tile has %d versions, want %d", len(saved.Versions), len(want))
+	}
+	for n, version := range saved.Versions {
+		if version.Number != want[n].Number || version.Format != want[n].Format || version.Opaque != want[n].Opaque {
+			t.Errorf("version %d is %+v, want %+v", n+1, version, want[n])
+		}
+		if _, err := os.Stat(path.Join(inst.Path(), "tiles", location.String(), version.Filename())); err != nil {
+			t.Error(err)
+		}
+	}
+	if layers := saved.Layers(); len(layers) != 1 || layers[0].Number != 3 {
+		t.Errorf("tile is rendered from %v, want only the last opaque version", layers)
+	}
+
+	composite, err := inst.GetStitchedImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(composite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.At(15, 15); !sameColour(got, green, 16) {
+		t.Errorf("composite shows %v in the tile, want the last version", got)
+	}
+	if got := img.At(35, 15); !sameColour(got, color.NRGBA{200, 200, 200, 255}, 16) {
+		t.Errorf("composite shows %v where no tile was drawn, want the source", got)
+	}
+}
+
+func TestUpdateTileRejects(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	location := tile.Location{X: 0, Y: 0}
+	for name, data := range map[string][]byte{
+		"not an image": []byte("hello"),
+		"truncated":    encodePNG(t, 10, 10, color.Black)[:40],
+		"wrong size":   encodePNG(t, 10, 11, color.Black),
+	} {
+		_, err := inst.ReadTileImage(location, bytes.NewReader(data))
+		if _, ok := err.(*tile.ValidationError); !ok {
+			t.Errorf("%s: got %v, want a validation error", name, err)
+		}
+	}
+	_, err := inst.ReadTileImage(tile.Location{X: 6, Y: 0}, bytes.NewReader(encodePNG(t, 10, 10, color.Black)))
+	if _, ok := err.(*tile.ValidationError); !ok {
+		t.Errorf("saving outside the grid: got %v, want a validation error", err)
+	}
+	saved, err := inst.Tile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Versions) != 0 {
+		t.Errorf("rejected images were saved as %d versions", len(saved.Versions))
+	}
+}
@@ -0,0 +1,317 @@
+package instance
+
+import (
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Palettes are the ways colours can be chosen for timelapse frames:
+//
+//	plan9, websafe: fixed palettes from image/color/palette
+//	adaptive: the most common colours in the source and current composite
+var Palettes = []string{"plan9", "websafe", "adaptive"}
+
+// TimelapseVariants is how many timelapses rendered with different options
+// are kept for an instance. The least recently opened are removed first.
+var TimelapseVariants = 8
+
+// TimelapseOptions describe how a timelapse is rendered
+type TimelapseOptions struct {
+	// Scale is the size of the timelapse relative to the source image
+	Scale float64
+	// Delay is how long each frame is shown
+	Delay time.Duration
+	// Bucket groups the tile saves made within each period into a single
+	// frame. If it is zero every save gets a frame of its own.
+	Bucket  time.Duration
+	Palette string
+	Dither  bool
+}
+
+// String identifies the options in the names of rendered timelapses
+func (o TimelapseOptions) String() string {
+	return fmt.Sprintf("s%g-d%d-b%d-%s-%t", o.Scale, o.Delay.Milliseconds(), int64(o.Bucket.Seconds()), o.Palette, o.Dither)
+}
+
+// timelapseEvent is the save of a single tile version
+type timelapseEvent struct {
+	tile    *tile.Tile
+	version int
+}
+
+func (e timelapseEvent) created() time.Time {
+	return e.tile.Versions[e.version].Created
+}
+
+func (i *Instance) timelapsePath() string {
+	return path.Join(i.Path(), "timelapse")
+}
+
+func (i *Instance) timelapseFilename(options TimelapseOptions) string {
+	return path.Join(i.timelapsePath(), fmt.Sprintf("%d-%s.gif", i.CompositeVersion, options))
+}
+
+// OpenTimelapse opens the timelapse rendered with options for the current
+// version of the composite. The error satisfies os.IsNotExist if it hasn't
+// been rendered yet.
+func (i *Instance) OpenTimelapse(options TimelapseOptions) (*os.File, error) {
+	filename := i.timelapseFilename(options)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	// the modification time records when it was last used, so that
+	// SaveTimelapse keeps the ones still being asked for
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+	return f, nil
+}
+
+// SaveTimelapse renders a timelapse of the instance with options, to be
+// opened with OpenTimelapse. Timelapses of earlier composite versions are
+// removed, as are the least recently used of the current version beyond
+// TimelapseVariants.
+func (i *Instance) SaveTimelapse(options TimelapseOptions) error {
+	timelapsePath := i.timelapsePath()
+	if _, err := os.Stat(timelapsePath); err != nil && os.IsNotExist(err) {
+		err := os.MkdirAll(timelapsePath, 0755)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create timelapse folder")
+		}
+	}
+
+	f, err := ioutil.TempFile(timelapsePath, "render-")
+	if err != nil {
+		return errors.Wrap(err, "Couldn't create timelapse file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	anim, err := i.renderTimelapse(options)
+	if err != nil {
+		return err
+	}
+	err = gif.EncodeAll(f, anim)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode timelapse")
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "Failed to write timelapse")
+	}
+
+	filename := i.timelapseFilename(options)
+	err = os.Rename(f.Name(), filename)
+	if err != nil {
+		return errors.Wrap(err, "Failed to save timelapse")
+	}
+	log.Infof("Saved %s", filename)
+
+	previous, err := ioutil.ReadDir(timelapsePath)
+	if err != nil {
+		return nil
+	}
+	current := fmt.Sprintf("%d-", i.CompositeVersion)
+	var kept []os.FileInfo
+	for _, p := range previous {
+		switch {
+		case strings.HasPrefix(p.Name(), "render-"):
+		case strings.HasPrefix(p.Name(), current):
+			kept = append(kept, p)
+		default:
+			os.Remove(path.Join(timelapsePath, p.Name()))
+		}
+	}
+	sort.Slice(kept, func(a, b int) bool {
+		return kept[a].ModTime().After(kept[b].ModTime())
+	})
+	for n, p := range kept {
+		if n >= TimelapseVariants && path.Join(timelapsePath, p.Name()) != filename {
+			os.Remove(path.Join(timelapsePath, p.Name()))
+		}
+	}
+
+	return nil
+}
+
+// renderTimelapse animates the composite from the bare source image through
+// every saved tile version in the order they were saved. Each frame after
+// the first only covers the tiles which changed. The source is read in the
+// pieces cut by cutSource, so only the scaled frames are ever whole.
+func (i *Instance) renderTimelapse(options TimelapseOptions) (*gif.GIF, error) {
+	events := make([]timelapseEvent, 0)
+	for _, region := range i.Regions() {
+		t, err := i.Tile(region.Location)
+		if err != nil {
+			log.Warn(errors.Wrap(err, "failed to load contribution"))
+			continue
+		}
+		for n := range t.Versions {
+			events = append(events, timelapseEvent{t, n})
+		}
+	}
+	sort.SliceStable(events, func(a, b int) bool {
+		return events[a].created().Before(events[b].created())
+	})
+
+	scaled := func(r image.Rectangle) image.Rectangle {
+		return image.Rect(
+			int(float64(r.Min.X)*options.Scale), int(float64(r.Min.Y)*options.Scale),
+			int(float64(r.Max.X)*options.Scale), int(float64(r.Max.Y)*options.Scale))
+	}
+
+	canvas := image.NewRGBA(scaled(image.Rect(0, 0, i.SourceImageWidth, i.SourceImageHeight)))
+	err := scaleStream(canvas, i.newSourceStream())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render source image")
+	}
+
+	framePalette, err := i.timelapsePalette(options, canvas)
+	if err != nil {
+		return nil, err
+	}
+
+	delay := int(options.Delay / (10 * time.Millisecond))
+	anim := &gif.GIF{}
+	addFrame := func(r image.Rectangle) {
+		frame := image.NewPaletted(r, framePalette)
+		if options.Dither {
+			draw.FloydSteinberg.Draw(frame, r, canvas, r.Min)
+		} else {
+			draw.Draw(frame, r, canvas, r.Min, draw.Src)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+	addFrame(canvas.Bounds())
+
+	for start := 0; start < len(events); {
+		end := start + 1
+		if options.Bucket > 0 {
+			bucket := events[start].created().Truncate(options.Bucket)
+			for end < len(events) && events[end].created().Truncate(options.Bucket).Equal(bucket) {
+				end++
+			}
+		}
+
+		changed := image.Rectangle{}
+		for _, event := range events[start:end] {
+			bounds := i.TileBounds(event.tile.Location)
+			source, err := i.sourceCrop(bounds)
+			if err != nil {
+				return nil, err
+			}
+			rendered := image.NewRGBA(bounds)
+			draw.Draw(rendered, bounds, source, bounds.Min, draw.Src)
+			i.drawTile(rendered, &tile.Tile{
+				Location: event.tile.Location,
+				Versions: event.tile.Versions[:event.version+1],
+			})
+
+			r := scaled(bounds)
+			draw.CatmullRom.Scale(canvas, r, rendered, bounds, draw.Src, nil)
+			changed = changed.Union(r)
+		}
+		if !changed.Empty() {
+			addFrame(changed)
+		}
+		start = end
+	}
+
+	// linger on the finished picture before looping
+	anim.Delay[len(anim.Delay)-1] = delay * 4
+	return anim, nil
+}
+
+func (i *Instance) timelapsePalette(options TimelapseOptions, first image.Image) (color.Palette, error) {
+	switch options.Palette {
+	case "websafe":
+		return palette.WebSafe, nil
+	case "adaptive":
+		last := image.NewRGBA(first.Bounds())
+		err := scaleStream(last, i.newCompositeStream())
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to render composite")
+		}
+		return adaptivePalette(first, last), nil
+	default:
+		return palette.Plan9, nil
+	}
+}
+
+// scaleStream draws the whole of c scaled to fill dst, a band at a time
+func scaleStream(dst *image.RGBA, c *compositeStream) error {
+	to, from := dst.Bounds(), c.Bounds()
+	if from.Empty() {
+		return nil
+	}
+	for n := 0; n+1 < len(c.bands); n++ {
+		c.render(c.bands[n])
+		rows := image.Rect(from.Min.X, c.top, from.Max.X, c.bottom)
+		r := image.Rect(
+			to.Min.X, to.Min.Y+(c.top-from.Min.Y)*to.Dy()/from.Dy(),
+			to.Max.X, to.Min.Y+(c.bottom-from.Min.Y)*to.Dy()/from.Dy())
+		if !r.Empty() {
+			draw.CatmullRom.Scale(dst, r, c.band, rows, draw.Src, nil)
+		}
+	}
+	return c.Err()
+}
+
+// adaptivePalette picks the 256 most common colours in the images, after
+// reducing them to 5 bits per channel so that similar colours are counted
+// together
+func adaptivePalette(images ...image.Image) color.Palette {
+	type bin struct {
+		count   int
+		r, g, b int
+	}
+	bins := make(map[uint16]*bin)
+	for _, img := range images {
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				key := uint16(r>>11)<<10 | uint16(g>>11)<<5 | uint16(b>>11)
+				if bins[key] == nil {
+					bins[key] = &bin{}
+				}
+				bins[key].count++
+				bins[key].r += int(r >> 8)
+				bins[key].g += int(g >> 8)
+				bins[key].b += int(b >> 8)
+			}
+		}
+	}
+
+	sorted := make([]*bin, 0, len(bins))
+	for _, b := range bins {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].count > sorted[b].count
+	})
+	if len(sorted) > 256 {
+		sorted = sorted[:256]
+	}
+
+	p := make(color.Palette, len(sorted))
+	for n, b := range sorted {
+		p[n] = color.RGBA{uint8(b.r / b.count), uint8(b.g / b.count), uint8(b.b / b.count), 0xff}
+	}
+	return p
+}
@@ -0,0 +1,116 @@
+package instance_test
+
+import (
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// TestTimelapse renders a timelapse from the pieces cut from the source,
+// which is removed first
+func TestTimelapse(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	saves := []tile.Location{{X: 0, Y: 0}, {X: 2, Y: 1}, {X: 0, Y: 0}}
+	for _, location := range saves {
+		submit(t, inst, location, encodePNG(t, 10, 10, color.Black))
+	}
+	err := os.Remove(inst.SourceImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, palette := range instance.Palettes {
+		options := instance.TimelapseOptions{Scale: 0.5, Delay: 100 * time.Millisecond, Palette: palette}
+		err := inst.SaveTimelapse(options)
+		if err != nil {
+			t.Fatalf("%s: %v", palette, err)
+		}
+		f, err := inst.OpenTimelapse(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		anim, err := gif.DecodeAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(anim.Image) != len(saves)+1 {
+			t.Errorf("%s: %d frames, want %d", palette, len(anim.Image), len(saves)+1)
+			continue
+		}
+		if got, want := anim.Image[0].Bounds(), image.Rect(0, 0, 30, 30); got != want {
+			t.Errorf("%s: first frame is %v, want %v", palette, got, want)
+		}
+		if got, want := anim.Image[2].Bounds(), image.Rect(10, 5, 15, 10); got != want {
+			t.Errorf("%s: frame of tile 2,1 is %v, want %v", palette, got, want)
+		}
+		r, g, b, _ := anim.Image[0].At(15, 15).RGBA()
+		if r>>8 < 150 || g>>8 < 150 || b>>8 < 150 {
+			t.Errorf("%s: source is drawn as %v", palette, anim.Image[0].At(15, 15))
+		}
+		r, g, b, _ = anim.Image[1].At(2, 2).RGBA()
+		if r>>8 > 50 || g>>8 > 50 || b>>8 > 50 {
+			t.Errorf("%s: tile 0,0 is drawn as %v", palette, anim.Image[1].At(2, 2))
+		}
+	}
+}
+
+// TestTimelapseVariants checks that only the most recently used timelapses
+// are kept
+func TestTimelapseVariants(t *testing.T) {
+	inst := newTestInstance(t, 60, 60, 6, 6)
+	previous := instance.TimelapseVariants
+	instance.TimelapseVariants = 2
+	t.Cleanup(func() { instance.TimelapseVariants = previous })
+
+	delays := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	options := make([]instance.TimelapseOptions, len(delays))
+	for n, delay := range delays {
+		options[n] = instance.TimelapseOptions{Scale: 0.1, Delay: delay, Palette: "plan9"}
+	}
+	save := func(options instance.TimelapseOptions) {
+		err := inst.SaveTimelapse(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// opening the first after the second is saved leaves the second as the
+	// least recently used when the third is saved
+	save(options[0])
+	save(options[1])
+	f, err := inst.OpenTimelapse(options[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	time.Sleep(10 * time.Millisecond)
+	save(options[2])
+
+	for n, want := range []bool{true, false, true} {
+		f, err := inst.OpenTimelapse(options[n])
+		if err == nil {
+			f.Close()
+		}
+		if kept := err == nil; kept != want {
+			t.Errorf("timelapse with delay %v kept is %t, want %t", delays[n], kept, want)
+		}
+	}
+	files, err := ioutil.ReadDir(path.Join(inst.Path(), "timelapse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Errorf("%d timelapses are kept, want 2", len(files))
+	}
+}
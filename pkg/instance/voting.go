@@ -0,0 +1,355 @@
+package instance
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/atomicfile"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// ErrNotCompetitive is returned when voting on an instance which isn't in
+// ModeCompetitive
+var ErrNotCompetitive = errors.New("Instance is not competitive")
+
+// ErrNoCandidate is returned for a candidate which doesn't exist
+var ErrNoCandidate = errors.New("Candidate not found")
+
+// ErrInvalidBallot is returned when voting with a ballot which wasn't issued
+// for the instance
+var ErrInvalidBallot = errors.New("Ballot was not issued for this instance")
+
+// candidatesPath is where the candidates for a tile in a voting round are
+// kept, with the tiles of the round it was held in
+func (i *Instance) candidatesPath(location tile.Location, round int) string {
+	tilesPath := i.tilesPath()
+	if earlier := i.votingRoundOf(round); earlier != nil {
+		tilesPath = path.Join(i.roundPath(earlier.Number), "tiles")
+	}
+	return path.Join(tilesPath, location.String(), "candidates", strconv.Itoa(round))
+}
+
+// startVotingRound makes round the current voting round. It is saved with
+// the instance.
+func (i *Instance) startVotingRound(round int) {
+	i.VotingRound = round
+	i.VotingCloses = time.Time{}
+	if i.VotingPeriod > 0 {
+		i.VotingCloses = time.Now().UTC().Add(i.VotingPeriod)
+	}
+}
+
+// VotingDue reports whether the current voting round has run for its
+// VotingPeriod and should be closed
+func (i *Instance) VotingDue() bool {
+	return i.Mode == ModeCompetitive && i.State != StateArchived && !i.VotingCloses.IsZero() && time.Now().After(i.VotingCloses)
+}
+
+// Candidates loads the candidates submitted for the tile at location during a
+// voting round. A round nobody submitted to is returned with no candidates.
+func (i *Instance) Candidates(location tile.Location, round int) (*tile.Round, error) {
+	r := &tile.Round{
+		Location:   location,
+		Number:     round,
+		Candidates: []tile.Candidate{},
+	}
+
+	data, err := ioutil.ReadFile(path.Join(i.candidatesPath(location, round), "round"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, errors.Wrap(err, "Failed to load round file")
+	}
+
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshall round data file")
+	}
+	return r, nil
+}
+
+func (i *Instance) saveRound(r *tile.Round) error {
+	roundPath := i.candidatesPath(r.Location, r.Number)
+	err := os.MkdirAll(roundPath, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create path for round")
+	}
+
+	json, _ := json.MarshalIndent(r, "", " ")
+	err = atomicfile.WriteFile(path.Join(roundPath, "round"), json, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write round data file")
+	}
+	return nil
+}
+
+// addCandidate saves a submission as a candidate for the tile at location in
+// the current voting round
+func (i *Instance) addCandidate(location tile.Location, submission *tile.Submission) (*tile.Candidate, error) {
+	r, err := i.Candidates(location, i.VotingRound)
+	if err != nil {
+		return nil, err
+	}
+
+	candidate := tile.Candidate{
+		Number:      len(r.Candidates) + 1,
+		Format:      submission.Format,
+		Opaque:      true,
+		Created:     time.Now().UTC(),
+		Metadata:    submission.Metadata,
+		Contributor: submission.Contributor,
+	}
+	if o, ok := submission.Image.(interface{ Opaque() bool }); ok {
+		candidate.Opaque = o.Opaque()
+	}
+
+	roundPath := i.candidatesPath(location, i.VotingRound)
+	err = os.MkdirAll(roundPath, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create path for round")
+	}
+	candidatePath := path.Join(roundPath, candidate.Filename())
+	err = atomicfile.WriteFile(candidatePath, submission.Data, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't write candidate image")
+	}
+	log.Infof("Saved %s", candidatePath)
+
+	r.Candidates = append(r.Candidates, candidate)
+	err = i.saveRound(r)
+	if err != nil {
+		return nil, err
+	}
+	return &candidate, nil
+}
+
+// ReadCandidate returns a candidate of a voting round and its encoded image.
+// ErrNoCandidate is returned if there isn't one numbered n.
+func (i *Instance) ReadCandidate(location tile.Location, round int, n int) (*tile.Candidate, []byte, error) {
+	r, err := i.Candidates(location, round)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidate := r.Candidate(n)
+	if candidate == nil {
+		return nil, nil, ErrNoCandidate
+	}
+
+	data, err := ioutil.ReadFile(path.Join(i.candidatesPath(location, round), candidate.Filename()))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to read candidate image")
+	}
+	return candidate, data, nil
+}
+
+// hashBallot is how a ballot is recorded, so that neither the issued ballots
+// nor the votes cast with them can be used to vote
+func hashBallot(ballot string) string {
+	hash := sha256.Sum256([]byte(ballot))
+	return hex.EncodeToString(hash[:])
+}
+
+func (i *Instance) ballotsPath() string {
+	return path.Join(i.Path(), "ballots")
+}
+
+// issuedBallots loads the hashes of the ballots issued for the instance
+func (i *Instance) issuedBallots() ([]string, error) {
+	issued := []string{}
+	data, err := ioutil.ReadFile(i.ballotsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return issued, nil
+		}
+		return nil, errors.Wrap(err, "Failed to load ballots file")
+	}
+	err = json.Unmarshal(data, &issued)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to unmarshall ballots file")
+	}
+	return issued, nil
+}
+
+// IssueBallots makes count new ballots for voting on a competitive
+// instance. A ballot holds one vote for each tile in every round. The
+// ballots are only returned here, the instance keeps their hashes.
+func (i *Instance) IssueBallots(count int) ([]string, error) {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return nil, err
+	}
+	if i.Mode != ModeCompetitive {
+		return nil, ErrNotCompetitive
+	}
+	if count < 1 {
+		return nil, errors.Errorf("Can't issue %d ballots", count)
+	}
+
+	issued, err := i.issuedBallots()
+	if err != nil {
+		return nil, err
+	}
+	ballots := make([]string, count)
+	for n := range ballots {
+		token := make([]byte, 16)
+		_, err := rand.Read(token)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to make ballot")
+		}
+		ballots[n] = hex.EncodeToString(token)
+		issued = append(issued, hashBallot(ballots[n]))
+	}
+
+	json, _ := json.MarshalIndent(issued, "", " ")
+	err = atomicfile.WriteFile(i.ballotsPath(), json, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to write ballots file")
+	}
+	log.Infof("Issued %d ballots for instance %v", count, i.ID)
+	return ballots, nil
+}
+
+// Vote casts ballot for candidate n of the tile at location in the current
+// voting round. Each ballot is one vote per tile, casting it again moves the
+// vote to the new candidate. ErrInvalidBallot is returned for a ballot which
+// wasn't issued by IssueBallots.
+func (i *Instance) Vote(location tile.Location, n int, ballot string) error {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return err
+	}
+	if i.Mode != ModeCompetitive {
+		return ErrNotCompetitive
+	}
+	if i.State == StateArchived {
+		return ErrArchived
+	}
+
+	r, err := i.Candidates(location, i.VotingRound)
+	if err != nil {
+		return err
+	}
+	if r.Candidate(n) == nil {
+		return ErrNoCandidate
+	}
+
+	issued, err := i.issuedBallots()
+	if err != nil {
+		return err
+	}
+	hash := hashBallot(ballot)
+	valid := false
+	for _, h := range issued {
+		valid = valid || h == hash
+	}
+	if ballot == "" || !valid {
+		return ErrInvalidBallot
+	}
+
+	if r.Ballots == nil {
+		r.Ballots = make(map[string]int)
+	}
+	r.Ballots[hash] = n
+	return i.saveRound(r)
+}
+
+// CloseVotingRound promotes the leading candidate of each tile to be its
+// next version, restitches the composite and starts the next voting round.
+// Tiles whose candidates got no votes are left as they were. Tiles whose
+// round was already closed, by an attempt which failed part way, are
+// skipped, so closing again doesn't promote their winners twice. It returns
+// how many tiles were changed.
+func (i *Instance) CloseVotingRound() (int, error) {
+	defer i.lock()()
+	err := i.refresh()
+	if err != nil {
+		return 0, err
+	}
+	if i.Mode != ModeCompetitive {
+		return 0, ErrNotCompetitive
+	}
+	if i.State == StateArchived {
+		return 0, ErrArchived
+	}
+
+	promoted := 0
+	for _, region := range i.Regions() {
+		location := region.Location
+		r, err := i.Candidates(location, i.VotingRound)
+		if err != nil {
+			return promoted, err
+		}
+		if len(r.Candidates) == 0 || r.Closed {
+			continue
+		}
+
+		if winner := r.Leader(); winner != nil {
+			candidate := fmt.Sprintf("%d/%d", r.Number, winner.Number)
+			t, err := i.Tile(location)
+			if err != nil {
+				return promoted, errors.Wrap(err, "Couldn't load tile")
+			}
+			// the winner may have been promoted by an attempt which failed
+			// before the round was saved
+			if latest := t.Latest(); latest == nil || latest.Metadata["candidate"] != candidate {
+				err = i.promote(location, winner, candidate)
+				if err != nil {
+					return promoted, err
+				}
+			}
+			r.Winner = winner.Number
+			promoted++
+		}
+		r.Closed = true
+		err = i.saveRound(r)
+		if err != nil {
+			return promoted, err
+		}
+	}
+
+	log.Infof("Closed voting round %d of instance %v, %d tiles changed", i.VotingRound, i.ID, promoted)
+	i.startVotingRound(i.VotingRound + 1)
+	// restitching saves the instance with the next round
+	err = i.stitch()
+	if err != nil {
+		return promoted, errors.Wrap(err, "Couldn't update instance stitch image")
+	}
+	return promoted, nil
+}
+
+// promote saves a winning candidate as the next version of the tile at
+// location, recording which candidate it was in its metadata
+func (i *Instance) promote(location tile.Location, winner *tile.Candidate, candidate string) error {
+	data, err := ioutil.ReadFile(path.Join(i.candidatesPath(location, i.VotingRound), winner.Filename()))
+	if err != nil {
+		return errors.Wrap(err, "Failed to read winning candidate")
+	}
+	metadata := make(map[string]string, len(winner.Metadata)+1)
+	for k, v := range winner.Metadata {
+		metadata[k] = v
+	}
+	metadata["candidate"] = candidate
+	err = i.addVersion(location, tile.Version{
+		Format:      winner.Format,
+		Opaque:      winner.Opaque,
+		Created:     time.Now().UTC(),
+		Metadata:    metadata,
+		Contributor: winner.Contributor,
+	}, data)
+	if err != nil {
+		return errors.Wrap(err, "Failed to promote winning candidate")
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package instance_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// newCompetitiveInstance creates a competitive instance of 20x20 tiles
+func newCompetitiveInstance(t *testing.T) *instance.Instance {
+	t.Helper()
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath: writeTestSource(t, 60, 60),
+		Cols:            3,
+		Rows:            3,
+		Mode:            instance.ModeCompetitive,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// issue issues count ballots for inst
+func issue(t *testing.T, inst *instance.Instance, count int) []string {
+	t.Helper()
+	ballots, err := inst.IssueBallots(count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ballots
+}
+
+// vote casts a ballot for candidate n of the tile at location
+func vote(t *testing.T, inst *instance.Instance, location tile.Location, n int, ballot string) {
+	t.Helper()
+	err := inst.Vote(location, n, ballot)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// versions returns the candidate each version of a tile was promoted from
+func versions(t *testing.T, inst *instance.Instance, location tile.Location) []string {
+	t.Helper()
+	tl, err := inst.Tile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	promoted := []string{}
+	for _, v := range tl.Versions {
+		promoted = append(promoted, v.Metadata["candidate"])
+	}
+	return promoted
+}
+
+func TestVote(t *testing.T) {
+	useTempData(t)
+	inst := newCompetitiveInstance(t)
+	location := tile.Location{X: 1, Y: 1}
+	for _, c := range []color.Color{color.Black, color.White} {
+		submit(t, inst, location, encodePNG(t, 20, 20, c))
+	}
+	ballots := issue(t, inst, 2)
+	other := newCompetitiveInstance(t)
+	elsewhere := issue(t, other, 1)
+
+	for name, ballot := range map[string]string{
+		"no ballot":                 "",
+		"made up ballot":            "00000000000000000000000000000000",
+		"another instance's ballot": elsewhere[0],
+		"hash of an issued ballot":  hashOf(t, inst, ballots[0]),
+	} {
+		if err := inst.Vote(location, 1, ballot); err != instance.ErrInvalidBallot {
+			t.Errorf("voting with %s returned %v", name, err)
+		}
+	}
+	if err := inst.Vote(location, 3, ballots[0]); err != instance.ErrNoCandidate {
+		t.Errorf("voting for a missing candidate returned %v", err)
+	}
+
+	// casting a ballot again moves its vote rather than adding one
+	vote(t, inst, location, 1, ballots[0])
+	vote(t, inst, location, 2, ballots[0])
+	vote(t, inst, location, 2, ballots[0])
+	vote(t, inst, location, 1, ballots[1])
+	round, err := inst.Candidates(location, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if votes := round.Tally(); votes[1] != 1 || votes[2] != 1 {
+		t.Errorf("tallied %v", votes)
+	}
+	for hash := range round.Ballots {
+		if hash == ballots[0] || hash == ballots[1] {
+			t.Error("round records the ballots themselves")
+		}
+	}
+
+	// ballots issued later are added to those already issued
+	more := issue(t, inst, 1)
+	vote(t, inst, location, 1, more[0])
+	vote(t, inst, location, 1, ballots[1])
+
+	latest := newTestInstance(t, 60, 60, 3, 3)
+	if _, err := latest.IssueBallots(1); err != instance.ErrNotCompetitive {
+		t.Errorf("issuing ballots for a latest instance returned %v", err)
+	}
+}
+
+// hashOf returns the recorded hash of a ballot, by casting it on a tile of
+// its own
+func hashOf(t *testing.T, inst *instance.Instance, ballot string) string {
+	t.Helper()
+	location := tile.Location{X: 2, Y: 2}
+	submit(t, inst, location, encodePNG(t, 20, 20, color.Black))
+	vote(t, inst, location, 1, ballot)
+	round, err := inst.Candidates(location, inst.VotingRound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hash := range round.Ballots {
+		return hash
+	}
+	t.Fatal("ballot wasn't recorded")
+	return ""
+}
+
+func TestCloseVotingRound(t *testing.T) {
+	useTempData(t)
+	inst := newCompetitiveInstance(t)
+	ballots := issue(t, inst, 3)
+	contested := tile.Location{X: 0, Y: 0}
+	tied := tile.Location{X: 1, Y: 0}
+	ignored := tile.Location{X: 2, Y: 0}
+	for _, location := range []tile.Location{contested, tied, ignored} {
+		for _, c := range []color.Color{color.Black, color.White} {
+			submit(t, inst, location, encodePNG(t, 20, 20, c))
+		}
+	}
+	vote(t, inst, contested, 1, ballots[0])
+	vote(t, inst, contested, 2, ballots[1])
+	vote(t, inst, contested, 2, ballots[2])
+	vote(t, inst, tied, 2, ballots[0])
+	vote(t, inst, tied, 1, ballots[1])
+
+	promoted, err := inst.CloseVotingRound()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted != 2 || inst.VotingRound != 2 {
+		t.Errorf("promoted %d tiles and moved on to round %d", promoted, inst.VotingRound)
+	}
+	tests := []struct {
+		location tile.Location
+		want     []string
+	}{
+		{contested, []string{"1/2"}},
+		// ties go to whichever was submitted first
+		{tied, []string{"1/1"}},
+		{ignored, []string{}},
+	}
+	for _, test := range tests {
+		got := versions(t, inst, test.location)
+		if len(got) != len(test.want) || (len(got) > 0 && got[0] != test.want[0]) {
+			t.Errorf("%v has versions from candidates %v, want %v", test.location, got, test.want)
+		}
+	}
+
+	// ballots carry over to the next round
+	submit(t, inst, contested, encodePNG(t, 20, 20, color.Black))
+	vote(t, inst, contested, 1, ballots[0])
+	promoted, err = inst.CloseVotingRound()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := versions(t, inst, contested); promoted != 1 || len(got) != 2 || got[1] != "2/1" {
+		t.Errorf("second round promoted %d tiles, %v has versions from candidates %v", promoted, contested, got)
+	}
+}
+
+func TestCloseVotingRoundAgain(t *testing.T) {
+	useTempData(t)
+	inst := newCompetitiveInstance(t)
+	ballot := issue(t, inst, 1)[0]
+	// tiles are closed by row, so the first is promoted before the second
+	// fails
+	first := tile.Location{X: 0, Y: 0}
+	second := tile.Location{X: 1, Y: 0}
+	third := tile.Location{X: 2, Y: 0}
+	for _, location := range []tile.Location{first, second, third} {
+		submit(t, inst, location, encodePNG(t, 20, 20, color.Black))
+		vote(t, inst, location, 1, ballot)
+	}
+	candidatesPath := func(location tile.Location) string {
+		return filepath.Join(inst.Path(), "tiles", location.String(), "candidates", "1")
+	}
+	moved := filepath.Join(instance.DataPath, "candidate.png")
+	err := os.Rename(filepath.Join(candidatesPath(second), "1.png"), moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := inst.CloseVotingRound(); err == nil {
+		t.Fatal("closed a round with a missing candidate")
+	}
+	reopened, err := instance.Open(inst.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.VotingRound != 1 {
+		t.Fatalf("failed close moved on to round %d", reopened.VotingRound)
+	}
+	if got := versions(t, reopened, first); len(got) != 1 {
+		t.Fatalf("first tile has versions from candidates %v before trying again", got)
+	}
+
+	// as if the first tile's version was saved but its round wasn't
+	roundFile := filepath.Join(candidatesPath(first), "round")
+	data, err := ioutil.ReadFile(roundFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	round := tile.Round{}
+	err = json.Unmarshal(data, &round)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !round.Closed {
+		t.Fatal("first tile's round wasn't closed")
+	}
+	round.Closed, round.Winner = false, 0
+	data, _ = json.Marshal(round)
+	err = ioutil.WriteFile(roundFile, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Rename(moved, filepath.Join(candidatesPath(second), "1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.CloseVotingRound(); err != nil {
+		t.Fatal(err)
+	}
+	if reopened.VotingRound != 2 {
+		t.Errorf("moved on to round %d", reopened.VotingRound)
+	}
+	for _, location := range []tile.Location{first, second, third} {
+		if got := versions(t, reopened, location); len(got) != 1 || got[0] != "1/1" {
+			t.Errorf("%v has versions from candidates %v, want [1/1]", location, got)
+		}
+	}
+	round1, err := reopened.Candidates(first, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !round1.Closed || round1.Winner != 1 {
+		t.Errorf("first tile's round is closed %t with winner %d", round1.Closed, round1.Winner)
+	}
+}
+
+func TestExportCandidates(t *testing.T) {
+	useTempData(t)
+	inst := newCompetitiveInstance(t)
+	ballot := issue(t, inst, 1)[0]
+	location := tile.Location{X: 1, Y: 2}
+	submit(t, inst, location, encodePNG(t, 20, 20, color.Black))
+	vote(t, inst, location, 1, ballot)
+	err := inst.StitchSessionImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	err = inst.Export(&archive, instance.ExportOptions{Format: "zip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err := instance.Import(&archive, instance.ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	round, err := imported.Candidates(location, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(round.Candidates) != 1 || round.Tally()[1] != 1 {
+		t.Fatalf("imported round has %d candidates and votes %v", len(round.Candidates), round.Tally())
+	}
+	if _, _, err := imported.ReadCandidate(location, 1, 1); err != nil {
+		t.Error(err)
+	}
+	// the issued ballots still count
+	vote(t, imported, location, 1, ballot)
+}
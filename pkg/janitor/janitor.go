@@ -0,0 +1,203 @@
+// Package janitor removes data which is no longer needed: the backgrounds of
+// closed sessions, archived instances past their retention and tile versions
+// beyond each instance's retention policy. It also closes the voting rounds
+// of competitive instances once they are due, and restitches composites which
+// were left behind saved tiles, such as by the server stopping.
+package janitor
+
+import (
+	"expvar"
+	"github.com/andrewmyhre/donk-server/pkg/audit"
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Policy controls what the janitor removes
+type Policy struct {
+	// ArchiveRetention is how long archived instances are kept before they
+	// are deleted, they are kept forever if it is zero
+	ArchiveRetention time.Duration
+	// DryRun reports what would be removed without removing anything
+	DryRun bool
+}
+
+// Report counts what a run of the janitor removed, or would have removed in
+// a dry run
+type Report struct {
+	Started            time.Time     `json:"started"`
+	Duration           time.Duration `json:"duration"`
+	DryRun             bool          `json:"dryRun"`
+	SessionsExpired    int           `json:"sessionsExpired"`
+	BackgroundsRemoved int           `json:"backgroundsRemoved"`
+	InstancesPurged    int           `json:"instancesPurged"`
+	TileVersionsPruned int           `json:"tileVersionsPruned"`
+	VotingRoundsClosed int           `json:"votingRoundsClosed"`
+	CompositesStitched int           `json:"compositesStitched"`
+	BytesFreed         int64         `json:"bytesFreed"`
+	Errors             int           `json:"errors"`
+}
+
+// metrics are published by expvar as "janitor". The totals only count runs
+// which weren't dry runs.
+var metrics = expvar.NewMap("janitor")
+
+var last = struct {
+	sync.Mutex
+	report Report
+}{}
+
+func init() {
+	metrics.Set("lastRun", expvar.Func(func() interface{} {
+		last.Lock()
+		defer last.Unlock()
+		return last.report
+	}))
+}
+
+// Run makes a single pass over every instance
+func Run(policy Policy) Report {
+	report := Report{
+		Started: time.Now().UTC(),
+		DryRun:  policy.DryRun,
+	}
+	failed := func(err error) {
+		log.Error(err)
+		report.Errors++
+	}
+
+	instances, err := instance.List()
+	if err != nil {
+		failed(err)
+		instances = nil
+	}
+	for _, inst := range instances {
+		if purge(inst, policy, &report, failed) {
+			continue
+		}
+		cleanSessions(inst, policy, &report, failed)
+
+		if inst.VotingDue() {
+			report.VotingRoundsClosed++
+			if !policy.DryRun {
+				_, err := inst.CloseVotingRound()
+				if err != nil {
+					failed(errors.Wrapf(err, "Failed to close voting round of instance %v", inst.ID))
+				}
+			}
+		}
+
+		if inst.StitchPending() {
+			report.CompositesStitched++
+			if !policy.DryRun {
+				err := inst.StitchSessionImage()
+				if err != nil {
+					failed(errors.Wrapf(err, "Failed to restitch composite of instance %v", inst.ID))
+				}
+			}
+		}
+
+		pruned, freed, err := inst.PruneTileVersions(policy.DryRun)
+		report.TileVersionsPruned += pruned
+		report.BytesFreed += freed
+		if err != nil {
+			failed(errors.Wrapf(err, "Failed to prune tile versions of instance %v", inst.ID))
+		}
+	}
+
+	report.Duration = time.Since(report.Started)
+	log.Infof("Janitor finished in %v (dry run: %t): %d sessions expired, %d backgrounds removed, %d instances purged, %d tile versions pruned, %d voting rounds closed, %d composites stitched, %d bytes freed, %d errors",
+		report.Duration, report.DryRun, report.SessionsExpired, report.BackgroundsRemoved, report.InstancesPurged, report.TileVersionsPruned, report.VotingRoundsClosed, report.CompositesStitched, report.BytesFreed, report.Errors)
+
+	metrics.Add("runs", 1)
+	if !policy.DryRun {
+		metrics.Add("sessionsExpired", int64(report.SessionsExpired))
+		metrics.Add("backgroundsRemoved", int64(report.BackgroundsRemoved))
+		metrics.Add("instancesPurged", int64(report.InstancesPurged))
+		metrics.Add("tileVersionsPruned", int64(report.TileVersionsPruned))
+		metrics.Add("votingRoundsClosed", int64(report.VotingRoundsClosed))
+		metrics.Add("compositesStitched", int64(report.CompositesStitched))
+		metrics.Add("bytesFreed", report.BytesFreed)
+	}
+	metrics.Add("errors", int64(report.Errors))
+	last.Lock()
+	last.report = report
+	last.Unlock()
+
+	return report
+}
+
+// purge deletes an instance which has been archived for longer than the
+// retention, reporting whether it was
+func purge(inst *instance.Instance, policy Policy, report *Report, failed func(error)) bool {
+	if policy.ArchiveRetention <= 0 || inst.State != instance.StateArchived || time.Since(inst.Archived) < policy.ArchiveRetention {
+		return false
+	}
+
+	report.InstancesPurged++
+	if policy.DryRun {
+		return true
+	}
+	err := inst.Delete()
+	if err != nil {
+		failed(err)
+		return true
+	}
+	err = audit.Record(audit.Entry{
+		Action:   "purge",
+		Instance: inst.ID,
+		Actor:    "janitor",
+		Detail:   inst.Title,
+	})
+	if err != nil {
+		failed(err)
+	}
+	return true
+}
+
+// cleanSessions removes the backgrounds of sessions which have expired or
+// been abandoned
+func cleanSessions(inst *instance.Instance, policy Policy, report *Report, failed func(error)) {
+	sessions, err := session.List(inst)
+	if err != nil {
+		failed(errors.Wrapf(err, "Failed to list sessions of instance %v", inst.ID))
+		return
+	}
+
+	for _, s := range sessions {
+		if !s.Closed() {
+			continue
+		}
+		freed, err := s.RemoveBackground(policy.DryRun)
+		if err != nil {
+			failed(err)
+			continue
+		}
+		if freed > 0 {
+			report.BackgroundsRemoved++
+			report.BytesFreed += freed
+			if s.Status == session.StatusExpired {
+				report.SessionsExpired++
+			}
+		}
+	}
+}
+
+// Start runs the janitor every interval until stop is closed
+func Start(interval time.Duration, policy Policy, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			Run(policy)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,258 @@
+package janitor_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/janitor"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// useTempData points instance.DataPath at a fresh folder for the test
+func useTempData(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "donk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := instance.DataPath
+	instance.DataPath = dir
+	t.Cleanup(func() {
+		instance.DataPath = previous
+		os.RemoveAll(dir)
+	})
+}
+
+// encodePNG encodes a width by height image filled with c
+func encodePNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestInstance creates an instance on the default grid which keeps keep
+// versions of each tile
+func newTestInstance(t *testing.T, keep int) *instance.Instance {
+	t.Helper()
+	source := filepath.Join(instance.DataPath, "source.png")
+	err := ioutil.WriteFile(source, encodePNG(t, 60, 60, color.Gray{200}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := instance.NewWithOptions(instance.Options{
+		SourceImagePath:  source,
+		Cols:             instance.DefaultStepCount,
+		Rows:             instance.DefaultStepCount,
+		KeepTileVersions: keep,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// submit saves a 10x10 drawing filled with c to a tile
+func submit(t *testing.T, inst *instance.Instance, location tile.Location, c color.Color) {
+	t.Helper()
+	submission, err := inst.ReadTileImage(location, bytes.NewReader(encodePNG(t, 10, 10, c)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inst.UpdateTile(location, submission)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useIdleTimeout changes how long sessions last for the test
+func useIdleTimeout(t *testing.T, timeout time.Duration) {
+	previous := session.IdleTimeout
+	session.IdleTimeout = timeout
+	t.Cleanup(func() { session.IdleTimeout = previous })
+}
+
+// backgroundExists reports whether the session still has its background
+func backgroundExists(t *testing.T, s *session.Session) bool {
+	t.Helper()
+	_, err := os.Stat(filepath.Join(s.Instance.Path(), "sessions", s.ID.String(), "background.jpg"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestSessions(t *testing.T) {
+	useTempData(t)
+	inst := newTestInstance(t, 0)
+	newSession := func(x int) *session.Session {
+		s, err := session.NewSession(inst, x, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	abandoned := newSession(0)
+	err := abandoned.Abandon()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle := newSession(1)
+	useIdleTimeout(t, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	open := newSession(2)
+
+	report := janitor.Run(janitor.Policy{DryRun: true})
+	if report.BackgroundsRemoved != 2 || report.SessionsExpired != 1 || report.BytesFreed == 0 {
+		t.Errorf("dry run reported %+v", report)
+	}
+	for _, s := range []*session.Session{abandoned, idle, open} {
+		if !backgroundExists(t, s) {
+			t.Fatalf("dry run removed the background of a %s session", s.Status)
+		}
+	}
+
+	report = janitor.Run(janitor.Policy{})
+	if report.BackgroundsRemoved != 2 || report.SessionsExpired != 1 || report.Errors != 0 {
+		t.Errorf("run reported %+v", report)
+	}
+	if backgroundExists(t, abandoned) || backgroundExists(t, idle) {
+		t.Error("closed sessions kept their backgrounds")
+	}
+	if !backgroundExists(t, open) {
+		t.Error("open session lost its background")
+	}
+	// the expiry is saved, so the session stays expired whatever the timeout
+	useIdleTimeout(t, time.Hour)
+	expired, err := session.Open(inst, idle.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired.Status != session.StatusExpired {
+		t.Errorf("session is %s once its background was removed", expired.Status)
+	}
+
+	report = janitor.Run(janitor.Policy{})
+	if report.BackgroundsRemoved != 0 {
+		t.Errorf("second run removed %d backgrounds", report.BackgroundsRemoved)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	useTempData(t)
+	archived := newTestInstance(t, 0)
+	err := archived.Archive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := newTestInstance(t, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	tests := []struct {
+		name   string
+		policy janitor.Policy
+		purged int
+	}{
+		{"retained forever", janitor.Policy{}, 0},
+		{"within retention", janitor.Policy{ArchiveRetention: time.Hour}, 0},
+		{"dry run", janitor.Policy{ArchiveRetention: time.Millisecond, DryRun: true}, 1},
+		{"past retention", janitor.Policy{ArchiveRetention: time.Millisecond}, 1},
+		{"already purged", janitor.Policy{ArchiveRetention: time.Millisecond}, 0},
+	}
+	for _, test := range tests {
+		report := janitor.Run(test.policy)
+		if report.InstancesPurged != test.purged {
+			t.Errorf("%s: purged %d instances, want %d", test.name, report.InstancesPurged, test.purged)
+		}
+	}
+
+	if _, err := instance.Open(archived.ID.String()); err != instance.ErrNotFound {
+		t.Errorf("opening the purged instance returned %v", err)
+	}
+	if _, err := instance.Open(open.ID.String()); err != nil {
+		t.Errorf("open instance was purged: %v", err)
+	}
+}
+
+func TestPruneTileVersions(t *testing.T) {
+	useTempData(t)
+	inst := newTestInstance(t, 2)
+	opaque := tile.Location{X: 0, Y: 0}
+	for _, c := range []color.Color{color.Black, color.White, color.Black, color.White} {
+		submit(t, inst, opaque, c)
+	}
+	// the opaque first version shows through the two transparent ones
+	layered := tile.Location{X: 1, Y: 0}
+	for _, c := range []color.Color{color.Black, color.NRGBA{255, 0, 0, 0}, color.NRGBA{0, 0, 255, 0}} {
+		submit(t, inst, layered, c)
+	}
+	untouched := newTestInstance(t, 0)
+	for _, c := range []color.Color{color.Black, color.White, color.Black} {
+		submit(t, untouched, opaque, c)
+	}
+
+	report := janitor.Run(janitor.Policy{DryRun: true})
+	if report.TileVersionsPruned != 2 {
+		t.Errorf("dry run would prune %d versions, want 2", report.TileVersionsPruned)
+	}
+	report = janitor.Run(janitor.Policy{})
+	if report.TileVersionsPruned != 2 || report.BytesFreed == 0 {
+		t.Errorf("run reported %+v", report)
+	}
+
+	versions := func(inst *instance.Instance, location tile.Location) []int {
+		t.Helper()
+		tl, err := inst.Tile(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numbers := []int{}
+		for _, v := range tl.Versions {
+			if _, err := os.Stat(filepath.Join(inst.Path(), "tiles", location.String(), v.Filename())); err != nil {
+				t.Errorf("version %d of %v is kept but its file is missing", v.Number, location)
+			}
+			numbers = append(numbers, v.Number)
+		}
+		return numbers
+	}
+	tests := []struct {
+		inst     *instance.Instance
+		location tile.Location
+		want     []int
+	}{
+		{inst, opaque, []int{3, 4}},
+		{inst, layered, []int{1, 2, 3}},
+		{untouched, opaque, []int{1, 2, 3}},
+	}
+	for _, test := range tests {
+		got := versions(test.inst, test.location)
+		if len(got) != len(test.want) {
+			t.Errorf("%v kept versions %v, want %v", test.location, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v kept versions %v, want %v", test.location, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package rendition
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// Cache holds encoded images in memory up to a budget of bytes, discarding
+// the least recently used when it is full. Keys should include the version of
+// whatever was rendered so that stale entries are never served.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type entry struct {
+	key  string
+	data []byte
+}
+
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the image cached under key, or calls render to produce it and
+// caches the result
+func (c *Cache) Get(key string, render func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		data := e.Value.(*entry).data
+		c.mu.Unlock()
+		return data, nil
+	}
+	c.mu.Unlock()
+
+	data, err := render()
+	if err != nil {
+		return nil, err
+	}
+	c.add(key, data)
+	return data, nil
+}
+
+func (c *Cache) add(key string, data []byte) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&entry{key, data})
+	c.size += int64(len(data))
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) remove(e *list.Element) {
+	en := c.order.Remove(e).(*entry)
+	delete(c.entries, en.key)
+	c.size -= int64(len(en.data))
+}
+
+// Invalidate discards every entry whose key starts with prefix
+func (c *Cache) Invalidate(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+		}
+	}
+}
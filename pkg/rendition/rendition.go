@@ -0,0 +1,284 @@
+package rendition
+
+import (
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats are the encodings images can be served in, in order of preference
+// when a client will accept any of them
+var Formats = []string{"jpeg", "png", "gif"}
+
+const DefaultQuality = 90
+
+// Sizes are the widths and heights images may be resized to. Limiting them
+// stops clients filling the cache with renditions of arbitrary sizes.
+var Sizes = []int{64, 128, 256, 512, 1024, 2048}
+
+// Fits are the ways an image can be resized to a width and height:
+//
+//	contain: the whole image fits within the size, keeping its aspect ratio
+//	cover: the image fills the size, keeping its aspect ratio and cropping
+//	  whatever falls outside
+//	fill: the image is stretched to the size
+var Fits = []string{"contain", "cover", "fill"}
+
+// Options describe how an image is encoded for a client. A Quality of zero
+// means the image is served as it was stored, if it is already in Format.
+// A Width or Height of zero follows from the other dimension, the image is
+// not resized if both are zero.
+type Options struct {
+	Format  string
+	Quality int
+	Width   int
+	Height  int
+	Fit     string
+}
+
+// String identifies the options within a cache key
+func (o Options) String() string {
+	return fmt.Sprintf("%s-q%d-%dx%d-%s", o.Format, o.Quality, o.Width, o.Height, o.Fit)
+}
+
+// Resized reports whether the options change the size of the image
+func (o Options) Resized() bool {
+	return o.Width != 0 || o.Height != 0
+}
+
+// MediaType is the Content-Type for images encoded with the options
+func (o Options) MediaType() string {
+	return "image/" + o.Format
+}
+
+// Encode writes img to w as described by options
+func Encode(w io.Writer, img image.Image, options Options) error {
+	switch options.Format {
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		quality := options.Quality
+		if quality == 0 {
+			quality = DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+}
+
+// Resize scales img as described by options, using Catmull-Rom resampling
+func Resize(img image.Image, options Options) image.Image {
+	if !options.Resized() {
+		return img
+	}
+
+	src := img.Bounds()
+	width, height := options.Width, options.Height
+	switch {
+	case width == 0:
+		width = max(1, src.Dx()*height/src.Dy())
+	case height == 0:
+		height = max(1, src.Dy()*width/src.Dx())
+	case options.Fit == "cover":
+		// crop the source to the aspect ratio of the rendition
+		if src.Dx()*height > src.Dy()*width {
+			w := src.Dy() * width / height
+			src.Min.X += (src.Dx() - w) / 2
+			src.Max.X = src.Min.X + w
+		} else {
+			h := src.Dx() * height / width
+			src.Min.Y += (src.Dy() - h) / 2
+			src.Max.Y = src.Min.Y + h
+		}
+	case options.Fit == "contain":
+		// shrink the rendition to the aspect ratio of the source
+		if src.Dx()*height > src.Dy()*width {
+			height = max(1, src.Dy()*width/src.Dx())
+		} else {
+			width = max(1, src.Dx()*height/src.Dy())
+		}
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, src, draw.Src, nil)
+	return resized
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// RequestError is returned when a request asks for an image in a way that
+// can't be served. Status is the HTTP status to respond with.
+type RequestError struct {
+	Status int
+	Reason string
+}
+
+func (e *RequestError) Error() string {
+	return e.Reason
+}
+
+// FromRequest reads the options a client asked for. The format is taken from
+// the format query parameter if given, otherwise it is negotiated from the
+// Accept header. JPEG quality is taken from the quality query parameter, and
+// the size from width, height and fit.
+func FromRequest(r *http.Request) (Options, error) {
+	query := r.URL.Query()
+	options := Options{}
+
+	if format := query.Get("format"); format != "" {
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !supported(format) {
+			return options, &RequestError{http.StatusBadRequest, "format must be one of " + strings.Join(Formats, ", ")}
+		}
+		options.Format = format
+	} else {
+		format, ok := negotiate(r.Header.Get("Accept"))
+		if !ok {
+			return options, &RequestError{http.StatusNotAcceptable, "images can only be served as " + strings.Join(Formats, ", ")}
+		}
+		options.Format = format
+	}
+
+	if quality := query.Get("quality"); quality != "" {
+		q, err := strconv.Atoi(quality)
+		if err != nil || q < 1 || q > 100 {
+			return options, &RequestError{http.StatusBadRequest, "quality must be a number from 1 to 100"}
+		}
+		if options.Format == "jpeg" {
+			options.Quality = q
+		}
+	}
+
+	var err error
+	options.Width, err = size(query.Get("width"))
+	if err != nil {
+		return options, &RequestError{http.StatusBadRequest, "width " + err.Error()}
+	}
+	options.Height, err = size(query.Get("height"))
+	if err != nil {
+		return options, &RequestError{http.StatusBadRequest, "height " + err.Error()}
+	}
+
+	if fit := query.Get("fit"); fit != "" {
+		if !contains(Fits, fit) {
+			return options, &RequestError{http.StatusBadRequest, "fit must be one of " + strings.Join(Fits, ", ")}
+		}
+		options.Fit = fit
+	}
+	if options.Resized() && options.Fit == "" {
+		options.Fit = Fits[0]
+	} else if !options.Resized() {
+		options.Fit = ""
+	}
+
+	return options, nil
+}
+
+// size parses a width or height, which must be one of Sizes
+func size(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil {
+		for _, s := range Sizes {
+			if s == n {
+				return n, nil
+			}
+		}
+	}
+	sizes := make([]string, len(Sizes))
+	for i, s := range Sizes {
+		sizes[i] = strconv.Itoa(s)
+	}
+	return 0, fmt.Errorf("must be one of %s", strings.Join(sizes, ", "))
+}
+
+func supported(format string) bool {
+	return contains(Formats, format)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// specificity is how closely a media range names format: 2 for the format
+// itself, 1 for image/*, 0 for */* and -1 if it doesn't match at all
+func (r acceptRange) specificity(format string) int {
+	switch r.mediaType {
+	case "image/" + format:
+		return 2
+	case "image/*":
+		return 1
+	case "*/*":
+		return 0
+	}
+	return -1
+}
+
+// negotiate picks the format best matching an Accept header. Each format is
+// weighted by the most specific range matching it, so a format refused with
+// q=0 isn't served through a wildcard. Between formats of equal weight one
+// named outright is preferred, then the earliest of Formats. A missing
+// header accepts anything.
+func negotiate(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return Formats[0], true
+	}
+
+	ranges := make([]acceptRange, 0)
+	for _, field := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(field))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+
+	best, bestQ, bestSpecificity := "", 0.0, -1
+	for _, format := range Formats {
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			if s := r.specificity(format); s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ || (q == bestQ && q > 0 && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = format, q, specificity
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,183 @@
+package rendition
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequestFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		format  string
+		quality int
+		status  int
+	}{
+		{name: "no accept header", format: "jpeg"},
+		{name: "anything", accept: "*/*", format: "jpeg"},
+		{name: "any image", accept: "image/*", format: "jpeg"},
+		{name: "only png", accept: "image/png", format: "png"},
+		{name: "preferred by weight", accept: "image/jpeg;q=0.5, image/gif;q=0.8", format: "gif"},
+		{name: "named before wildcard", accept: "image/*, image/png", format: "png"},
+		{name: "wildcard of higher weight", accept: "image/png;q=0.5, */*", format: "jpeg"},
+		{name: "unsupported skipped", accept: "image/webp, image/png;q=0.9", format: "png"},
+		{name: "refused with zero weight", accept: "image/jpeg;q=0, image/png;q=0.1", format: "png"},
+		{name: "refused despite a wildcard", accept: "image/jpeg;q=0, */*", format: "png"},
+		{name: "refused despite an image wildcard", accept: "image/*, image/jpeg;q=0, image/png;q=0", format: "gif"},
+		{name: "malformed ranges skipped", accept: "image/png;q=x, ;;, image/gif", format: "gif"},
+		{name: "nothing acceptable", accept: "image/webp, text/html", status: http.StatusNotAcceptable},
+		{name: "everything refused", accept: "image/*;q=0", status: http.StatusNotAcceptable},
+		{name: "every format refused", accept: "*/*, image/jpeg;q=0, image/png;q=0, image/gif;q=0", status: http.StatusNotAcceptable},
+		{name: "format parameter", query: "format=png", accept: "image/jpeg", format: "png"},
+		{name: "jpg is jpeg", query: "format=jpg", format: "jpeg"},
+		{name: "unsupported format parameter", query: "format=webp", status: http.StatusBadRequest},
+		{name: "quality", query: "quality=40", format: "jpeg", quality: 40},
+		{name: "quality ignored for png", query: "format=png&quality=40", format: "png"},
+		{name: "quality too low", query: "quality=0", status: http.StatusBadRequest},
+		{name: "quality too high", query: "quality=101", status: http.StatusBadRequest},
+		{name: "quality not a number", query: "quality=best", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/composite?"+test.query, nil)
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+			options, err := FromRequest(r)
+			if test.status != 0 {
+				rerr, ok := err.(*RequestError)
+				if !ok {
+					t.Fatalf("got %v, want a request error", err)
+				}
+				if rerr.Status != test.status {
+					t.Errorf("%q has status %d, want %d", rerr.Reason, rerr.Status, test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if options.Format != test.format || options.Quality != test.quality {
+				t.Errorf("got %s at quality %d, want %s at quality %d", options.Format, options.Quality, test.format, test.quality)
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := NewCache(10)
+	renders := 0
+	get := func(key string, size int) {
+		_, err := c.Get(key, func() ([]byte, error) {
+			renders++
+			return make([]byte, size), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("a", 4)
+	get("b", 4)
+	get("a", 4)
+	// b is the least recently used, so it makes room for c
+	get("c", 4)
+	get("a", 4)
+	if renders != 3 {
+		t.Errorf("rendered %d times, want a kept", renders)
+	}
+	get("b", 4)
+	if renders != 4 {
+		t.Errorf("rendered %d times, want b rendered again", renders)
+	}
+
+	// anything larger than the whole cache is never kept
+	get("huge", 11)
+	get("huge", 11)
+	if renders != 6 {
+		t.Errorf("rendered %d times, want huge rendered each time", renders)
+	}
+
+	_, err := c.Get("failed", func() ([]byte, error) { return nil, fmt.Errorf("no") })
+	if err == nil {
+		t.Error("render error wasn't returned")
+	}
+}
+
+func TestFromRequestSize(t *testing.T) {
+	tests := []struct {
+		query  string
+		width  int
+		height int
+		fit    string
+		status int
+	}{
+		{query: ""},
+		{query: "width=256", width: 256, fit: "contain"},
+		{query: "width=256&height=128&fit=cover", width: 256, height: 128, fit: "cover"},
+		{query: "fit=cover"},
+		{query: "width=300", status: http.StatusBadRequest},
+		{query: "height=-64", status: http.StatusBadRequest},
+		{query: "width=wide", status: http.StatusBadRequest},
+		{query: "width=64&fit=stretch", status: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/composite?"+test.query, nil)
+		options, err := FromRequest(r)
+		if test.status != 0 {
+			if rerr, ok := err.(*RequestError); !ok || rerr.Status != test.status {
+				t.Errorf("%s: got %v, want status %d", test.query, err, test.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		if options.Width != test.width || options.Height != test.height || options.Fit != test.fit {
+			t.Errorf("%s: got %dx%d %q, want %dx%d %q", test.query, options.Width, options.Height, options.Fit, test.width, test.height, test.fit)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	// the left half is black and the right half white
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 200; x < 400; x++ {
+			src.Set(x, y, color.White)
+		}
+	}
+
+	tests := []struct {
+		options Options
+		size    image.Point
+	}{
+		{Options{}, image.Pt(400, 200)},
+		{Options{Width: 64, Fit: "contain"}, image.Pt(64, 32)},
+		{Options{Height: 64, Fit: "contain"}, image.Pt(128, 64)},
+		{Options{Width: 128, Height: 128, Fit: "contain"}, image.Pt(128, 64)},
+		{Options{Width: 128, Height: 128, Fit: "cover"}, image.Pt(128, 128)},
+		{Options{Width: 128, Height: 128, Fit: "fill"}, image.Pt(128, 128)},
+	}
+	for _, test := range tests {
+		resized := Resize(src, test.options)
+		if size := resized.Bounds().Size(); size != test.size {
+			t.Errorf("%s: resized to %v, want %v", test.options, size, test.size)
+		}
+	}
+
+	// cover crops the middle of the source, so the edges stay black and white
+	covered := Resize(src, Options{Width: 64, Height: 64, Fit: "cover"})
+	if r, _, _, _ := covered.At(2, 32).RGBA(); r > 0x1000 {
+		t.Errorf("left edge of the cover is %v, want black", covered.At(2, 32))
+	}
+	if r, _, _, _ := covered.At(61, 32).RGBA(); r < 0xf000 {
+		t.Errorf("right edge of the cover is %v, want white", covered.At(61, 32))
+	}
+}
@@ -0,0 +1,34 @@
+package session
+
+import (
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+	"time"
+)
+
+// Filter selects sessions when listing them. Zero fields match every
+// session.
+type Filter struct {
+	Location *tile.Location
+	Status   string
+	// MinAge and MaxAge bound how long ago sessions were created
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+// Matches reports whether s is selected by the filter
+func (f Filter) Matches(s *Session) bool {
+	if f.Location != nil && s.Location != *f.Location {
+		return false
+	}
+	if f.Status != "" && s.Status != f.Status {
+		return false
+	}
+	age := time.Since(s.Created)
+	if f.MinAge > 0 && age < f.MinAge {
+		return false
+	}
+	if f.MaxAge > 0 && age > f.MaxAge {
+		return false
+	}
+	return true
+}
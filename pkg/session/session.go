@@ -1,45 +1,116 @@
 package session
 
 import (
-	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"github.com/andrewmyhre/donk-server/pkg/atomicfile"
 	"github.com/andrewmyhre/donk-server/pkg/instance"
 	"github.com/andrewmyhre/donk-server/pkg/tile"
 	"github.com/google/uuid"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	log "github.com/sirupsen/logrus"
 	"github.com/pkg/errors"
-	"strings"
+	"time"
 
 	"image"
-	_ "image/jpeg"
 )
 
 type Session struct {
 	ID uuid.UUID `json:"id"`
 	Instance *instance.Instance `json:"instance"`
 	Location tile.Location `json:"location"`
-	BackgroundImage image.Image `json:omit`
+	// Round is the round of the instance the session was created in, it
+	// can't save tiles once a later round has started
+	Round int `json:"round"`
+	// TileVersion is the version of the tile shown in the background image,
+	// zero if the tile hadn't been drawn when the background was made
+	TileVersion int `json:"tileVersion"`
+	// CompositeVersion is the composite version which shows the tile last
+	// saved by the session, zero if it hasn't saved one or only saved
+	// candidates. The composite is restitched in the background so it may
+	// not have reached it yet.
+	CompositeVersion int `json:"compositeVersion,omitempty"`
+	Status string `json:"status"`
+	Created time.Time `json:"created"`
+	// Updated is when the status last changed or the tile was last saved
+	Updated time.Time `json:"updated"`
+	// Contributor is credited with the session's saves unless a save names
+	// someone else
+	Contributor *tile.Contributor `json:"contributor,omitempty"`
+	BackgroundImage image.Image `json:"-"`
 }
 
-type sessionOut struct {
+// Summary describes a session without its instance, it is what is saved for
+// each session
+type Summary struct {
 	ID uuid.UUID `json:"id"`
 	InstanceID uuid.UUID `json:"instanceID"`
 	Location tile.Location `json:"location"`
+	Round int `json:"round,omitempty"`
+	TileVersion int `json:"tileVersion"`
+	CompositeVersion int `json:"compositeVersion,omitempty"`
+	Status string `json:"status"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Contributor *tile.Contributor `json:"contributor,omitempty"`
 }
 
-func NewSession(instance *instance.Instance, x,y int) (*Session,error) {
+// Statuses a session can have
+const (
+	// StatusCreated sessions haven't started drawing
+	StatusCreated = "created"
+	// StatusDrawing sessions have started drawing and not saved yet
+	StatusDrawing = "drawing"
+	// StatusSubmitted sessions have saved their tile at least once, they can
+	// go on saving it until IdleTimeout passes without another save
+	StatusSubmitted = "submitted"
+	// StatusExpired sessions went longer than IdleTimeout without saving,
+	// since they were created or since their last save
+	StatusExpired = "expired"
+	// StatusAbandoned sessions were given up by their client
+	StatusAbandoned = "abandoned"
+)
+
+// Statuses are all the statuses a session can have
+var Statuses = []string{StatusCreated, StatusDrawing, StatusSubmitted, StatusExpired, StatusAbandoned}
+
+// IdleTimeout is how long a session can go without saving before it expires,
+// so that the janitor can remove its background
+var IdleTimeout = 24 * time.Hour
+
+// ErrNotFound is returned when opening a session which doesn't exist
+var ErrNotFound = errors.New("Session not found")
+
+// ErrClosed is returned when saving to a session which has expired or been
+// abandoned
+var ErrClosed = errors.New("Session is closed")
+
+// NewSession starts a session for drawing the tile at x,y of inst. The
+// contributor may be nil.
+func NewSession(inst *instance.Instance, x,y int, contributor *tile.Contributor) (*Session,error) {
+	if inst.State == instance.StateArchived {
+		return nil, instance.ErrArchived
+	}
+	if !inst.HasTile(tile.Location{X: x, Y: y}) {
+		return nil, errors.Errorf("Tile %d,%d is outside the instance layout", x, y)
+	}
+
+	now := time.Now().UTC()
 	session := &Session {
-		Instance: instance,
+		Instance: inst,
 		ID: uuid.New(),
 		Location: tile.Location {
 			X: x,
 			Y: y,
 		},
+		Round: inst.Round,
+		Status: StatusCreated,
+		Created: now,
+		Updated: now,
+		Contributor: contributor,
 	}
 
 	err := session.initializeBackgroundImage()
@@ -56,22 +127,28 @@ func NewSession(instance *instance.Instance, x,y int) (*Session,error) {
 	return session, nil
 }
 
-func (s *Session) save() error {
-	out := sessionOut{
+// Summary describes the session for a listing
+func (s *Session) Summary() Summary {
+	return Summary{
 		ID: s.ID,
 		InstanceID: s.Instance.ID,
 		Location: s.Location,
+		Round: s.Round,
+		TileVersion: s.TileVersion,
+		CompositeVersion: s.CompositeVersion,
+		Status: s.Status,
+		Created: s.Created,
+		Updated: s.Updated,
+		Contributor: s.Contributor,
 	}
+}
 
-	filePath := path.Join("data","instances",s.Instance.ID.String(),"sessions",s.ID.String(),"session")
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		return errors.Wrap(err, "Couldn't open session data file for writing")
-	}
-	defer f.Close()
+func (s *Session) save() error {
+	out := s.Summary()
 
+	filePath := path.Join(s.Instance.Path(), "sessions", s.ID.String(), "session")
 	json, _ := json.MarshalIndent(out, "", " ")
-	_, err = f.Write(json)
+	err := atomicfile.WriteFile(filePath, json, 0755)
 	if err != nil {
 		return errors.Wrap(err, "Failed to write json to file")
 	}
@@ -80,16 +157,15 @@ func (s *Session) save() error {
 }
 
 func (s *Session) load() error {
-	out := &sessionOut {}
+	out := &Summary{}
 
-	filePath := path.Join("data","instances",s.Instance.ID.String(),"sessions",s.ID.String(),"session")
-
-	if _, err := os.Stat(filePath); err != nil {
-		return nil
-	}
+	filePath := path.Join(s.Instance.Path(), "sessions", s.ID.String(), "session")
 
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
 		return errors.Wrap(err, "Failed to load session file")
 	}
 
@@ -100,7 +176,33 @@ func (s *Session) load() error {
 
 	s.Location.X=out.Location.X
 	s.Location.Y=out.Location.Y
+	s.TileVersion=out.TileVersion
+	s.CompositeVersion = out.CompositeVersion
+	s.Round = out.Round
+	s.Status = out.Status
+	s.Created = out.Created
+	s.Updated = out.Updated
+	s.Contributor = out.Contributor
 	s.Instance.ID = out.InstanceID
+
+	// sessions saved before they had a status
+	if s.Status == "" {
+		s.Status = StatusCreated
+		if info, err := os.Stat(filePath); err == nil {
+			s.Created = info.ModTime().UTC()
+			s.Updated = s.Created
+		}
+	}
+	if (s.Status == StatusCreated || s.Status == StatusDrawing || s.Status == StatusSubmitted) && time.Since(s.Updated) > IdleTimeout {
+		s.Status = StatusExpired
+	}
+	// sessions saved before instances had rounds were in the first one
+	if s.Round == 0 {
+		s.Round = 1
+	}
+	if s.Round < s.Instance.Round && s.Status != StatusAbandoned {
+		s.Status = StatusExpired
+	}
 	log.Infof("Loaded session for %d,%d", s.Location.X, s.Location.Y)
 	return nil
 }
@@ -116,6 +218,9 @@ func Open(instance *instance.Instance, sessionID string) (*Session, error) {
 		Instance: instance,
 	}
 	err = session.load()
+	if err == ErrNotFound {
+		return nil, err
+	}
 	if err != nil {
 		return nil, errors.Wrap(err,"Couldn't open session")
 	}
@@ -124,10 +229,8 @@ func Open(instance *instance.Instance, sessionID string) (*Session, error) {
 }
 
 func (s *Session) initializeBackgroundImage() error {
-	sessionPath := path.Join("data", "instances", s.Instance.ID.String(), "sessions",s.ID.String())
+	sessionPath := path.Join(s.Instance.Path(), "sessions", s.ID.String())
 	backgroundImagePath := path.Join(sessionPath,"background.jpg")
-	tileFilename := fmt.Sprintf("%d,%d.jpg", s.Location.X, s.Location.Y)
-	tileImage := path.Join("data", "instances", s.Instance.ID.String(), "tiles", tileFilename)
 
 	if _, err := os.Stat(sessionPath); err != nil && os.IsNotExist(err) {
 		err := os.MkdirAll(sessionPath, 0755)
@@ -137,46 +240,24 @@ func (s *Session) initializeBackgroundImage() error {
 		log.Infof("Created path for session %v", s.ID)
 	}
 
-	if _, err := os.Stat(tileImage); err == nil {
-		log.Infof("Using existing tile image for %d,%d", s.Location.X, s.Location.Y)
-		input, err := ioutil.ReadFile(tileImage)
-        if err != nil {
-                return errors.Wrap(err, "Failed to read tile image")
-        }
-
-        err = ioutil.WriteFile(backgroundImagePath, input, 0644)
-        if err != nil {
-                return errors.Wrap(err, "Failed to write tile to background image")
-        }
-		return nil
-	}
-	log.Info("No existing tile, generating a background from source")
-	
-	reader, err := os.Open(s.Instance.SourceImagePath)
+	t, err := s.Instance.Tile(s.Location)
 	if err != nil {
-	    return errors.Wrapf(err, "Failed to open %s for reading", s.Instance.SourceImagePath)
+		return errors.Wrap(err, "Failed to load tile")
 	}
-	source, _, err := image.Decode(reader)
+	newImage, err := s.Instance.RenderTile(t)
 	if err != nil {
-		return errors.Wrap(err, "Failed to decode source image")
+		return errors.Wrap(err, "Failed to render tile")
 	}
-
-	newImageSize := image.Rect(0,0,s.Instance.StepSizeX,s.Instance.StepSizeY)
-	newImage := image.NewRGBA(newImageSize)
-
-	sourceX0 := s.Location.X * s.Instance.StepSizeX
-	sourceY0 := s.Location.Y * s.Instance.StepSizeY
-
-	for y := 0; y < s.Instance.StepSizeY; y++ {
-		for x := 0; x < s.Instance.StepSizeX; x++ {
-			newImage.Set(x,y,source.At(sourceX0+x,sourceY0+y))
-		}
+	s.TileVersion = 0
+	if latest := t.Latest(); latest != nil {
+		s.TileVersion = latest.Number
 	}
 
-	writer, err := os.Create(backgroundImagePath)
+	writer, err := atomicfile.Create(backgroundImagePath, 0644)
 	if err != nil {
 		return errors.Wrap(err, "Failed to open background image for writing")
 	}
+	defer writer.Close()
 
 	err = jpeg.Encode(writer, newImage, &jpeg.Options{
 		Quality: 100,
@@ -185,11 +266,21 @@ func (s *Session) initializeBackgroundImage() error {
 	if err != nil {
 		return errors.Wrap(err, "Failed to write background image")
 	}
-	return nil
+	return writer.Commit()
+}
+
+// BackgroundModified returns the time the background image was last saved,
+// or the zero time if it hasn't been
+func (s *Session) BackgroundModified() time.Time {
+	info, err := os.Stat(path.Join(s.Instance.Path(), "sessions", s.ID.String(), "background.jpg"))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
 }
 
 func (s *Session) ReadBackgroundImage() ([]byte,error) {
-	backgroundImagePath := path.Join("data", "instances", s.Instance.ID.String(), "sessions", s.ID.String(), "background.jpg")
+	backgroundImagePath := path.Join(s.Instance.Path(), "sessions", s.ID.String(), "background.jpg")
 	dat, err := ioutil.ReadFile(backgroundImagePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to read session background image")
@@ -197,39 +288,155 @@ func (s *Session) ReadBackgroundImage() ([]byte,error) {
 	return dat, nil
 }
 
-func (s *Session) UpdateBackgroundImage(data []byte) error {
-	outFilePath := path.Join("data", "instances", s.Instance.ID.String(), "sessions", s.ID.String(), "background.jpg")
-	encodedImageData := strings.Replace(string(data), "data:image/jpeg;base64,", "", 1)
-	decodedImageData, err := base64.StdEncoding.DecodeString(encodedImageData)
+// RemoveBackground deletes the background image of a closed session, saving
+// the session so that its status is kept. It returns the bytes freed, with
+// dryRun the bytes which would have been.
+func (s *Session) RemoveBackground(dryRun bool) (int64, error) {
+	if !s.Closed() {
+		return 0, errors.Errorf("Session %v is %s, only closed sessions can lose their background", s.ID, s.Status)
+	}
 
+	backgroundImagePath := path.Join(s.Instance.Path(), "sessions", s.ID.String(), "background.jpg")
+	info, err := os.Stat(backgroundImagePath)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to decode from base64: %s", encodedImageData)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "Failed to find session background image")
+	}
+	if dryRun {
+		return info.Size(), nil
 	}
 
-	imageFile, err := os.OpenFile(outFilePath,os.O_RDWR|os.O_CREATE, 0755)
+	err = s.save()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to save session")
+	}
+	err = os.Remove(backgroundImagePath)
 	if err != nil {
-		return errors.Wrap(err, "Couldn't open image file for writing")
+		return 0, errors.Wrap(err, "Failed to remove session background image")
 	}
-	defer imageFile.Close()
+	log.Infof("Removed background of %s session %v", s.Status, s.ID)
+	return info.Size(), nil
+}
 
-	_, err = imageFile.Write(decodedImageData)
+// ReadImage reads and validates a drawing submitted for the session's tile.
+// Problems with the image are returned as a *tile.ValidationError.
+func (s *Session) ReadImage(r io.Reader) (*tile.Submission, error) {
+	return s.Instance.ReadTileImage(s.Location, r)
+}
+
+// Closed reports whether the session has expired or been abandoned, so it
+// can't be saved to any more
+func (s *Session) Closed() bool {
+	return s.Status == StatusExpired || s.Status == StatusAbandoned
+}
+
+// StartDrawing moves a session which has just been created on to drawing,
+// once its client has started. ErrClosed is returned if the session has
+// expired or been abandoned.
+func (s *Session) StartDrawing() error {
+	if s.Closed() {
+		return ErrClosed
+	}
+	if s.Status != StatusCreated {
+		return nil
+	}
+	return s.setStatus(StatusDrawing)
+}
+
+// Abandon closes the session so it can't be saved to
+func (s *Session) Abandon() error {
+	if s.Status == StatusAbandoned {
+		return nil
+	}
+	return s.setStatus(StatusAbandoned)
+}
+
+func (s *Session) setStatus(status string) error {
+	s.Status = status
+	s.Updated = time.Now().UTC()
+	err := s.save()
 	if err != nil {
-		if err != nil {
-			return errors.Wrap(err, "Couldn't write image data")
-		}
+		return errors.Wrap(err, "Failed to save session")
 	}
+	log.Infof("Session %v is %s", s.ID, status)
+	return nil
+}
 
-	log.Infof("Saved %s", outFilePath)
+// UpdateBackgroundImage saves a drawing read by ReadImage to the session's
+// tile, credited to the session's contributor unless the submission names
+// one. The session background is then regenerated from the updated tile.
+// ErrClosed is returned if the session has expired or been abandoned.
+func (s *Session) UpdateBackgroundImage(submission *tile.Submission) error {
+	if s.Closed() {
+		return ErrClosed
+	}
+	if submission.Contributor == nil {
+		submission.Contributor = s.Contributor
+	}
 
-	err = s.Instance.UpdateTile(s.Location, decodedImageData)
+	err := s.Instance.UpdateTile(s.Location, submission)
 	if err != nil {
 		return errors.Wrap(err, "Failed to update instance tile")
 	}
+	// candidates on a competitive instance don't go into the composite until
+	// their voting round closes, if they win it
+	s.CompositeVersion = 0
+	if s.Instance.Mode != instance.ModeCompetitive {
+		s.CompositeVersion = s.Instance.PendingCompositeVersion
+		if !s.Instance.StitchPending() {
+			s.CompositeVersion = s.Instance.CompositeVersion
+		}
+	}
+
+	err = s.initializeBackgroundImage()
+	if err != nil {
+		return errors.Wrap(err, "Failed to update session background image")
+	}
+
+	s.Status = StatusSubmitted
+	s.Updated = time.Now().UTC()
+	err = s.save()
+	if err != nil {
+		return errors.Wrap(err, "Failed to save session")
+	}
 	return nil
 }
 
+// List opens every session of an instance
+func List(inst *instance.Instance) ([]*Session, error) {
+	entries, err := ioutil.ReadDir(path.Join(inst.Path(), "sessions"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Session{}, nil
+		}
+		return nil, errors.Wrap(err, "Failed to list sessions")
+	}
+
+	sessions := make([]*Session, 0, len(entries))
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		s, err := Open(inst, entry.Name())
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// Find opens a session of any instance by its ID
 func Find(sessionID string) (*Session, error) {
-	instancesPath := path.Join("data", "instances")
+	sessionUUID, err := uuid.Parse(sessionID)
+	if err != nil {
+		return nil, errors.Wrap(ErrNotFound, sessionID + " is not a valid session ID")
+	}
+
+	instancesPath := instance.InstancesPath()
 
 	instances, err := ioutil.ReadDir(instancesPath)
 	if err != nil {
@@ -237,38 +444,19 @@ func Find(sessionID string) (*Session, error) {
 	}
 
 	for _, instanceID := range instances {
-		if instanceID.IsDir() {
-			instanceUUID, err := uuid.Parse(instanceID.Name())
-			if err != nil {
-				continue
-			}
-			// TODO: load the instance from disk if available
-			instanceObj := &instance.Instance {
-				ID: instanceUUID,
-			}
-			sessionsPath := path.Join(instancesPath, instanceID.Name(), "sessions")
-			if _, err := os.Stat(sessionsPath); err != nil {
-				continue
-			}
-			sessions, err := ioutil.ReadDir(sessionsPath)
-			if err != nil {
-				return nil, errors.Wrap(err, "Failed to list subfolders for instance " + instanceID.Name())
-			}
-			for _, s := range sessions {
-				if s.IsDir() {
-					_, err := uuid.Parse(s.Name())
-					if err != nil {
-						continue
-					}
-					session, err := Open(instanceObj, sessionID)
-					if err != nil {
-						return nil, errors.Wrap(err, "Failed to open session " + session.ID.String())
-					}
-					return session, nil
-				}
-			}
+		if !instanceID.IsDir() {
+			continue
+		}
+		sessionPath := path.Join(instancesPath, instanceID.Name(), "sessions", sessionUUID.String())
+		if _, err := os.Stat(sessionPath); err != nil {
+			continue
 		}
+		inst, err := instance.Open(instanceID.Name())
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to open instance of session " + sessionID)
+		}
+		return Open(inst, sessionID)
 	}
 
-	return nil, errors.New("Failed to find session " + sessionID)
-}
\ No newline at end of file
+	return nil, ErrNotFound
+}
@@ -0,0 +1,188 @@
+package session_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andrewmyhre/donk-server/pkg/instance"
+	"github.com/andrewmyhre/donk-server/pkg/session"
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+// newTestInstance creates an instance of 10x10 tiles in a fresh data folder
+func newTestInstance(t *testing.T) *instance.Instance {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "donk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := instance.DataPath
+	instance.DataPath = dir
+	t.Cleanup(func() {
+		instance.DataPath = previous
+		os.RemoveAll(dir)
+	})
+
+	source := filepath.Join(dir, "source.png")
+	err = ioutil.WriteFile(source, encodePNG(t, 60, 60), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst, err := instance.New(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+// encodePNG encodes a plain width by height image
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useIdleTimeout changes how long sessions last for the test
+func useIdleTimeout(t *testing.T, timeout time.Duration) {
+	previous := session.IdleTimeout
+	session.IdleTimeout = timeout
+	t.Cleanup(func() { session.IdleTimeout = previous })
+}
+
+// submit saves a plain drawing to the session's tile
+func submit(t *testing.T, s *session.Session) {
+	t.Helper()
+	submission, err := s.ReadImage(bytes.NewReader(encodePNG(t, 10, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateBackgroundImage(submission)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	inst := newTestInstance(t)
+	submitted, err := session.NewSession(inst, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit(t, submitted)
+	idle, err := session.NewSession(inst, 1, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useIdleTimeout(t, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	saving, err := session.NewSession(inst, 2, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit(t, saving)
+
+	for _, s := range []*session.Session{idle, submitted} {
+		expired, err := session.Open(inst, s.ID.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired.Status != session.StatusExpired {
+			t.Fatalf("session idle since %s is %s", s.Status, expired.Status)
+		}
+		if err := expired.StartDrawing(); err != session.ErrClosed {
+			t.Errorf("starting an expired session returned %v", err)
+		}
+		submission, err := expired.ReadImage(bytes.NewReader(encodePNG(t, 10, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := expired.UpdateBackgroundImage(submission); err != session.ErrClosed {
+			t.Errorf("saving to an expired session returned %v", err)
+		}
+	}
+
+	// a session which saved within the timeout can go on saving
+	reopened, err := session.Open(inst, saving.ID.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Status != session.StatusSubmitted {
+		t.Errorf("recently saved session is %s", reopened.Status)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	inst := newTestInstance(t)
+	s, err := session.NewSession(inst, 2, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Created = time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		filter  session.Filter
+		matches bool
+	}{
+		{"everything", session.Filter{}, true},
+		{"same tile", session.Filter{Location: &tile.Location{X: 2, Y: 3}}, true},
+		{"other tile", session.Filter{Location: &tile.Location{X: 3, Y: 2}}, false},
+		{"same status", session.Filter{Status: session.StatusCreated}, true},
+		{"other status", session.Filter{Status: session.StatusDrawing}, false},
+		{"old enough", session.Filter{MinAge: time.Minute}, true},
+		{"too new", session.Filter{MinAge: 2 * time.Hour}, false},
+		{"new enough", session.Filter{MaxAge: 2 * time.Hour}, true},
+		{"too old", session.Filter{MaxAge: time.Minute}, false},
+	}
+	for _, test := range tests {
+		if matches := test.filter.Matches(s); matches != test.matches {
+			t.Errorf("%s: matched %v", test.name, matches)
+		}
+	}
+}
+
+func TestCompositeVersion(t *testing.T) {
+	previous := instance.StitchDelay
+	instance.StitchDelay = time.Hour
+	t.Cleanup(func() { instance.StitchDelay = previous })
+
+	tests := []struct {
+		mode string
+		want int
+	}{
+		// the tile is in the composite once the pending version is rendered
+		{instance.ModeLatest, 1},
+		// candidates aren't in the composite unless they win a vote
+		{instance.ModeCompetitive, 0},
+	}
+	for _, test := range tests {
+		newTestInstance(t)
+		inst, err := instance.NewWithOptions(instance.Options{SourceImagePath: filepath.Join(instance.DataPath, "source.png"), Cols: 6, Rows: 6, Mode: test.mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := session.NewSession(inst, 1, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		submit(t, s)
+		if s.CompositeVersion != test.want {
+			t.Errorf("%s: session reports composite version %d, want %d", test.mode, s.CompositeVersion, test.want)
+		}
+	}
+}
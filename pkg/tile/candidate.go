@@ -0,0 +1,71 @@
+package tile
+
+import (
+	"fmt"
+	"time"
+)
+
+// Candidate is a drawing submitted for a tile during a voting round of a
+// competitive instance. The winner of the round becomes the tile's next
+// version.
+type Candidate struct {
+	Number      int               `json:"number"`
+	Format      string            `json:"format"`
+	Opaque      bool              `json:"opaque"`
+	Created     time.Time         `json:"created"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Contributor *Contributor      `json:"contributor,omitempty"`
+}
+
+// Filename is the name of the candidate's image file within the round folder
+func (c Candidate) Filename() string {
+	return fmt.Sprintf("%d%s", c.Number, Extension(c.Format))
+}
+
+// Round holds the candidates submitted for a tile during a voting round and
+// the votes cast for them
+type Round struct {
+	Location   Location    `json:"location"`
+	Number     int         `json:"number"`
+	Candidates []Candidate `json:"candidates"`
+	// Ballots maps the hash of each ballot cast to the candidate it was cast
+	// for, the ballots themselves aren't kept so they can't be read back
+	Ballots map[string]int `json:"ballots,omitempty"`
+	// Winner is the number of the candidate which was promoted when the
+	// round closed, 0 if the round is still open or nobody voted
+	Winner int  `json:"winner,omitempty"`
+	Closed bool `json:"closed,omitempty"`
+}
+
+// Candidate returns the candidate numbered n, or nil if there isn't one
+func (r *Round) Candidate(n int) *Candidate {
+	for c := range r.Candidates {
+		if r.Candidates[c].Number == n {
+			return &r.Candidates[c]
+		}
+	}
+	return nil
+}
+
+// Tally counts the votes for each candidate
+func (r *Round) Tally() map[int]int {
+	votes := make(map[int]int, len(r.Candidates))
+	for _, n := range r.Ballots {
+		votes[n]++
+	}
+	return votes
+}
+
+// Leader returns the candidate with the most votes, ties going to whichever
+// was submitted first. It returns nil if no votes have been cast.
+func (r *Round) Leader() *Candidate {
+	votes := r.Tally()
+	var leader *Candidate
+	for c := range r.Candidates {
+		candidate := &r.Candidates[c]
+		if votes[candidate.Number] > 0 && (leader == nil || votes[candidate.Number] > votes[leader.Number]) {
+			leader = candidate
+		}
+	}
+	return leader
+}
@@ -0,0 +1,51 @@
+package tile
+
+import (
+	"net/url"
+	"unicode/utf8"
+)
+
+// Contributor credits the person who drew a tile version
+type Contributor struct {
+	Name   string `json:"name"`
+	Handle string `json:"handle,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+const (
+	maxContributorName   = 100
+	maxContributorHandle = 50
+	maxContributorLink   = 500
+)
+
+// NewContributor checks the details given for a contributor. It returns nil
+// if none were given, a name is needed if a handle or link is.
+func NewContributor(name, handle, link string) (*Contributor, error) {
+	if name == "" && handle == "" && link == "" {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, invalid("a contributor needs a name")
+	}
+	if utf8.RuneCountInString(name) > maxContributorName {
+		return nil, invalid("contributor name is longer than %d characters", maxContributorName)
+	}
+	if utf8.RuneCountInString(handle) > maxContributorHandle {
+		return nil, invalid("contributor handle is longer than %d characters", maxContributorHandle)
+	}
+	if link != "" {
+		u, err := url.Parse(link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(link) > maxContributorLink {
+			return nil, invalid("contributor link must be an http or https URL of up to %d characters", maxContributorLink)
+		}
+	}
+	return &Contributor{Name: name, Handle: handle, Link: link}, nil
+}
+
+// String is how the contributor is credited in rendered images
+func (c Contributor) String() string {
+	if c.Handle == "" {
+		return c.Name
+	}
+	return c.Name + " (" + c.Handle + ")"
+}
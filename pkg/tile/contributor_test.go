@@ -0,0 +1,56 @@
+package tile_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+func TestNewContributor(t *testing.T) {
+	tests := []struct {
+		name    string
+		details [3]string
+		want    *tile.Contributor
+		valid   bool
+	}{
+		{"nobody", [3]string{"", "", ""}, nil, true},
+		{"name", [3]string{"Ada", "", ""}, &tile.Contributor{Name: "Ada"}, true},
+		{"everything", [3]string{"Ada", "@ada", "https://example.com/ada"}, &tile.Contributor{Name: "Ada", Handle: "@ada", Link: "https://example.com/ada"}, true},
+		{"handle without a name", [3]string{"", "@ada", ""}, nil, false},
+		{"link without a name", [3]string{"", "", "https://example.com"}, nil, false},
+		{"long name", [3]string{strings.Repeat("a", 101), "", ""}, nil, false},
+		// lengths count characters rather than bytes
+		{"long name in bytes", [3]string{strings.Repeat("é", 100), "", ""}, &tile.Contributor{Name: strings.Repeat("é", 100)}, true},
+		{"long handle", [3]string{"Ada", strings.Repeat("a", 51), ""}, nil, false},
+		{"long link", [3]string{"Ada", "", "https://example.com/" + strings.Repeat("a", 500)}, nil, false},
+		{"script link", [3]string{"Ada", "", "javascript:alert(1)"}, nil, false},
+		{"relative link", [3]string{"Ada", "", "/ada"}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := tile.NewContributor(test.details[0], test.details[1], test.details[2])
+			if !test.valid {
+				if _, ok := err.(*tile.ValidationError); !ok {
+					t.Fatalf("returned %v, want a validation error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (c == nil) != (test.want == nil) || (c != nil && *c != *test.want) {
+				t.Errorf("returned %v, want %v", c, test.want)
+			}
+		})
+	}
+}
+
+func TestContributorString(t *testing.T) {
+	if s := (tile.Contributor{Name: "Ada"}).String(); s != "Ada" {
+		t.Errorf("credited as %q", s)
+	}
+	if s := (tile.Contributor{Name: "Ada", Handle: "@ada", Link: "https://example.com"}).String(); s != "Ada (@ada)" {
+		t.Errorf("credited as %q", s)
+	}
+}
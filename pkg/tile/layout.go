@@ -0,0 +1,124 @@
+package tile
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Region is the part of an instance's source image covered by one tile.
+// Tiles are addressed by Name, and their versions are stored by Location.
+type Region struct {
+	Name     string          `json:"name"`
+	Location Location        `json:"location"`
+	Bounds   image.Rectangle `json:"bounds"`
+}
+
+// Layout is the arrangement of tiles over a source image, in the order
+// they are drawn into the composite
+type Layout []Region
+
+// GridLayout divides the area below and to the right of offsetX,offsetY
+// into cols by rows tiles of width by height. Each tile is named after its
+// location.
+func GridLayout(cols, rows, width, height, offsetX, offsetY int) Layout {
+	layout := make(Layout, 0, cols*rows)
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			location := Location{X: x, Y: y}
+			x0, y0 := offsetX+x*width, offsetY+y*height
+			layout = append(layout, Region{
+				Name:     location.String(),
+				Location: location,
+				Bounds:   image.Rect(x0, y0, x0+width, y0+height),
+			})
+		}
+	}
+	return layout
+}
+
+// BrickLayout lays rows of bricks over an image of width by height, with
+// every other row offset by half a brick like a stretcher bond wall. Even
+// rows have cols bricks, odd rows have a half brick at each end with
+// cols-1 whole bricks between them. Bricks are named after their location,
+// counted along their row.
+func BrickLayout(cols, rows, width, height int) Layout {
+	brickWidth, brickHeight := width/cols, height/rows
+	layout := make(Layout, 0, cols*rows+rows/2)
+	for y := 0; y < rows; y++ {
+		edges := make([]int, 0, cols+2)
+		if y%2 == 1 {
+			edges = append(edges, 0)
+			for x := 0; x < cols; x++ {
+				edges = append(edges, brickWidth/2+x*brickWidth)
+			}
+		} else {
+			for x := 0; x < cols; x++ {
+				edges = append(edges, x*brickWidth)
+			}
+		}
+		edges = append(edges, cols*brickWidth)
+
+		for x := 0; x+1 < len(edges); x++ {
+			location := Location{X: x, Y: y}
+			layout = append(layout, Region{
+				Name:     location.String(),
+				Location: location,
+				Bounds:   image.Rect(edges[x], y*brickHeight, edges[x+1], (y+1)*brickHeight),
+			})
+		}
+	}
+	return layout
+}
+
+// Find returns the region of the tile at location, or nil if the layout
+// doesn't have one
+func (l Layout) Find(location Location) *Region {
+	for n := range l {
+		if l[n].Location == location {
+			return &l[n]
+		}
+	}
+	return nil
+}
+
+// Named returns the region of the tile called name, or nil if the layout
+// doesn't have one
+func (l Layout) Named(name string) *Region {
+	for n := range l {
+		if l[n].Name == name {
+			return &l[n]
+		}
+	}
+	return nil
+}
+
+// Check returns an error describing the first problem with the layout as a
+// layout for an image of width by height: it must have a tile, each tile
+// must have a name and location of its own, and cover part of the image.
+// Tiles may overlap, later ones are drawn over those before them.
+func (l Layout) Check(width, height int) error {
+	if len(l) == 0 {
+		return fmt.Errorf("layout must have at least one tile")
+	}
+	area := image.Rect(0, 0, width, height)
+	names := make(map[string]bool, len(l))
+	locations := make(map[Location]bool, len(l))
+	for _, region := range l {
+		switch {
+		case region.Name == "" || strings.ContainsAny(region.Name, "/?#"):
+			return fmt.Errorf("tile %v must have a name without / ? or #, not %q", region.Location, region.Name)
+		case names[region.Name]:
+			return fmt.Errorf("there is more than one tile called %s", region.Name)
+		case region.Location.X < 0 || region.Location.Y < 0:
+			return fmt.Errorf("tile %s has a negative location %v", region.Name, region.Location)
+		case locations[region.Location]:
+			return fmt.Errorf("there is more than one tile at %v", region.Location)
+		case region.Bounds.Empty() || !region.Bounds.In(area):
+			return fmt.Errorf("tile %s covers %v, which is not a part of the %dx%d image", region.Name, region.Bounds, width, height)
+		}
+		names[region.Name] = true
+		locations[region.Location] = true
+	}
+	return nil
+}
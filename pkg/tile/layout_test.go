@@ -0,0 +1,95 @@
+package tile_test
+
+import (
+	"image"
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+func TestBrickLayout(t *testing.T) {
+	layout := tile.BrickLayout(3, 4, 60, 40)
+	if err := layout.Check(60, 40); err != nil {
+		t.Fatal(err)
+	}
+	// 3 bricks on even rows, 2 bricks and 2 halves on odd rows
+	if len(layout) != 3*2+4*2 {
+		t.Fatalf("laid %d bricks", len(layout))
+	}
+
+	// every pixel is covered by exactly one brick, so there are no gaps at
+	// the ends of the offset rows
+	covered := make([][]int, 40)
+	for y := range covered {
+		covered[y] = make([]int, 60)
+	}
+	for _, region := range layout {
+		for y := region.Bounds.Min.Y; y < region.Bounds.Max.Y; y++ {
+			for x := region.Bounds.Min.X; x < region.Bounds.Max.X; x++ {
+				covered[y][x]++
+			}
+		}
+	}
+	for y := range covered {
+		for x, n := range covered[y] {
+			if n != 1 {
+				t.Fatalf("%d,%d is covered by %d bricks", x, y, n)
+			}
+		}
+	}
+
+	tests := []struct {
+		location tile.Location
+		bounds   image.Rectangle
+	}{
+		{tile.Location{X: 0, Y: 0}, image.Rect(0, 0, 20, 10)},
+		{tile.Location{X: 0, Y: 1}, image.Rect(0, 10, 10, 20)},
+		{tile.Location{X: 1, Y: 1}, image.Rect(10, 10, 30, 20)},
+		{tile.Location{X: 3, Y: 1}, image.Rect(50, 10, 60, 20)},
+	}
+	for _, test := range tests {
+		region := layout.Find(test.location)
+		if region == nil || region.Bounds != test.bounds || layout.Named(test.location.String()) != region {
+			t.Errorf("brick %v is %+v, want bounds %v", test.location, region, test.bounds)
+		}
+	}
+	if layout.Find(tile.Location{X: 3, Y: 0}) != nil {
+		t.Error("even row has a fourth brick")
+	}
+}
+
+func TestLayoutCheck(t *testing.T) {
+	region := func(name string, x, y int, bounds image.Rectangle) tile.Region {
+		return tile.Region{Name: name, Location: tile.Location{X: x, Y: y}, Bounds: bounds}
+	}
+	tests := []struct {
+		name    string
+		layout  tile.Layout
+		problem string
+	}{
+		{"overlapping tiles", tile.Layout{region("sky", 0, 0, image.Rect(0, 0, 60, 30)), region("sun", 1, 0, image.Rect(40, 0, 60, 20))}, ""},
+		{"empty", tile.Layout{}, "at least one tile"},
+		{"unnamed", tile.Layout{region("", 0, 0, image.Rect(0, 0, 10, 10))}, "must have a name"},
+		{"name with a slash", tile.Layout{region("a/b", 0, 0, image.Rect(0, 0, 10, 10))}, "must have a name"},
+		{"same name", tile.Layout{region("sky", 0, 0, image.Rect(0, 0, 10, 10)), region("sky", 1, 0, image.Rect(0, 0, 10, 10))}, "more than one tile called sky"},
+		{"same location", tile.Layout{region("sky", 0, 0, image.Rect(0, 0, 10, 10)), region("sea", 0, 0, image.Rect(0, 0, 10, 10))}, "more than one tile at"},
+		{"negative location", tile.Layout{region("sky", -1, 0, image.Rect(0, 0, 10, 10))}, "negative location"},
+		{"past the right edge", tile.Layout{region("sky", 0, 0, image.Rect(50, 0, 61, 10))}, "not a part of the 60x40 image"},
+		{"no area", tile.Layout{region("sky", 0, 0, image.Rect(10, 10, 10, 20))}, "not a part of the 60x40 image"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.layout.Check(60, 40)
+			if test.problem == "" {
+				if err != nil {
+					t.Errorf("rejected with %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("returned %v, want a problem with %q", err, test.problem)
+			}
+		})
+	}
+}
@@ -1,6 +1,99 @@
 package tile
 
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
 type Location struct {
 	X int
 	Y int
-}
\ No newline at end of file
+}
+
+func (l Location) String() string {
+	return fmt.Sprintf("%d,%d", l.X, l.Y)
+}
+
+// ParseLocation reads a location written by Location.String
+func ParseLocation(s string) (Location, error) {
+	l := Location{}
+	var rest string
+	n, _ := fmt.Sscanf(s, "%d,%d%s", &l.X, &l.Y, &rest)
+	if n != 2 || l.String() != s {
+		return l, fmt.Errorf("%q is not a tile location", s)
+	}
+	return l, nil
+}
+
+// Version is a single drawing saved for a tile. Versions are layered in
+// order when the tile is rendered, so transparent pixels in a version show
+// the version beneath it, or the source image if there is none.
+type Version struct {
+	Number   int               `json:"number"`
+	Format   string            `json:"format"`
+	Opaque   bool              `json:"opaque"`
+	Created  time.Time         `json:"created"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Contributor is who drew the version, nil if they weren't credited
+	Contributor *Contributor `json:"contributor,omitempty"`
+}
+
+// Filename is the name of the version's image file within the tile folder
+func (v Version) Filename() string {
+	return fmt.Sprintf("%d%s", v.Number, Extension(v.Format))
+}
+
+type Tile struct {
+	Location Location  `json:"location"`
+	Versions []Version `json:"versions"`
+}
+
+// Latest returns the most recent version of the tile, or nil if the tile
+// has never been drawn
+func (t *Tile) Latest() *Version {
+	if len(t.Versions) == 0 {
+		return nil
+	}
+	return &t.Versions[len(t.Versions)-1]
+}
+
+// Layers returns the versions which contribute to the rendered tile: the
+// most recent opaque version and everything saved after it
+func (t *Tile) Layers() []Version {
+	for n := len(t.Versions) - 1; n >= 0; n-- {
+		if t.Versions[n].Opaque {
+			return t.Versions[n:]
+		}
+	}
+	return t.Versions
+}
+
+// Extension returns the file extension used to store images of the given
+// format, as named by image.Decode
+func Extension(format string) string {
+	switch format {
+	case "png":
+		return ".png"
+	default:
+		return ".jpg"
+	}
+}
+
+// MediaType returns the MIME type of images in format
+func MediaType(format string) string {
+	return "image/" + format
+}
+
+// FormatOf returns the image format, as named by image.Decode, for the MIME
+// type mediaType. It returns an empty string if mediaType isn't an image.
+func FormatOf(mediaType string) string {
+	if !strings.HasPrefix(mediaType, "image/") {
+		return ""
+	}
+	format := strings.TrimPrefix(mediaType, "image/")
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
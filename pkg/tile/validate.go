@@ -0,0 +1,173 @@
+package tile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Limits restrict the images which are accepted as tile submissions
+type Limits struct {
+	MaxBytes  int64
+	MaxPixels int
+	Formats   []string
+}
+
+// DefaultLimits are applied to every tile submission. The serve command
+// overrides them from configuration.
+var DefaultLimits = Limits{
+	MaxBytes:  8 << 20,
+	MaxPixels: 4096 * 4096,
+	Formats:   []string{"jpeg", "png"},
+}
+
+// ValidationError describes why a submitted image was rejected. TooLarge is
+// set when the image exceeded a size limit rather than being malformed.
+type ValidationError struct {
+	Reason   string
+	TooLarge bool
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+func invalid(format string, args ...interface{}) error {
+	return &ValidationError{Reason: fmt.Sprintf(format, args...)}
+}
+
+func tooLarge(format string, args ...interface{}) error {
+	return &ValidationError{Reason: fmt.Sprintf(format, args...), TooLarge: true}
+}
+
+// Submission is an image submitted for a tile, decoded and validated. Data
+// holds the image exactly as it was encoded by the client.
+type Submission struct {
+	Image       image.Image
+	Format      string
+	Data        []byte
+	Metadata    map[string]string
+	Contributor *Contributor
+}
+
+// Allows reports whether images of format are accepted
+func (l Limits) Allows(format string) bool {
+	for _, f := range l.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Read decodes an encoded image from r, checking it against the limits as it
+// goes. The image must be exactly width by height pixels. Any problem with
+// the image is returned as a *ValidationError.
+func (l Limits) Read(r io.Reader, width, height int) (*Submission, error) {
+	var data bytes.Buffer
+	source := &errorReader{r: r}
+	reader := io.Reader(source)
+	if l.MaxBytes > 0 {
+		reader = io.LimitReader(reader, l.MaxBytes+1)
+	}
+	reader = io.TeeReader(reader, &data)
+
+	config, format, err := image.DecodeConfig(reader)
+	if err != nil {
+		return nil, l.readError(source, data.Len(), invalid("image data is not a recognised image: %v", err))
+	}
+	if !l.Allows(format) {
+		return nil, invalid("image format %s is not accepted", format)
+	}
+	if l.MaxPixels > 0 && config.Width*config.Height > l.MaxPixels {
+		return nil, tooLarge("image is %dx%d pixels, the maximum is %d pixels", config.Width, config.Height, l.MaxPixels)
+	}
+	if config.Width != width || config.Height != height {
+		return nil, invalid("image is %dx%d but the tile is %dx%d", config.Width, config.Height, width, height)
+	}
+
+	// the header has already been consumed, so replay it ahead of the rest
+	header := append([]byte(nil), data.Bytes()...)
+	img, _, err := image.Decode(io.MultiReader(bytes.NewReader(header), reader))
+	if err != nil {
+		return nil, l.readError(source, data.Len(), invalid("image data is truncated or corrupt: %v", err))
+	}
+
+	// anything after the end of the image still counts towards the limit
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return nil, l.readError(source, data.Len(), err)
+	}
+	if l.MaxBytes > 0 && int64(data.Len()) > l.MaxBytes {
+		return nil, tooLarge("image is larger than %d bytes", l.MaxBytes)
+	}
+
+	return &Submission{
+		Image:  img,
+		Format: format,
+		Data:   data.Bytes(),
+	}, nil
+}
+
+// readError explains a failure to decode an image. Running out of allowance
+// or failing to read the underlying data takes precedence over the decoder's
+// own complaint.
+func (l Limits) readError(source *errorReader, read int, err error) error {
+	if l.MaxBytes > 0 && int64(read) > l.MaxBytes {
+		return tooLarge("image is larger than %d bytes", l.MaxBytes)
+	}
+	switch cause := source.err.(type) {
+	case nil:
+		return err
+	case *ValidationError:
+		return cause
+	case base64.CorruptInputError:
+		return invalid("image data is not valid base64: %v", cause)
+	default:
+		return cause
+	}
+}
+
+// DataURLReader returns a reader of the image encoded in a base64 data URL,
+// such as those produced by HTMLCanvasElement.toDataURL. The data URL header
+// is optional, plain base64 is also accepted.
+func (l Limits) DataURLReader(r io.Reader) (io.Reader, error) {
+	reader := bufio.NewReader(r)
+	prefix, err := reader.Peek(len("data:"))
+	if err == nil && string(prefix) == "data:" {
+		header, err := reader.ReadSlice(',')
+		if err != nil {
+			return nil, invalid("data URL has no data")
+		}
+		mediaType := string(header[len("data:") : len(header)-1])
+		if !strings.HasSuffix(mediaType, ";base64") {
+			return nil, invalid("data URL is not base64 encoded")
+		}
+		mediaType = strings.TrimSuffix(mediaType, ";base64")
+		if format := FormatOf(mediaType); format == "" || !l.Allows(format) {
+			return nil, invalid("data URL media type %s is not accepted", mediaType)
+		}
+	}
+
+	return base64.NewDecoder(base64.StdEncoding, reader), nil
+}
+
+// errorReader remembers the first error, other than io.EOF, returned by the
+// reader it wraps
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+package tile_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andrewmyhre/donk-server/pkg/tile"
+)
+
+func encode(t *testing.T, format string, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLimitsRead(t *testing.T) {
+	small := encode(t, "png", 20, 10)
+	formats := []string{"jpeg", "png"}
+	limits := tile.Limits{MaxBytes: 4096, MaxPixels: 400, Formats: formats}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		limits   tile.Limits
+		width    int
+		height   int
+		format   string
+		invalid  bool
+		tooLarge bool
+	}{
+		{name: "png", data: small, limits: limits, width: 20, height: 10, format: "png"},
+		{name: "jpeg", data: encode(t, "jpeg", 20, 10), limits: limits, width: 20, height: 10, format: "jpeg"},
+		{name: "no size limits", data: encode(t, "png", 200, 100), limits: tile.Limits{Formats: formats}, width: 200, height: 100, format: "png"},
+		{name: "format not accepted", data: encode(t, "gif", 20, 10), limits: limits, width: 20, height: 10, invalid: true},
+		{name: "wrong size", data: small, limits: limits, width: 10, height: 20, invalid: true},
+		{name: "too many pixels", data: encode(t, "png", 30, 20), limits: limits, width: 30, height: 20, tooLarge: true},
+		// the pixel limit is checked from the header, before the wrong size
+		{name: "too many pixels for the tile", data: encode(t, "png", 30, 20), limits: limits, width: 20, height: 10, tooLarge: true},
+		{name: "too many bytes", data: small, limits: tile.Limits{MaxBytes: int64(len(small) - 1), Formats: formats}, width: 20, height: 10, tooLarge: true},
+		{name: "exactly max bytes", data: small, limits: tile.Limits{MaxBytes: int64(len(small)), Formats: formats}, width: 20, height: 10, format: "png"},
+		{name: "trailing data over max bytes", data: append(append([]byte{}, small...), make([]byte, 10)...),
+			limits: tile.Limits{MaxBytes: int64(len(small) + 5), Formats: formats}, width: 20, height: 10, tooLarge: true},
+		{name: "truncated", data: small[:len(small)/2], limits: limits, width: 20, height: 10, invalid: true},
+		{name: "not an image", data: []byte("hello"), limits: limits, width: 20, height: 10, invalid: true},
+		{name: "empty", limits: limits, width: 20, height: 10, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			submission, err := test.limits.Read(bytes.NewReader(test.data), test.width, test.height)
+			if !test.invalid && !test.tooLarge {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if submission.Format != test.format {
+					t.Errorf("read as %s, want %s", submission.Format, test.format)
+				}
+				if !bytes.Equal(submission.Data, test.data) {
+					t.Errorf("submission data isn't the image as it was sent")
+				}
+				return
+			}
+			verr, ok := err.(*tile.ValidationError)
+			if !ok {
+				t.Fatalf("got %v, want a validation error", err)
+			}
+			if verr.TooLarge != test.tooLarge {
+				t.Errorf("%q has TooLarge %v, want %v", verr.Reason, verr.TooLarge, test.tooLarge)
+			}
+		})
+	}
+}
+
+// failingReader returns data and then an error other than io.EOF
+type failingReader struct {
+	data []byte
+	err  error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestLimitsReadError(t *testing.T) {
+	small := encode(t, "png", 20, 10)
+	failure := io.ErrUnexpectedEOF
+	_, err := tile.DefaultLimits.Read(&failingReader{data: small[:len(small)/2], err: failure}, 20, 10)
+	if err != failure {
+		t.Errorf("got %v, want the reader's error", err)
+	}
+}
+
+func TestDataURLReader(t *testing.T) {
+	small := encode(t, "png", 20, 10)
+	encoded := base64.StdEncoding.EncodeToString(small)
+
+	tests := []struct {
+		name    string
+		url     string
+		invalid bool
+	}{
+		{"data URL", "data:image/png;base64," + encoded, false},
+		{"plain base64", encoded, false},
+		{"not base64 encoded", "data:image/png," + encoded, true},
+		{"media type not accepted", "data:image/gif;base64," + encoded, true},
+		{"no data", "data:image/png;base64", true},
+		{"corrupt base64", "data:image/png;base64,!!!" + encoded, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := tile.DefaultLimits.DataURLReader(strings.NewReader(test.url))
+			if err == nil {
+				_, err = tile.DefaultLimits.Read(reader, 20, 10)
+			}
+			if test.invalid {
+				if _, ok := err.(*tile.ValidationError); !ok {
+					t.Errorf("got %v, want a validation error", err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}